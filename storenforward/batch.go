@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/storenforward/codec"
+	"gsamples/storenforward/trace"
+	"gsamples/types"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+Batch publishing. Rather than one message per POST, a publisher can send many messages to BATCH_PATTERN in a single
+request, either as a JSON array:
+
+	[{"topic": "Bernie", "body": {...}}, {"topic": "Sanders", "body": {...}}]
+
+or as NDJSON - one object per line - when the Content-Type is application/x-ndjson. The topic can be left out of an
+item if the request URL has a topic parameter, which is then used as the default.
+
+Each item can carry an idempotency key, which works in the same way as the Idempotency-Key header on IN_PATTERN.
+Messages are stored atomically per topic and the reply is a JSON array with one result per message, in the order
+they were sent, giving the status and the sequence number the store assigned.
+
+The request can be gzipped, with a Content-Encoding of gzip, which is worth doing for a large batch. Large messages
+in a batch are compressed for storage in the same way as those sent on their own.
+
+A batch can have up to MAX_BATCH messages, in no more than MAX_BATCH_BYTES, before and after it's decompressed. It's
+read a message at a time, so one that's too big is turned away, with a 413, without being read in full.
+*/
+
+const (
+	NDJSON_TYPE     = "application/x-ndjson"
+	MAX_BATCH       = 10000    // The most messages we'll take in one request
+	MAX_BATCH_BYTES = 64 << 20 // and the most bytes
+	MULTI_STATUS    = 207      // Some, but not all, of the messages in a batch were stored
+	TOO_LARGE       = 413      // The batch has too many messages, or bytes
+)
+
+var errBatchSize = fmt.Errorf("more than %d messages", MAX_BATCH)
+
+// One message in a batch. Apart from the body, it's all optional.
+type batchItem struct {
+	Topic         string            `json:"topic"`         // Defaults to the topic in the URL
+	Body          json.RawMessage   `json:"body"`          // The message itself, forwarded to subscribers as is
+	Key           string            `json:"key"`           // Idempotency key
+	TTL           string            `json:"ttl"`           // Time to live, like the ttl parameter on IN_PATTERN
+	ContentType   string            `json:"contentType"`   // Defaults to JSON
+	CorrelationId string            `json:"correlationId"` // These all go in the message's envelope
+	ReplyTo       string            `json:"replyTo"`
+	ProducerId    string            `json:"producerId"`
+	Headers       map[string]string `json:"headers"`
+	TraceParent   string            `json:"traceparent"` // Where the message is in a trace, as the traceparent header
+}
+
+// What happened to one message in a batch.
+type batchResult struct {
+	Index  int    `json:"index"` // Position of the message in the batch
+	Topic  string `json:"topic"`
+	Status int    `json:"status"`              // HTTP style status for this message
+	Seq    uint64 `json:"seq,omitempty"`       // The sequence number given to the message, if stored
+	Dup    bool   `json:"duplicate,omitempty"` // The message had already been published; Seq is the original's
+	Error  string `json:"error,omitempty"`     // Why the message wasn't stored
+}
+
+// This function does the store and forward for a batch of messages.
+func (b *broker) processBatch(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		fmt.Println("recieved a non-POST request")
+		err := errors.New("Unsupported request method")
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	// The whole request can be compressed
+	var body io.Reader = http.MaxBytesReader(w, r.Body, MAX_BATCH_BYTES)
+	switch enc := r.Header.Get("Content-Encoding"); {
+	case codec.IsIdentity(enc):
+	case strings.EqualFold(enc, codec.GZIP):
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "Invalid batch - "+err.Error(), BAD_REQUEST)
+			return
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(w, gz, MAX_BATCH_BYTES)
+	default:
+		http.Error(w, "Unsupported Content-Encoding for a batch: "+enc, UNSUPPORTED_MEDIA_TYPE)
+		return
+	}
+
+	var items []batchItem
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), NDJSON_TYPE) {
+		items, err = readNDJSON(body)
+	} else {
+		items, err = readJSONArray(body)
+	}
+	var tooBig *http.MaxBytesError
+	if err == errBatchSize || errors.As(err, &tooBig) {
+		fmt.Printf("Batch too large: %+v\n", err)
+		http.Error(w, "Batch too large - "+err.Error(), TOO_LARGE)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error reading batch: %+v\n", err)
+		http.Error(w, "Invalid batch - "+err.Error(), BAD_REQUEST)
+		return
+	}
+
+	var results []batchResult
+	if b.cluster != nil && r.Header.Get(FORWARDED_HEADER) == "" {
+		results = b.cluster.storeBatch(items, r.URL.Query().Get("topic"))
+	} else {
+		results = b.storeBatch(items, r.URL.Query().Get("topic"))
+	}
+
+	status := http.StatusOK
+	for _, res := range results {
+		if res.Status != http.StatusOK {
+			status = MULTI_STATUS
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// Validate the batch, then store it and tell the subscribers, topic by topic. Nothing is stored unless it's
+// valid, but one bad message doesn't stop the rest.
+func (b *broker) storeBatch(items []batchItem, defTopic string) []batchResult {
+
+	results := make([]batchResult, len(items))
+	spans := make([]*trace.Span, len(items))
+	byTopic := make(map[string][]int) // The index of each valid message, grouped by topic
+	var topics []string               // The topics, in the order we first saw them
+	envs := make([]*types.Envelope, len(items))
+	now := time.Now()
+
+	for i, item := range items {
+		topic := item.Topic
+		if topic == "" {
+			topic = defTopic
+		}
+		results[i] = batchResult{Index: i, Topic: topic}
+		expires, err := expiryFrom(item.TTL, now)
+		if err == nil && topic != "" && len(item.Body) > 0 {
+			envs[i] = item.envelope(now, expires)
+			envs[i].Topic = topic
+			if err = b.validateMessage(envs[i]); err == nil {
+				b.compressForStore(envs[i])
+			}
+		}
+
+		switch {
+		case topic == "":
+			results[i].Status = BAD_REQUEST
+			results[i].Error = "Missing Topic"
+		case isReplyTopic(topic):
+			results[i].Status = BAD_REQUEST
+			results[i].Error = "Replies can't be sent in a batch"
+		case len(item.Body) == 0:
+			results[i].Status = BAD_REQUEST
+			results[i].Error = "Missing body"
+		case err != nil:
+			results[i].Status = BAD_REQUEST
+			results[i].Error = err.Error()
+		default:
+			if _, ok := byTopic[topic]; !ok {
+				topics = append(topics, topic)
+			}
+			byTopic[topic] = append(byTopic[topic], i)
+			spans[i] = b.startStore(envs[i])
+		}
+	}
+
+	for _, topic := range topics {
+		idx := byTopic[topic]
+		topicEnvs := make([]*types.Envelope, len(idx))
+		for j, i := range idx {
+			topicEnvs[j] = envs[i]
+		}
+
+		seqs, dups, err := b.addAllToStore(topicEnvs, topic)
+		for j, i := range idx {
+			if err != nil {
+				finishStore(spans[i], 0, false, err)
+				results[i].Status = UNAVAILABLE
+				results[i].Error = err.Error()
+				continue
+			}
+			finishStore(spans[i], seqs[j], dups[j], nil)
+			results[i].Status = http.StatusOK
+			results[i].Seq = seqs[j]
+			results[i].Dup = dups[j]
+		}
+	}
+	return results
+}
+
+// Put a batch item in an envelope. The header names are made canonical, as they would be if they'd been sent as
+// HTTP headers.
+func (item *batchItem) envelope(received time.Time, expires time.Time) *types.Envelope {
+
+	env := &types.Envelope{
+		Received:      received,
+		Expires:       expires,
+		ContentType:   item.ContentType,
+		CorrelationId: item.CorrelationId,
+		ReplyTo:       item.ReplyTo,
+		ProducerId:    item.ProducerId,
+		Key:           item.Key,
+		TraceParent:   item.TraceParent,
+		Body:          item.Body,
+	}
+	if env.ContentType == "" {
+		env.ContentType = types.DEFAULT_TYPE
+	}
+	if len(item.Headers) > 0 {
+		env.Headers = make(map[string]string, len(item.Headers))
+		for name, val := range item.Headers {
+			env.Headers[http.CanonicalHeaderKey(name)] = val
+		}
+	}
+	return env
+}
+
+// Read a batch sent as a JSON array, an item at a time.
+func readJSONArray(r io.Reader) ([]batchItem, error) {
+
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, errors.New("not a JSON array")
+	}
+
+	var items []batchItem
+	for dec.More() {
+		if len(items) == MAX_BATCH {
+			return nil, errBatchSize
+		}
+		var item batchItem
+		if err := dec.Decode(&item); err != nil {
+			return nil, fmt.Errorf("message %d: %w", len(items), err)
+		}
+		items = append(items, item)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Read a batch sent as NDJSON, skipping any blank lines.
+func readNDJSON(r io.Reader) ([]batchItem, error) {
+
+	var items []batchItem
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if len(items) == MAX_BATCH {
+			return nil, errBatchSize
+		}
+
+		var item batchItem
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Send a batch and read the results.
+func postBatch(t *testing.T, n *testNode, query, contentType string, body []byte, gzipped bool) (int, []batchResult) {
+
+	req, _ := http.NewRequest("POST", n.url+BATCH_PATTERN+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var results []batchResult
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == MULTI_STATUS {
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatalf("Cannot read results: %v", err)
+		}
+	}
+	return resp.StatusCode, results
+}
+
+// A batch for several topics is numbered per topic, in the order it was sent.
+func TestBatch(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	publish(t, n, "Orders", `{"Id":0}`)
+
+	batch := `[{"body":{"Id":1}}, {"topic":"Prices","body":{"Id":2}}, {"body":{"Id":3},"key":"k3"}, {"body":{"Id":4},"key":"k3"}]`
+	status, results := postBatch(t, n, "?topic=Orders", "application/json", []byte(batch), false)
+	if status != http.StatusOK || len(results) != 4 {
+		t.Fatalf("Batch got %d %+v", status, results)
+	}
+	want := []batchResult{
+		{Index: 0, Topic: "Orders", Status: 200, Seq: 2},
+		{Index: 1, Topic: "Prices", Status: 200, Seq: 1},
+		{Index: 2, Topic: "Orders", Status: 200, Seq: 3},
+		{Index: 3, Topic: "Orders", Status: 200, Seq: 3, Dup: true},
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("Result %d is %+v, not %+v", i, results[i], want[i])
+		}
+	}
+	if got := strings.Join(stored(n, "Orders"), "|"); got != `{"Id":0}|{"Id":1}|{"Id":3}` {
+		t.Errorf("Orders has %s", got)
+	}
+}
+
+// NDJSON, gzipped, with a bad message that doesn't stop the rest.
+func TestBatchNDJSON(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte("{\"topic\":\"Orders\",\"body\":{\"Id\":1}}\n\n{\"topic\":\"Orders\"}\n{\"body\":{\"Id\":3}}\n"))
+	gz.Close()
+
+	status, results := postBatch(t, n, "", NDJSON_TYPE, body.Bytes(), true)
+	if status != MULTI_STATUS || len(results) != 3 {
+		t.Fatalf("Batch got %d %+v", status, results)
+	}
+	if results[0].Status != 200 || results[0].Seq != 1 || results[1].Status != BAD_REQUEST || results[2].Error != "Missing Topic" {
+		t.Errorf("Results are %+v", results)
+	}
+
+	if status, _ := postBatch(t, n, "", "application/json", []byte(`{"not":"an array"}`), false); status != BAD_REQUEST {
+		t.Errorf("A batch that isn't an array got %d", status)
+	}
+}
+
+// A batch with more messages for a topic than the ring holds gets them all to the subscribers, and one with more than
+// MAX_BATCH is turned away.
+func TestBatchLarge(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	rec := newTestReceiver(t)
+	subscribeReceiver(t, n, rec, "Orders", url.Values{"batch": {"100"}})
+
+	var items []string
+	for i := 1; i <= BUFF_SIZE*2+20; i++ {
+		items = append(items, fmt.Sprintf(`{"body":{"Id":%d}}`, i))
+	}
+	status, results := postBatch(t, n, "?topic=Orders", "application/json", []byte("["+strings.Join(items, ",")+"]"), false)
+	if status != http.StatusOK || len(results) != len(items) {
+		t.Fatalf("Batch got %d with %d results", status, len(results))
+	}
+	eventually(t, "every message", func() bool { return len(rec.seqs()) >= len(items) })
+	for i, seq := range rec.seqs() {
+		if seq != uint64(i+1) || len(rec.seqs()) != len(items) {
+			t.Fatalf("Subscriber got %v", rec.seqs())
+		}
+	}
+
+	items = items[:0]
+	for i := 0; i <= MAX_BATCH; i++ {
+		items = append(items, `{"body":1}`)
+	}
+	if status, _ := postBatch(t, n, "?topic=Orders", "application/json", []byte("["+strings.Join(items, ",")+"]"), false); status != TOO_LARGE {
+		t.Errorf("A batch of %d got %d", len(items), status)
+	}
+	if status, _ := postBatch(t, n, "?topic=Orders", NDJSON_TYPE, []byte(strings.Join(items, "\n")), false); status != TOO_LARGE {
+		t.Errorf("An NDJSON batch of %d got %d", len(items), status)
+	}
+}
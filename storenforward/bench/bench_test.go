@@ -0,0 +1,69 @@
+package bench
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+
+	for _, spec := range []string{"constant:100", "poisson:2.5", "step:100,200@10s", "STEP:1@1ms"} {
+		if _, err := ParseRate(spec); err != nil {
+			t.Errorf("ParseRate(%s): %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "100", "constant:0", "poisson:x", "step:100,200", "step:100,-1@1s", "step:1@0s"} {
+		if _, err := ParseRate(spec); err == nil {
+			t.Errorf("ParseRate(%s) should have failed", spec)
+		}
+	}
+	for _, spec := range []string{"fixed:256", "uniform:100-100", "normal:1000,0"} {
+		if _, err := ParseSize(spec); err != nil {
+			t.Errorf("ParseSize(%s): %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"fixed:0", "uniform:200-100", "uniform:100", "normal:1000", "normal:-1,5", "big:1"} {
+		if _, err := ParseSize(spec); err == nil {
+			t.Errorf("ParseSize(%s) should have failed", spec)
+		}
+	}
+}
+
+func TestRatesAndSizes(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+	step, _ := ParseRate("step:100,200@10s")
+	for elapsed, want := range map[time.Duration]time.Duration{
+		0:                10 * time.Millisecond,
+		15 * time.Second: 5 * time.Millisecond,
+		time.Hour:        5 * time.Millisecond, // The last rate carries on
+	} {
+		if got := step.Gap(elapsed, rnd); got != want {
+			t.Errorf("Gap after %s is %s, not %s", elapsed, got, want)
+		}
+	}
+
+	size, _ := ParseSize("uniform:10-20")
+	for i := 0; i < 1000; i++ {
+		if n := size.Next(rnd); n < 10 || n > 20 {
+			t.Fatalf("uniform:10-20 gave %d", n)
+		}
+	}
+}
+
+func TestLatencies(t *testing.T) {
+
+	l := NewLatencies()
+	if s := l.Summary(); s.Count != 0 || s.P99 != 0 {
+		t.Errorf("Empty summary %v", s)
+	}
+	for i := 1000; i >= 1; i-- {
+		l.Record(time.Duration(i) * time.Millisecond)
+	}
+	s := l.Summary()
+	if s.Count != 1000 || s.P50 != 500*time.Millisecond || s.P99 != 990*time.Millisecond ||
+		s.P999 != 999*time.Millisecond || s.Max != time.Second || s.Mean != 500500*time.Microsecond {
+		t.Errorf("Summary %v", s)
+	}
+}
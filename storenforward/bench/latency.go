@@ -0,0 +1,96 @@
+/*
+Package bench has what the publisher's load generator and the subscriber's latency mode share: recording latencies
+and working out their percentiles, and the rates and message sizes a load can be described with.
+*/
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const MAX_SAMPLES = 1000000 // Latencies kept for the percentiles; after this many, a random sample of them is
+
+// Records latencies. It's safe for concurrent use.
+type Latencies struct {
+	mut     sync.Mutex
+	samples []time.Duration
+	count   int // How many have been recorded, which can be more than there are samples
+	total   time.Duration
+	max     time.Duration
+	rnd     *rand.Rand
+}
+
+func NewLatencies() *Latencies {
+	return &Latencies{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (l *Latencies) Record(d time.Duration) {
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.count++
+	l.total += d
+	if d > l.max {
+		l.max = d
+	}
+
+	// Keep every one to start with, then a random sample, which is still fair to the percentiles
+	if len(l.samples) < MAX_SAMPLES {
+		l.samples = append(l.samples, d)
+	} else if i := l.rnd.Intn(l.count); i < MAX_SAMPLES {
+		l.samples[i] = d
+	}
+}
+
+// The latencies recorded so far, summed up.
+type Summary struct {
+	Count int
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+	Max   time.Duration
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("n=%d mean=%s p50=%s p90=%s p99=%s p99.9=%s max=%s", s.Count, s.Mean, s.P50, s.P90, s.P99, s.P999, s.Max)
+}
+
+func (l *Latencies) Summary() Summary {
+
+	l.mut.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	s := Summary{Count: l.count, Max: l.max}
+	if l.count > 0 {
+		s.Mean = l.total / time.Duration(l.count)
+	}
+	l.mut.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s.P50 = percentile(sorted, 0.5)
+	s.P90 = percentile(sorted, 0.9)
+	s.P99 = percentile(sorted, 0.99)
+	s.P999 = percentile(sorted, 0.999)
+	return s
+}
+
+// The latency that the fraction p of the sorted samples are at or below.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
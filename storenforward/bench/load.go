@@ -0,0 +1,162 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+How a load is described on the command line.
+
+The rate, in messages a second, is one of:
+
+	constant:500          - evenly spaced
+	poisson:500           - at random, 500 a second on average, as independent clients would
+	step:100,200,400@10s  - 100 a second for 10s, then 200 for 10s, then 400 from then on
+
+The message size, in bytes, is one of:
+
+	fixed:256
+	uniform:100-2000      - anything in the range, equally likely
+	normal:1000,200       - mean and standard deviation, never less than 1
+*/
+
+// A rate says how long to wait before the next message.
+type Rate interface {
+	Gap(elapsed time.Duration, rnd *rand.Rand) time.Duration // elapsed is how long the load's been running
+}
+
+type constantRate float64
+
+func (r constantRate) Gap(time.Duration, *rand.Rand) time.Duration {
+	return time.Duration(float64(time.Second) / float64(r))
+}
+
+type poissonRate float64
+
+func (r poissonRate) Gap(_ time.Duration, rnd *rand.Rand) time.Duration {
+	return time.Duration(rnd.ExpFloat64() / float64(r) * float64(time.Second))
+}
+
+type stepRate struct {
+	rates []float64
+	every time.Duration
+}
+
+func (r stepRate) Gap(elapsed time.Duration, _ *rand.Rand) time.Duration {
+	step := int(elapsed / r.every)
+	if step >= len(r.rates) {
+		step = len(r.rates) - 1
+	}
+	return time.Duration(float64(time.Second) / r.rates[step])
+}
+
+func ParseRate(spec string) (Rate, error) {
+
+	kind, arg := splitSpec(spec)
+	switch kind {
+	case "constant", "poisson":
+		r, err := positive(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad rate %q: %v", spec, err)
+		}
+		if kind == "constant" {
+			return constantRate(r), nil
+		}
+		return poissonRate(r), nil
+
+	case "step":
+		at := strings.LastIndex(arg, "@")
+		if at < 0 {
+			return nil, fmt.Errorf("bad rate %q: a step needs @duration", spec)
+		}
+		every, err := time.ParseDuration(arg[at+1:])
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("bad rate %q: bad step duration", spec)
+		}
+		r := stepRate{every: every}
+		for _, s := range strings.Split(arg[:at], ",") {
+			rate, err := positive(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad rate %q: %v", spec, err)
+			}
+			r.rates = append(r.rates, rate)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("unknown rate %q; it's constant:, poisson: or step:", spec)
+}
+
+// A size says how big the next message is.
+type Size interface {
+	Next(rnd *rand.Rand) int
+}
+
+type fixedSize int
+
+func (s fixedSize) Next(*rand.Rand) int { return int(s) }
+
+type uniformSize struct{ min, max int }
+
+func (s uniformSize) Next(rnd *rand.Rand) int { return s.min + rnd.Intn(s.max-s.min+1) }
+
+type normalSize struct{ mean, stddev float64 }
+
+func (s normalSize) Next(rnd *rand.Rand) int {
+	return int(math.Max(1, math.Round(rnd.NormFloat64()*s.stddev+s.mean)))
+}
+
+func ParseSize(spec string) (Size, error) {
+
+	kind, arg := splitSpec(spec)
+	switch kind {
+	case "fixed":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad size %q", spec)
+		}
+		return fixedSize(n), nil
+
+	case "uniform":
+		parts := strings.SplitN(arg, "-", 2)
+		if len(parts) == 2 {
+			min, err1 := strconv.Atoi(parts[0])
+			max, err2 := strconv.Atoi(parts[1])
+			if err1 == nil && err2 == nil && min > 0 && max >= min {
+				return uniformSize{min, max}, nil
+			}
+		}
+		return nil, fmt.Errorf("bad size %q; it's uniform:min-max", spec)
+
+	case "normal":
+		parts := strings.SplitN(arg, ",", 2)
+		if len(parts) == 2 {
+			mean, err1 := strconv.ParseFloat(parts[0], 64)
+			stddev, err2 := strconv.ParseFloat(parts[1], 64)
+			if err1 == nil && err2 == nil && mean > 0 && stddev >= 0 {
+				return normalSize{mean, stddev}, nil
+			}
+		}
+		return nil, fmt.Errorf("bad size %q; it's normal:mean,stddev", spec)
+	}
+	return nil, fmt.Errorf("unknown size %q; it's fixed:, uniform: or normal:", spec)
+}
+
+func splitSpec(spec string) (string, string) {
+	if i := strings.Index(spec, ":"); i >= 0 {
+		return strings.ToLower(spec[:i]), spec[i+1:]
+	}
+	return strings.ToLower(spec), ""
+}
+
+func positive(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("%q isn't a positive number", s)
+	}
+	return f, nil
+}
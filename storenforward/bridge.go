@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Bridging. A storenforward can mirror topics from another one, e.g. at another site, by subscribing to them there like
+any other subscriber and publishing what it's sent to its own topics. Each -bridge flag sets up the topics to mirror
+from one other storenforward:
+
+	-bridge "http://siteb:7868 Bernie=siteb.*,Orders"
+
+That mirrors Bernie on siteb to siteb.Bernie here - a * in the local name is replaced by the remote topic - and
+Orders to Orders. The flag can be given more than once.
+
+A bridged message keeps its body and metadata, apart from its sequence number, which is given by us. Every
+storenforward it's passed through is added to its VIA_HEADER, and a message that has already been through this one
+is dropped, so topics can be mirrored both ways, or round a ring of sites, without going round in circles. For that
+each storenforward needs its own -name, which it gives out on subscribe in BROKER_HEADER.
+
+A bridge subscribes again every BRIDGE_REFRESH, in case the other end has restarted and forgotten it. The replay of
+what's already stored that comes with subscribing is filtered out by the idempotency window, as each bridged
+message's key is made from where it came from. Messages sent while this end is down are lost, as for any other
+subscriber, apart from those still in the other end's store when it's back. In a cluster, bridges should only be set
+up on one of the nodes.
+*/
+
+const (
+	BRIDGE_PATTERN = "/bridge"    // Messages from the other storenforwards are sent here
+	BROKER_HEADER  = "X-Broker"   // Set on the reply to a subscribe, giving the storenforward's name
+	VIA_HEADER     = "Bridge-Via" // The envelope header listing the storenforwards a message has been through
+	BRIDGE_BATCH   = 100          // Ask the other end to send up to this many messages at once
+	BRIDGE_LINGER  = 50           // and to wait this many milliseconds to fill a batch
+	BRIDGE_QUEUE   = 10000        // and to queue this many for us
+	BRIDGE_REFRESH = time.Minute
+	BRIDGE_RETRY   = 5 * time.Second // How long to wait before trying again when the other end can't be reached
+)
+
+// One topic mirrored from another storenforward.
+type bridgeRoute struct {
+	remote     string      // The other storenforward's URL
+	topic      string      // The topic there
+	local      string      // The topic here
+	mut        *sync.Mutex // Guards remoteName
+	remoteName string      // What the other end calls itself
+}
+
+// The values of a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, " ") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Add the topics to mirror given by a -bridge flag.
+func (b *broker) addBridge(spec string) error {
+
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return fmt.Errorf("a bridge is a URL and a list of topics, got %q", spec)
+	}
+
+	remote := strings.TrimRight(fields[0], "/")
+	if u, err := url.Parse(remote); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q isn't a storenforward URL", fields[0])
+	}
+
+	for _, rule := range strings.Split(fields[1], ",") {
+		topic, local := rule, "*"
+		if i := strings.Index(rule, "="); i >= 0 {
+			topic, local = rule[:i], rule[i+1:]
+		}
+		if topic == "" || local == "" {
+			return fmt.Errorf("bad topic rule %q", rule)
+		}
+		b.bridges = append(b.bridges, &bridgeRoute{
+			remote: remote,
+			topic:  topic,
+			local:  strings.Replace(local, "*", topic, -1),
+			mut:    &sync.Mutex{},
+		})
+	}
+	return nil
+}
+
+// Keep a bridge subscribed until the broker's stopped.
+func (b *broker) runBridge(n int, r *bridgeRoute) {
+
+	for {
+		wait := BRIDGE_REFRESH
+		if err := b.subscribeBridge(n, r); err != nil {
+			fmt.Printf("Cannot subscribe to %s on %s: %+v\n", r.topic, r.remote, err)
+			wait = BRIDGE_RETRY
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Subscribe to a bridged topic on the other storenforward. Our id is made from our URL and the local topic, so it
+// stays the same each time and a new subscription replaces the old one.
+func (b *broker) subscribeBridge(n int, r *bridgeRoute) error {
+
+	h := fnv.New32a()
+	h.Write([]byte(b.advertise + "|" + r.local))
+
+	params := url.Values{}
+	params.Set("id", strconv.Itoa(int(h.Sum32()&0x7fffffff)))
+	params.Set("topic", r.topic)
+	params.Set("replyto", b.advertise+BRIDGE_PATTERN+"?route="+strconv.Itoa(n))
+	params.Set("batch", strconv.Itoa(BRIDGE_BATCH))
+	params.Set("linger", strconv.Itoa(BRIDGE_LINGER))
+	params.Set("queue", strconv.Itoa(BRIDGE_QUEUE))
+
+	req, err := http.NewRequest("GET", r.remote+SUB_PATTERN+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept-Encoding", "zstd, gzip, deflate") // Keep compressed messages compressed
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	name := resp.Header.Get(BROKER_HEADER)
+	if name == "" {
+		name = r.remote
+	}
+	r.mut.Lock()
+	r.remoteName = name
+	r.mut.Unlock()
+	return nil
+}
+
+// The other end of a bridge has sent us messages.
+func (b *broker) processBridged(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		fmt.Println("recieved a non-POST request")
+		err := errors.New("Unsupported request method")
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	n, err := strconv.Atoi(r.URL.Query().Get("route"))
+	if err != nil || n < 0 || n >= len(b.bridges) {
+		http.Error(w, "No such bridge", http.StatusNotFound)
+		return
+	}
+	route := b.bridges[n]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Printf("Error reading body: %+v\n", err)
+		http.Error(w, "Cannot read messages", BAD_REQUEST)
+		return
+	}
+
+	// The same as a subscriber gets: a batch is a JSON array of envelopes, otherwise it's one with the metadata in the headers
+	var envs []*types.Envelope
+	if r.Header.Get(BATCH_HEADER) != "" {
+		if err := json.Unmarshal(body, &envs); err != nil {
+			fmt.Printf("Error unmarshalling batch: %+v\n", err)
+			http.Error(w, "Invalid batch", BAD_REQUEST)
+			return
+		}
+	} else {
+		envs = append(envs, types.ReadEnvelope(r.Header, body))
+	}
+
+	var bridged []*types.Envelope
+	for _, env := range envs {
+		if env := b.bridgeMessage(route, env); env != nil {
+			bridged = append(bridged, env)
+		}
+	}
+
+	if len(bridged) > 0 {
+		if _, _, err := b.addAllToStore(bridged, route.local); err != nil {
+			fmt.Printf("Cannot store bridged messages for %s: %+v\n", route.local, err)
+			http.Error(w, "Cannot store messages - "+err.Error(), UNAVAILABLE)
+			return
+		}
+	}
+	fmt.Printf("Bridged %d of %d messages from %s on %s to %s\n", len(bridged), len(envs), route.topic, route.remote, route.local)
+	w.Write([]byte("OK"))
+}
+
+// Turn a message from the other end of a bridge into one of ours. It's nil if the message has already been through
+// here, or it isn't valid here.
+func (b *broker) bridgeMessage(route *bridgeRoute, env *types.Envelope) *types.Envelope {
+
+	route.mut.Lock()
+	remoteName := route.remoteName
+	route.mut.Unlock()
+	if remoteName == "" {
+		remoteName = route.remote
+	}
+
+	var via []string
+	if v := env.Headers[VIA_HEADER]; v != "" {
+		via = strings.Split(v, ",")
+	}
+	for _, name := range via {
+		if name == b.name {
+			fmt.Printf("Dropping message %d from %s, as it's already been through here\n", env.Sequence, route.remote)
+			return nil
+		}
+	}
+	if len(via) == 0 || via[len(via)-1] != remoteName {
+		via = append(via, remoteName)
+	}
+	via = append(via, b.name)
+
+	bridged := *env
+	bridged.Topic = route.local
+	bridged.Sequence = 0
+	bridged.Received = time.Now()
+	bridged.Key = fmt.Sprintf("bridge:%s:%s:%d:%d", remoteName, route.topic, env.Sequence, env.Received.UnixNano())
+	bridged.Headers = make(map[string]string, len(env.Headers)+1)
+	for name, val := range env.Headers {
+		bridged.Headers[name] = val
+	}
+	bridged.Headers[VIA_HEADER] = strings.Join(via, ",")
+
+	if err := b.validateMessage(&bridged); err != nil {
+		fmt.Printf("Dropping message %d from %s: %+v\n", env.Sequence, route.remote, err)
+		return nil
+	}
+	b.compressForStore(&bridged)
+	return &bridged
+}
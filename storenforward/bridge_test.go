@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/types"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Listen on loopback for a broker that's started later, once everything that needs its URL is known.
+func listen(t *testing.T) (net.Listener, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	return ln, "http://" + ln.Addr().String()
+}
+
+// Start a broker that isn't part of a cluster, with the given bridges.
+func startBroker(t *testing.T, ln net.Listener, name string, bridges ...string) *testNode {
+
+	b := newBroker()
+	b.name = name
+	b.advertise = "http://" + ln.Addr().String()
+	for _, spec := range bridges {
+		if err := b.addBridge(spec); err != nil {
+			t.Fatalf("addBridge(%q): %v", spec, err)
+		}
+	}
+	b.start()
+
+	n := &testNode{url: b.advertise, b: b, srv: &http.Server{Handler: b.handler()}}
+	go n.srv.Serve(ln)
+	t.Cleanup(n.kill)
+	return n
+}
+
+func subscribed(n *testNode, topic string) bool {
+	n.b.subMut.RLock()
+	defer n.b.subMut.RUnlock()
+	return len(n.b.submap[topic]) > 0
+}
+
+func TestBridgeBothWays(t *testing.T) {
+
+	lnA, urlA := listen(t)
+	lnB, urlB := listen(t)
+	siteA := startBroker(t, lnA, "siteA", urlB+" Orders")
+	siteB := startBroker(t, lnB, "siteB", urlA+" Orders,Bernie=siteA.*")
+
+	eventually(t, "the bridges to subscribe", func() bool {
+		return subscribed(siteA, "Orders") && subscribed(siteB, "Orders") && subscribed(siteA, "Bernie")
+	})
+
+	publish(t, siteA, "Orders", `{"Id":1}`)
+	publish(t, siteB, "Orders", `{"Id":2}`)
+	publish(t, siteA, "Bernie", `{"Id":3}`)
+
+	eventually(t, "Orders to be mirrored", func() bool {
+		return len(stored(siteA, "Orders")) == 2 && len(stored(siteB, "Orders")) == 2
+	})
+	eventually(t, "Bernie to be mirrored under its new name", func() bool {
+		return len(stored(siteB, "siteA.Bernie")) == 1
+	})
+
+	// Nothing comes back round
+	time.Sleep(300 * time.Millisecond)
+	if a, b := stored(siteA, "Orders"), stored(siteB, "Orders"); len(a) != 2 || len(b) != 2 {
+		t.Errorf("Messages went round in circles: siteA has %q, siteB has %q", a, b)
+	}
+
+	// The one that came over the bridge says where it's been
+	var via string
+	rb := siteB.b.getRingBuf("Orders")
+	rb.mut.Lock()
+	rb.buf.Do(func(val interface{}) {
+		if env, ok := val.(*types.Envelope); ok && string(env.Body) == `{"Id":1}` {
+			via = env.Headers[VIA_HEADER]
+		}
+	})
+	rb.mut.Unlock()
+	if via != "siteA,siteB" {
+		t.Errorf("Bridged message came via %q", via)
+	}
+}
+
+// A bridged batch bigger than the ring gets to the mirror topic's subscribers in full.
+func TestBridgeLargeBatch(t *testing.T) {
+
+	lnA, _ := listen(t)
+	lnB, urlB := listen(t)
+	siteA := startBroker(t, lnA, "siteA", urlB+" Orders")
+	siteB := startBroker(t, lnB, "siteB")
+	eventually(t, "the bridge to subscribe", func() bool { return subscribed(siteB, "Orders") })
+
+	rec := newTestReceiver(t)
+	subscribeReceiver(t, siteA, rec, "Orders", url.Values{"batch": {"100"}})
+	var envs []*types.Envelope
+	for i := 1; i <= BRIDGE_BATCH+BUFF_SIZE; i++ {
+		envs = append(envs, &types.Envelope{ContentType: types.DEFAULT_TYPE, Body: []byte(fmt.Sprintf(`{"Id":%d}`, i))})
+	}
+	siteB.b.addAllToStore(envs, "Orders")
+
+	eventually(t, "every message to be mirrored", func() bool { return len(rec.seqs()) >= len(envs) })
+	for i, seq := range rec.seqs() {
+		if seq != uint64(i+1) || len(rec.seqs()) != len(envs) {
+			t.Fatalf("Subscriber got %v", rec.seqs())
+		}
+	}
+}
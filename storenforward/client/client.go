@@ -0,0 +1,172 @@
+/*
+Package client is for talking to a storenforward from Go, so that publishers and subscribers don't each have to build
+the URLs and make the HTTP calls themselves.
+
+A Broker says where the storenforward is and how to talk to it: the http.Client, which by default is one that's
+shared and keeps connections open, and how many times to try again when something fails in a way that may go away -
+the storenforward can't be reached, or answers 429, 502, 503 or 504. Every call takes a context, which can cancel it,
+retries included. When the storenforward turns something down, the error is an *Error with the HTTP status.
+
+	p := client.NewPublisher("http://localhost:7868")
+	receipt, err := p.Publish(ctx, "Orders", &order)
+
+	s := client.NewSubscriber("http://localhost:7868", "Orders", client.NewId(), "http://me:8080/forward")
+	sub, err := s.Subscribe(ctx)
+	defer s.Unsubscribe(ctx)
+
+	// and in the handler for /forward
+	envs, err := client.ReadDelivery(r)
+	err = client.Decode(envs[0], &order)
+
+A Publisher can also send requests and wait for the reply, and reply to them - see request.go - and ExactlyOnce, in
+exactlyonce.go, is for subscribers that mustn't handle a message twice. A Consumer, in consumer.go, looks after the
+subscriptions to any number of topics, serves them all on one listener and hands each message to the handler for its
+topic, through whatever middleware it's been given.
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	MESSAGE_PATTERN     = "/message"
+	REQUEST_PATTERN     = "/request"
+	SUBSCRIBE_PATTERN   = "/subscribe"
+	UNSUBSCRIBE_PATTERN = "/unsubscribe"
+	BATCH_HEADER        = "X-Batch-Size" // Set by the storenforward when a delivery is a JSON array of messages
+	RETRIES             = 3              // How many more times to try after a failure that may go away, by default
+	BACKOFF             = 200 * time.Millisecond
+	TIMEOUT             = 10 * time.Second // How long to wait for the storenforward to answer, by default
+)
+
+// Shared by everything that doesn't bring its own http.Client, so connections to the storenforward are reused. There's
+// no overall timeout, as that's up to each call.
+var DefaultClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// The storenforward turned a call down.
+type Error struct {
+	Op      string // What we were trying to do
+	Status  int    // The HTTP status it answered with
+	Message string // What it said
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %d %s %s", e.Op, e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// Whether it's worth trying again later.
+func (e *Error) Temporary() bool {
+	switch e.Status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Where a storenforward is, and how to talk to it.
+type Broker struct {
+	URL     string        // e.g. http://localhost:7868
+	Client  *http.Client  // DefaultClient unless it's set
+	Retries int           // How many more times to try after a failure that may go away
+	Backoff time.Duration // How long to wait before trying again the first time; it doubles each time after that
+	Timeout time.Duration // How long to wait for an answer each time
+}
+
+func NewBroker(url string) *Broker {
+	return &Broker{
+		URL:     strings.TrimRight(url, "/"),
+		Client:  DefaultClient,
+		Retries: RETRIES,
+		Backoff: BACKOFF,
+		Timeout: TIMEOUT,
+	}
+}
+
+// Make a call to the storenforward, trying again if it fails in a way that may go away, and return the response and
+// its body, which has been read. Anything but a 2xx is an *Error. The call has to be safe to make more than once.
+func (b *Broker) do(ctx context.Context, op, method, path string, params url.Values, body []byte, h http.Header, timeout time.Duration) (*http.Response, []byte, error) {
+
+	client := b.Client
+	if client == nil {
+		client = DefaultClient
+	}
+	u := b.URL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	backoff := b.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, reply, err := b.once(ctx, client, method, u, body, h, timeout)
+		if err == nil && resp.StatusCode/100 != 2 {
+			err = &Error{Op: op, Status: resp.StatusCode, Message: strings.TrimSpace(string(reply))}
+		}
+		if err == nil {
+			return resp, reply, nil
+		}
+
+		// Only try again if it may work next time
+		if e, ok := err.(*Error); (ok && !e.Temporary()) || ctx.Err() != nil || attempt >= b.Retries {
+			return resp, reply, err
+		}
+		fmt.Printf("%s failed, trying again in %s: %+v\n", op, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// Make one attempt at a call.
+func (b *Broker) once(ctx context.Context, client *http.Client, method, u string, body []byte, h http.Header, timeout time.Duration) (*http.Response, []byte, error) {
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, vals := range h {
+		req.Header[name] = vals
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	// Reading it all lets the connection be reused
+	reply, err := ioutil.ReadAll(resp.Body)
+	return resp, reply, err
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"gsamples/types"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A storenforward that fails the first few publishes with the given status, and remembers the keys it was sent.
+type flakyBroker struct {
+	mut    sync.Mutex
+	fail   int
+	status int
+	keys   []string
+}
+
+func (f *flakyBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.keys = append(f.keys, r.Header.Get(types.KEY_HEADER))
+	if len(f.keys) <= f.fail {
+		http.Error(w, "not now", f.status)
+		return
+	}
+	w.Header().Set(types.SEQUENCE_HEADER, "7")
+	w.Write([]byte("OK"))
+}
+
+func testPublisher(url string) *Publisher {
+	p := NewPublisher(url)
+	p.Broker.Backoff = time.Millisecond
+	return p
+}
+
+func TestPublishRetries(t *testing.T) {
+
+	f := &flakyBroker{fail: 2, status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	receipt, err := testPublisher(srv.URL).Publish(context.Background(), "Orders", &types.Message{Id: 1})
+	if err != nil || receipt.Seq != 7 {
+		t.Fatalf("Publish got %+v, %v", receipt, err)
+	}
+
+	// Every try carries the same key, so the storenforward only stores it once
+	if len(f.keys) != 3 || f.keys[0] == "" || f.keys[0] != f.keys[2] {
+		t.Errorf("Sent keys %q", f.keys)
+	}
+}
+
+func TestPublishErrors(t *testing.T) {
+
+	f := &flakyBroker{fail: 100, status: http.StatusBadRequest}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	// A bad request isn't tried again
+	_, err := testPublisher(srv.URL).Publish(context.Background(), "Orders", &types.Message{Id: 1})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusBadRequest || e.Temporary() {
+		t.Errorf("Publish got %v", err)
+	}
+	if len(f.keys) != 1 {
+		t.Errorf("Bad request was tried %d times", len(f.keys))
+	}
+
+	// Cancelling stops the retries
+	f.status = http.StatusServiceUnavailable
+	p := testPublisher(srv.URL)
+	p.Broker.Retries = 1000
+	p.Broker.Backoff = 20 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := p.Publish(ctx, "Orders", &types.Message{Id: 2}); err != context.DeadlineExceeded {
+		t.Errorf("Cancelled publish got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+
+	var got map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		w.Header().Set(BATCH_HEADER, "10")
+		w.Header().Set("X-Linger", "50")
+	}))
+	defer srv.Close()
+
+	s := NewSubscriber(srv.URL, "Orders", "3", "http://me/forward")
+	s.Batch = 20
+	s.From = 5
+	sub, err := s.Subscribe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["id"][0] != "3" || got["from"][0] != "5" || got["batch"][0] != "20" || got["replyto"][0] != "http://me/forward" {
+		t.Errorf("Subscribed with %v", got)
+	}
+	if sub.Batch != 10 || sub.Linger != 50*time.Millisecond {
+		t.Errorf("Agreed %+v", sub)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("id"))
+		if len(got) > 1 {
+			http.Error(w, "no such subscriber", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewSubscriber(srv.URL, "Orders", NewId(), "http://me/forward")
+	for i := 0; i < 2; i++ {
+		if err := s.Unsubscribe(context.Background()); err != nil {
+			t.Errorf("Unsubscribe %d: %v", i, err)
+		}
+	}
+	if len(got) != 2 || got[0] != "POST /unsubscribe "+s.Id {
+		t.Errorf("Unsubscribed with %v", got)
+	}
+	if len(s.Id) != 36 || s.Id[14] != '4' || s.Id == NewId() {
+		t.Errorf("Not a new UUID: %s", s.Id)
+	}
+}
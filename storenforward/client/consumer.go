@@ -0,0 +1,361 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A Consumer subscribes to any number of topics and hands each message that's delivered to the handler registered for
+its topic. All the subscriptions share the one listener, and the one subscriber id, so a consumer can be stopped and
+started again as the same subscriber:
+
+	c := client.NewConsumer("http://localhost:7868")
+	c.Use(client.Recover, client.Logging, metrics.Middleware)
+	c.Handle("Orders", client.Decoding(newOrder)(client.HandlerFunc(handleOrder)))
+	c.HandleFunc("siteb.*", handleMirrored)
+	c.Subscribe("siteb.Orders", "siteb.Prices") // The topics the pattern's for
+	err := c.Start(ctx)
+	...
+	err = c.Stop(ctx) // Unsubscribes from everything
+
+A handler is registered for a topic, or for a pattern that matches topics as path.Match does, e.g. "orders.*". A topic
+with a handler of its own is subscribed to on Start; the storenforward can't subscribe to patterns, so the topics a
+pattern is for have to be given to Subscribe. A topic with a handler of its own uses it, otherwise it's the first
+pattern that matches, in the order they were registered.
+
+Middleware wraps every handler registered after it's added with Use, the first added outermost, so Use comes first.
+See middleware.go for what there is. The messages in a delivery are handled in order, and if one fails, the rest
+aren't handled and the delivery is answered with a 500. With Workers set, they're handled concurrently instead, in
+order for each key - see workers.go.
+*/
+
+const CONSUMER_PATTERN = "/forward" // Where the storenforward sends a consumer's messages, by default
+
+var ErrNoHandler = errors.New("no handler for the topic")
+
+// What's done with a message. An error means it wasn't handled.
+type Handler interface {
+	Handle(ctx context.Context, env *types.Envelope) error
+}
+
+type HandlerFunc func(ctx context.Context, env *types.Envelope) error
+
+func (f HandlerFunc) Handle(ctx context.Context, env *types.Envelope) error { return f(ctx, env) }
+
+// Middleware wraps a handler to do something before or after it, or instead of it.
+type Middleware func(next Handler) Handler
+
+type route struct {
+	pattern string
+	handler Handler // With the middleware
+}
+
+// Consumes the messages on a number of topics. The fields are for each subscription, and have to be set before Start.
+type Consumer struct {
+	Broker   *Broker
+	Id       string // The subscriber id for every topic; a new UUID by default
+	Listen   string // The address to listen on; any free port by default
+	Host     string // The host the storenforward can reach us on; by default the one we're listening on, or localhost
+	Pattern  string // The path the messages are sent to
+	ReplyTo  string // Where the messages are sent, if Listen is "" and the application serves the consumer itself
+	Batch    int
+	Linger   time.Duration
+	Queue    int
+	Overflow string
+	Accept   string
+	Encoding string
+	From     func(topic string) (uint64, error) // Where to start each topic from, e.g. ExactlyOnce.From; nil for all of it
+	Epoch    func(topic string) (string, error) // The store From is in, e.g. ExactlyOnce.Epoch
+	Workers  int                                // Handle messages on this many goroutines; 0 to handle them as they come in
+	OrderKey func(env *types.Envelope) string   // With Workers, messages with the same key are handled in order; by topic by default
+
+	mut        sync.Mutex
+	middleware []Middleware
+	topics     map[string]Handler
+	patterns   []route
+	extra      []string // Topics to subscribe to for the patterns
+	subs       []*Subscriber
+	pool       *workerPool
+	ln         net.Listener
+	srv        *http.Server
+}
+
+func NewConsumer(broker string) *Consumer {
+	return &Consumer{
+		Broker:  NewBroker(broker),
+		Id:      NewId(),
+		Listen:  ":0",
+		Pattern: CONSUMER_PATTERN,
+		topics:  make(map[string]Handler),
+	}
+}
+
+// Add middleware for the handlers registered from now on.
+func (c *Consumer) Use(mw ...Middleware) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.middleware = append(c.middleware, mw...)
+}
+
+// Register the handler for a topic, or for the topics matching a pattern.
+func (c *Consumer) Handle(pattern string, h Handler) {
+
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		panic("client: bad topic pattern " + strconv.Quote(pattern))
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		h = c.middleware[i](h)
+	}
+	if isPattern(pattern) {
+		c.patterns = append(c.patterns, route{pattern, h})
+	} else {
+		c.topics[pattern] = h
+	}
+}
+
+func (c *Consumer) HandleFunc(pattern string, f func(ctx context.Context, env *types.Envelope) error) {
+	c.Handle(pattern, HandlerFunc(f))
+}
+
+// Subscribe to topics that are handled by a pattern, on Start.
+func (c *Consumer) Subscribe(topics ...string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.extra = append(c.extra, topics...)
+}
+
+func isPattern(s string) bool { return strings.ContainsAny(s, `*?[\`) }
+
+// The handler for a topic, or nil if there isn't one.
+func (c *Consumer) handler(topic string) Handler {
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if h, ok := c.topics[topic]; ok {
+		return h
+	}
+	for _, r := range c.patterns {
+		if ok, _ := path.Match(r.pattern, topic); ok {
+			return r.handler
+		}
+	}
+	return nil
+}
+
+// Handle one message with the handler for its topic.
+func (c *Consumer) dispatch(ctx context.Context, env *types.Envelope) error {
+	h := c.handler(env.Topic)
+	if h == nil {
+		return ErrNoHandler
+	}
+	err := h.Handle(ctx, env)
+	if err != nil {
+		fmt.Printf("Cannot handle message %d on %s: %+v\n", env.Sequence, env.Topic, err)
+	}
+	return err
+}
+
+// Handle the messages in a delivery, on the workers if there are any, otherwise in order until one fails.
+func (c *Consumer) handleAll(ctx context.Context, envs []*types.Envelope) error {
+
+	c.mut.Lock()
+	pool := c.pool
+	c.mut.Unlock()
+	if pool != nil {
+		return pool.submit(ctx, envs)
+	}
+
+	for _, env := range envs {
+		if err := c.dispatch(ctx, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take a delivery from the storenforward, and handle what's in it. The consumer serves this itself once it's
+// started, but it can be used on a server of the application's own instead, with Listen set to "" and ReplyTo to
+// where it's served.
+func (c *Consumer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported request method", http.StatusMethodNotAllowed)
+		return
+	}
+	envs, err := ReadDelivery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, env := range envs {
+		if env.Topic == "" {
+			env.Topic = r.URL.Query().Get("topic")
+		}
+	}
+	if err := c.handleAll(r.Context(), envs); err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrStopped {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// Start listening, unless Listen is "", and subscribe to every topic. The reply to URL is made from the address
+// we're listening on, or it's ReplyTo. If any subscription fails, the ones that worked are undone.
+func (c *Consumer) Start(ctx context.Context) error {
+
+	if c.Workers > 0 {
+		c.mut.Lock()
+		c.pool = newWorkerPool(c.Workers, c.OrderKey, c.dispatch)
+		c.mut.Unlock()
+	}
+
+	base := c.ReplyTo
+	if c.Listen != "" {
+		ln, err := net.Listen("tcp", c.Listen)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle(c.Pattern, c)
+		srv := &http.Server{Handler: mux}
+		c.mut.Lock()
+		c.ln, c.srv = ln, srv
+		c.mut.Unlock()
+		go srv.Serve(ln)
+		base = c.replyURL(ln.Addr().(*net.TCPAddr))
+	}
+	if base == "" {
+		return errors.New("a consumer that isn't listening needs a ReplyTo")
+	}
+
+	for _, topic := range c.Topics() {
+		s := &Subscriber{
+			Broker:   c.Broker,
+			Topic:    topic,
+			Id:       c.Id,
+			ReplyTo:  base + "?" + url.Values{"topic": {topic}}.Encode(),
+			Batch:    c.Batch,
+			Linger:   c.Linger,
+			Queue:    c.Queue,
+			Overflow: c.Overflow,
+			Accept:   c.Accept,
+			Encoding: c.Encoding,
+		}
+		if c.From != nil {
+			from, err := c.From(topic)
+			if err != nil {
+				c.Stop(ctx)
+				return err
+			}
+			s.From = from
+		}
+		if c.Epoch != nil {
+			epoch, err := c.Epoch(topic)
+			if err != nil {
+				c.Stop(ctx)
+				return err
+			}
+			s.Epoch = epoch
+		}
+		if _, err := s.Subscribe(ctx); err != nil {
+			c.Stop(ctx)
+			return err
+		}
+		c.mut.Lock()
+		c.subs = append(c.subs, s)
+		c.mut.Unlock()
+	}
+	return nil
+}
+
+// The topics that are subscribed to on Start, in order.
+func (c *Consumer) Topics() []string {
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	seen := make(map[string]bool)
+	var topics []string
+	for _, t := range c.extra {
+		seen[t] = true
+	}
+	for t := range c.topics {
+		seen[t] = true
+	}
+	for t := range seen {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// The address we're listening on, once we've started; nil if we're not.
+func (c *Consumer) Addr() net.Addr {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Addr()
+}
+
+func (c *Consumer) replyURL(addr *net.TCPAddr) string {
+
+	host := c.Host
+	if host == "" {
+		host = "localhost"
+		if !addr.IP.IsUnspecified() {
+			host = addr.IP.String()
+		}
+	}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, strconv.Itoa(addr.Port)), Path: c.Pattern}
+	return u.String()
+}
+
+// Unsubscribe from everything, then stop listening once the messages being handled have been. It returns the first
+// thing that went wrong, having tried to do the rest anyway.
+func (c *Consumer) Stop(ctx context.Context) error {
+
+	c.mut.Lock()
+	subs, srv, pool := c.subs, c.srv, c.pool
+	c.subs, c.srv, c.ln = nil, nil, nil
+	c.mut.Unlock()
+
+	var first error
+	for _, s := range subs {
+		if err := s.Unsubscribe(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	if pool != nil {
+		pool.stop()
+	}
+	return first
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"gsamples/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A storenforward that remembers who's subscribed, and can send them messages.
+type fakeBroker struct {
+	mut     sync.Mutex
+	replyTo map[string]string // By topic
+	calls   []string
+}
+
+func (f *fakeBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.calls = append(f.calls, r.URL.Path+" "+q.Get("topic"))
+	switch r.URL.Path {
+	case SUBSCRIBE_PATTERN:
+		f.replyTo[q.Get("topic")] = q.Get("replyto")
+	case UNSUBSCRIBE_PATTERN:
+		delete(f.replyTo, q.Get("topic"))
+	}
+}
+
+// Send a batch to the subscriber for the topic, and say what it answered.
+func (f *fakeBroker) send(t *testing.T, topic string, envs ...*types.Envelope) int {
+	f.mut.Lock()
+	u := f.replyTo[topic]
+	f.mut.Unlock()
+	body, _ := json.Marshal(envs)
+	req, _ := http.NewRequest("POST", u, bytes.NewReader(body))
+	req.Header.Set(BATCH_HEADER, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Cannot send to %s: %v", topic, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestConsumer(t *testing.T) {
+
+	f := &fakeBroker{replyTo: make(map[string]string)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	var mut sync.Mutex
+	var got []string
+	record := func(s string) {
+		mut.Lock()
+		got = append(got, s)
+		mut.Unlock()
+	}
+
+	metrics := NewMetrics()
+	c := NewConsumer(srv.URL)
+	c.Use(Recover, metrics.Middleware)
+	c.Handle("Orders", Decoding(func() interface{} { return new(types.Message) })(HandlerFunc(func(ctx context.Context, env *types.Envelope) error {
+		record("order " + Decoded(ctx).(*types.Message).Content)
+		return nil
+	})))
+	c.HandleFunc("siteb.*", func(ctx context.Context, env *types.Envelope) error {
+		if string(env.Body) == "panic" {
+			panic("bad message")
+		}
+		record(env.Topic + " " + string(env.Body))
+		return nil
+	})
+	c.HandleFunc("siteb.Special", func(ctx context.Context, env *types.Envelope) error {
+		record("special")
+		return errors.New("failed")
+	})
+	c.Subscribe("siteb.Prices")
+
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if topics := c.Topics(); strings.Join(topics, ",") != "Orders,siteb.Prices,siteb.Special" {
+		t.Errorf("Subscribed to %v", topics)
+	}
+	if len(f.replyTo) != 3 || !strings.HasSuffix(f.replyTo["Orders"], CONSUMER_PATTERN+"?topic=Orders") {
+		t.Fatalf("Reply to %v", f.replyTo)
+	}
+
+	ok := f.send(t, "Orders", &types.Envelope{Topic: "Orders", Sequence: 1, ContentType: "application/json", Body: []byte(`{"Content":"one"}`)},
+		&types.Envelope{Topic: "Orders", Sequence: 2, ContentType: "application/json", Body: []byte(`{"Content":"two"}`)})
+	prices := f.send(t, "siteb.Prices", &types.Envelope{Sequence: 1, Body: []byte("99")}) // Topic from the URL
+	panicked := f.send(t, "siteb.Prices", &types.Envelope{Topic: "siteb.Prices", Sequence: 2, Body: []byte("panic")})
+	special := f.send(t, "siteb.Special", &types.Envelope{Topic: "siteb.Special", Sequence: 1})
+	unknown := f.send(t, "Orders", &types.Envelope{Topic: "Nobody", Sequence: 1})
+	if ok != 200 || prices != 200 || panicked != 500 || special != 500 || unknown != 500 {
+		t.Errorf("Deliveries answered %d %d %d %d %d", ok, prices, panicked, special, unknown)
+	}
+	if s := strings.Join(got, "|"); s != "order one|order two|siteb.Prices 99|special" {
+		t.Errorf("Handled %s", s)
+	}
+	m := metrics.Topics()
+	if m["Orders"].Handled != 2 || m["siteb.Prices"].Handled != 1 || m["siteb.Prices"].Failed != 1 || m["siteb.Special"].Failed != 1 {
+		t.Errorf("Metrics %+v", m)
+	}
+
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.replyTo) != 0 {
+		t.Errorf("Still subscribed to %v", f.replyTo)
+	}
+	var unsubs []string
+	for _, call := range f.calls {
+		if strings.HasPrefix(call, UNSUBSCRIBE_PATTERN) {
+			unsubs = append(unsubs, call)
+		}
+	}
+	if len(unsubs) != 3 {
+		t.Errorf("Unsubscribed with %v", unsubs)
+	}
+}
+
+func TestConsumerOnce(t *testing.T) {
+
+	var handled []uint64
+	eo := NewExactlyOnce(NewMemoryOffsetStore(), nil)
+	c := NewConsumer("http://localhost")
+	c.Use(eo.Middleware)
+	c.HandleFunc("Orders", func(ctx context.Context, env *types.Envelope) error {
+		handled = append(handled, env.Sequence)
+		return nil
+	})
+	for _, seq := range []uint64{1, 2, 1, 3, 2} {
+		if err := c.dispatch(context.Background(), &types.Envelope{Topic: "Orders", Sequence: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(handled) != 3 || handled[2] != 3 {
+		t.Errorf("Handled %v", handled)
+	}
+	if from, _ := eo.From("Orders"); from != 4 {
+		t.Errorf("From %d", from)
+	}
+}
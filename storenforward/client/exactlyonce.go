@@ -0,0 +1,314 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+/*
+Exactly once processing. A storenforward can send a subscriber the same message more than once - everything in the
+store is sent again whenever it subscribes - so a handler that mustn't run twice for a message needs to know what
+it's already done. Every message on a topic has a sequence number, one more than the last, so it's enough to keep
+the last sequence number processed on each topic, as long as it's kept together with whatever the handler changes:
+if the two were saved separately, a crash in between would lose a message or process it twice.
+
+The sequence numbers start again from 1 when the storenforward's store does, e.g. when it's restarted, so each
+message also has the Epoch of the store it's from, which is kept with the offset. A message from another epoch is
+from a new store, and is handled however far on the offset had got; and subscribing with the epoch means the
+storenforward sends the new store's messages from the start.
+
+An OffsetStore does that keeping. ExactlyOnce runs the handler for each message through the store and skips anything
+it's already processed. It's an http.Handler, so it can be the subscriber's reply to URL, and From gives the from
+parameter to subscribe with so that the storenforward only replays what hasn't been processed:
+
+	store, err := client.NewFileOffsetStore("offsets.json", &inventory)
+	eo := client.NewExactlyOnce(store, func(env *types.Envelope) error {
+		return inventory.apply(env) // Only changes inventory, which is saved with the offset
+	})
+	http.Handle("/forward", eo)
+	// and subscribe with from=eo.From("Orders") and epoch=eo.Epoch("Orders")
+
+Messages on a topic are handled one at a time, in order, but different topics' can be handled at the same time, as
+far as the OffsetStore allows. A handler that fails is tried again the next time the message is delivered, which for
+a message that's already been sent means subscribing again.
+*/
+
+// Where processing has got to on a topic.
+type Offset struct {
+	Epoch string `json:"epoch,omitempty"` // The store the sequence number is from; empty if the storenforward didn't say
+	Seq   uint64 `json:"seq"`
+}
+
+// An OffsetStore keeps the last sequence number processed on each topic, along with the application state that
+// processing changes, so that the two are always saved together.
+type OffsetStore interface {
+
+	// The last message processed on a topic; the zero Offset if there hasn't been one.
+	Offset(topic string) (Offset, error)
+
+	// Run apply, which makes the changes for processing a message, and record offset as processed on the topic, as
+	// one: if apply fails, or the changes can't be saved, then neither the changes nor the offset are kept. A store
+	// backed by a database would run apply in the same transaction that it updates the offset in. Commits are never
+	// made for the same topic at the same time, but can be for different ones.
+	Commit(topic string, offset Offset, apply func() error) error
+}
+
+// An OffsetStore that's only held in memory, for applications whose state is too. It's forgotten on restart.
+type MemoryOffsetStore struct {
+	mut     sync.Mutex
+	offsets map[string]Offset
+}
+
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{offsets: make(map[string]Offset)}
+}
+
+func (m *MemoryOffsetStore) Offset(topic string) (Offset, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.offsets[topic], nil
+}
+
+// There's nothing to save, so apply is run without the lock, and topics don't wait for each other.
+func (m *MemoryOffsetStore) Commit(topic string, offset Offset, apply func() error) error {
+	if err := apply(); err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.offsets[topic] = offset
+	return nil
+}
+
+// An OffsetStore that saves the offsets and the application's state, as JSON, in one file. The state is whatever
+// state points to, which the handlers change. The file is replaced in one go after each message, by writing a new one
+// and renaming it, so it always has the state and the offsets that go with it. If a handler fails, then state is put
+// back as it was. As the state's shared by every topic, one message is committed at a time, whatever its topic.
+type FileOffsetStore struct {
+	mut   sync.Mutex
+	path  string
+	state interface{}
+	saved fileState // What's in the file
+}
+
+// The contents of a FileOffsetStore's file.
+type fileState struct {
+	Offsets map[string]Offset `json:"offsets"`
+	State   json.RawMessage   `json:"state,omitempty"`
+}
+
+// Open a FileOffsetStore, reading the state back from the file if it's there. If it isn't, then the state as it is
+// now is what a failed handler's changes are undone to, until the first commit.
+func NewFileOffsetStore(path string, state interface{}) (*FileOffsetStore, error) {
+
+	f := &FileOffsetStore{path: path, state: state, saved: fileState{Offsets: make(map[string]Offset)}}
+
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if state != nil {
+			if f.saved.State, err = json.Marshal(state); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &f.saved); err != nil {
+		return nil, fmt.Errorf("%s isn't an offset file: %v", path, err)
+	}
+	if f.saved.Offsets == nil {
+		f.saved.Offsets = make(map[string]Offset)
+	}
+	if err := f.restore(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileOffsetStore) Offset(topic string) (Offset, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.saved.Offsets[topic], nil
+}
+
+func (f *FileOffsetStore) Commit(topic string, offset Offset, apply func() error) error {
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if err := apply(); err != nil {
+		f.restore()
+		return err
+	}
+
+	next := fileState{Offsets: make(map[string]Offset, len(f.saved.Offsets)+1)}
+	for t, o := range f.saved.Offsets {
+		next.Offsets[t] = o
+	}
+	next.Offsets[topic] = offset
+
+	var err error
+	if f.state != nil {
+		if next.State, err = json.Marshal(f.state); err != nil {
+			f.restore()
+			return err
+		}
+	}
+	if err := f.write(&next); err != nil {
+		f.restore()
+		return err
+	}
+	f.saved = next
+	return nil
+}
+
+// Put the state back to what was last saved. It's emptied first, as unmarshalling into a map, or a slice of structs,
+// would otherwise keep what the handler added.
+func (f *FileOffsetStore) restore() error {
+	if f.state == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(f.state); v.Kind() == reflect.Ptr && !v.IsNil() {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	}
+	if len(f.saved.State) == 0 {
+		return nil
+	}
+	return json.Unmarshal(f.saved.State, f.state)
+}
+
+// Replace the file, via a temporary one in the same directory so the rename can't leave half a file.
+func (f *FileOffsetStore) write(fs *fileState) error {
+
+	raw, err := json.Marshal(fs)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(raw); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Runs a handler at most once for each message, and - as long as everything's eventually delivered - exactly once.
+type ExactlyOnce struct {
+	store   OffsetStore
+	handler func(env *types.Envelope) error
+	mut     sync.Mutex             // Guards topics
+	topics  map[string]*sync.Mutex // One message at a time on each topic
+}
+
+func NewExactlyOnce(store OffsetStore, handler func(env *types.Envelope) error) *ExactlyOnce {
+	return &ExactlyOnce{store: store, handler: handler, topics: make(map[string]*sync.Mutex)}
+}
+
+// The from parameter to subscribe to a topic with: the message after the last one processed.
+func (e *ExactlyOnce) From(topic string) (uint64, error) {
+	offset, err := e.store.Offset(topic)
+	return offset.Seq + 1, err
+}
+
+// The epoch parameter to subscribe to a topic with: the store that From is a sequence number in.
+func (e *ExactlyOnce) Epoch(topic string) (string, error) {
+	offset, err := e.store.Offset(topic)
+	return offset.Epoch, err
+}
+
+// The lock for a topic's messages.
+func (e *ExactlyOnce) lock(topic string) *sync.Mutex {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	mut, ok := e.topics[topic]
+	if !ok {
+		mut = &sync.Mutex{}
+		e.topics[topic] = mut
+	}
+	return mut
+}
+
+// Handle a message, unless it's been handled already. It says whether it ran the handler.
+func (e *ExactlyOnce) Handle(env *types.Envelope) (bool, error) {
+	return e.handle(env, func() error { return e.handler(env) })
+}
+
+// As a Consumer's middleware, what's run for a message is the rest of the chain rather than the handler, which can be
+// nil. A message that's been handled already is skipped without an error. Give the consumer From too.
+func (e *ExactlyOnce) Middleware(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, env *types.Envelope) error {
+		_, err := e.handle(env, func() error { return next.Handle(ctx, env) })
+		return err
+	})
+}
+
+func (e *ExactlyOnce) handle(env *types.Envelope, apply func() error) (bool, error) {
+
+	if env.Sequence == 0 || env.Topic == "" {
+		return false, errors.New("a message needs its topic and sequence number to be handled exactly once")
+	}
+
+	mut := e.lock(env.Topic)
+	mut.Lock()
+	defer mut.Unlock()
+
+	last, err := e.store.Offset(env.Topic)
+	if err != nil {
+		return false, err
+	}
+	if env.Epoch != "" && last.Epoch != "" && env.Epoch != last.Epoch {
+		fmt.Printf("The store for %s has started again, at epoch %s after %s; carrying on from its message %d\n", env.Topic, env.Epoch, last.Epoch, env.Sequence)
+		last = Offset{}
+	}
+	if env.Sequence <= last.Seq {
+		return false, nil
+	}
+	if env.Sequence > last.Seq+1 && last.Seq != 0 {
+		fmt.Printf("Missed messages %d to %d on %s\n", last.Seq+1, env.Sequence-1, env.Topic)
+	}
+
+	err = e.store.Commit(env.Topic, Offset{Epoch: env.Epoch, Seq: env.Sequence}, apply)
+	return err == nil, err
+}
+
+// Take a delivery from the storenforward, one message or a batch, and handle what's in it. If a message can't be
+// handled, then the ones after it in a batch aren't either, so they're kept in order, and the reply is a 500.
+func (e *ExactlyOnce) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	envs, err := ReadDelivery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, env := range envs {
+		if _, err := e.Handle(env); err != nil {
+			fmt.Printf("Cannot handle message %d on %s: %+v\n", env.Sequence, env.Topic, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExactlyOnceSkipsRedelivery(t *testing.T) {
+
+	var handled []uint64
+	eo := NewExactlyOnce(NewMemoryOffsetStore(), func(env *types.Envelope) error {
+		handled = append(handled, env.Sequence)
+		return nil
+	})
+
+	// The replay on subscribing again sends 1 and 2 a second time
+	for _, seq := range []uint64{1, 2, 1, 2, 3} {
+		if _, err := eo.Handle(&types.Envelope{Topic: "Orders", Sequence: seq}); err != nil {
+			t.Fatalf("Handle(%d): %v", seq, err)
+		}
+	}
+	if len(handled) != 3 || handled[2] != 3 {
+		t.Errorf("Handled %v", handled)
+	}
+	if from, _ := eo.From("Orders"); from != 4 {
+		t.Errorf("From is %d", from)
+	}
+}
+
+func TestFileOffsetStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offsets.json")
+
+	var total struct{ Sum int }
+	store, err := NewFileOffsetStore(path, &total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Commit("Orders", Offset{Epoch: "e1", Seq: 1}, func() error { total.Sum += 10; return nil })
+
+	// A failed handler changes nothing
+	err = store.Commit("Orders", Offset{Epoch: "e1", Seq: 2}, func() error { total.Sum += 5; return errors.New("no") })
+	if err == nil || total.Sum != 10 {
+		t.Errorf("Failed commit left sum %d, err %v", total.Sum, err)
+	}
+
+	// The state and the offset come back together
+	var again struct{ Sum int }
+	store, err = NewFileOffsetStore(path, &again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off, _ := store.Offset("Orders"); off != (Offset{Epoch: "e1", Seq: 1}) || again.Sum != 10 {
+		t.Errorf("Reopened with offset %+v, sum %d", off, again.Sum)
+	}
+}
+
+// A failed handler's changes are undone on the first commit too, and a map is put back as it was, not merged.
+func TestFileOffsetStoreRollback(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var total struct{ Sum int }
+	store, err := NewFileOffsetStore(filepath.Join(dir, "total.json"), &total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Commit("Orders", Offset{Seq: 1}, func() error { total.Sum += 5; return errors.New("no") }); err == nil || total.Sum != 0 {
+		t.Errorf("Failed first commit left sum %d, err %v", total.Sum, err)
+	}
+
+	counts := map[string]int{}
+	store, err = NewFileOffsetStore(filepath.Join(dir, "counts.json"), &counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Commit("Orders", Offset{Seq: 1}, func() error { counts["a"]++; return nil })
+	store.Commit("Orders", Offset{Seq: 2}, func() error { counts["b"]++; return errors.New("no") })
+	if len(counts) != 1 || counts["a"] != 1 {
+		t.Errorf("Failed commit left %v", counts)
+	}
+}
+
+// A message from another epoch is from a store that's started again, so it's handled even though its sequence number
+// has been seen before.
+func TestExactlyOnceNewEpoch(t *testing.T) {
+
+	var handled []string
+	eo := NewExactlyOnce(NewMemoryOffsetStore(), func(env *types.Envelope) error {
+		handled = append(handled, fmt.Sprint(env.Epoch, ":", env.Sequence))
+		return nil
+	})
+	for _, env := range []*types.Envelope{
+		{Topic: "Orders", Epoch: "e1", Sequence: 1},
+		{Topic: "Orders", Epoch: "e1", Sequence: 2},
+		{Topic: "Orders", Epoch: "e2", Sequence: 1},
+		{Topic: "Orders", Epoch: "e2", Sequence: 1},
+		{Topic: "Orders", Epoch: "e2", Sequence: 2},
+	} {
+		if _, err := eo.Handle(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fmt.Sprint(handled); got != "[e1:1 e1:2 e2:1 e2:2]" {
+		t.Errorf("Handled %s", got)
+	}
+	if epoch, _ := eo.Epoch("Orders"); epoch != "e2" {
+		t.Errorf("Epoch is %q", epoch)
+	}
+}
+
+// A handler that's slow on one topic doesn't hold up the others.
+func TestExactlyOnceTopics(t *testing.T) {
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	eo := NewExactlyOnce(NewMemoryOffsetStore(), func(env *types.Envelope) error {
+		if env.Topic == "Slow" {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+	go eo.Handle(&types.Envelope{Topic: "Slow", Sequence: 1})
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, err := eo.Handle(&types.Envelope{Topic: "Orders", Sequence: 1})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Orders waited for Slow")
+	}
+	close(release)
+}
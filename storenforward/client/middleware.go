@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gsamples/storenforward/trace"
+	"gsamples/types"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Middleware for a Consumer's handlers. Each is a Middleware, or has a method that is, so they can be added with Use,
+or wrapped round one handler:
+
+	Recover                - turns a panic in the handler into an error, so one bad message doesn't take the consumer down
+	Logging                - prints how each message went and how long it took
+	Metrics.Middleware     - counts the messages handled and failed on each topic, and the time taken
+	Tracing(tracer)        - handles each message in a span of its trace, which the handler's context carries
+	Decoding(newValue)     - decodes each message into a new value of the handler's type, for Decoded to get
+	ExactlyOnce.Middleware - skips the messages that have been handled already, and commits the rest with their offsets
+
+Recover is best outermost, so it catches the rest too.
+*/
+
+// Turn a panic into an error.
+func Recover(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, env *types.Envelope) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				fmt.Printf("Panic handling message %d on %s: %v\n%s", env.Sequence, env.Topic, p, debug.Stack())
+				err = fmt.Errorf("panic handling message %d on %s: %v", env.Sequence, env.Topic, p)
+			}
+		}()
+		return next.Handle(ctx, env)
+	})
+}
+
+// Say how each message went.
+func Logging(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, env *types.Envelope) error {
+		start := time.Now()
+		err := next.Handle(ctx, env)
+		if err != nil {
+			fmt.Printf("Message %d on %s failed after %s: %+v\n", env.Sequence, env.Topic, time.Since(start), err)
+		} else {
+			fmt.Printf("Message %d on %s handled in %s\n", env.Sequence, env.Topic, time.Since(start))
+		}
+		return err
+	})
+}
+
+// Handle each message in a "handle" span, as a child of the span that delivered it, and put the span in the handler's
+// context, so that whatever it publishes with the context is part of the same trace. A message that's handled
+// without a traceparent starts a new trace. A nil tracer traces nothing.
+func Tracing(tracer *trace.Tracer) Middleware {
+	return func(next Handler) Handler {
+		if tracer == nil {
+			return next
+		}
+		return HandlerFunc(func(ctx context.Context, env *types.Envelope) error {
+			span := tracer.StartFrom("handle", env.TraceParent)
+			span.SetAttribute("topic", env.Topic)
+			span.SetAttribute("seq", strconv.FormatUint(env.Sequence, 10))
+			failed := errors.New("the handler panicked")
+			defer func() {
+				span.SetError(failed)
+				span.Finish()
+			}()
+			err := next.Handle(trace.ContextWithSpan(ctx, span), env)
+			failed = err
+			return err
+		})
+	}
+}
+
+// How the messages on a topic have gone.
+type TopicMetrics struct {
+	Handled uint64
+	Failed  uint64
+	Time    time.Duration // Spent handling them, failures included
+	Max     time.Duration // The longest any one took
+}
+
+// Counts the messages on each topic. It's safe for concurrent use.
+type Metrics struct {
+	mut    sync.Mutex
+	topics map[string]*TopicMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{topics: make(map[string]*TopicMetrics)}
+}
+
+// Count each message, as failed if the handler panics too.
+func (m *Metrics) Middleware(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, env *types.Envelope) error {
+		start := time.Now()
+		failed := true
+		defer func() { m.record(env.Topic, time.Since(start), failed) }()
+		err := next.Handle(ctx, env)
+		failed = err != nil
+		return err
+	})
+}
+
+func (m *Metrics) record(topic string, took time.Duration, failed bool) {
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	tm, ok := m.topics[topic]
+	if !ok {
+		tm = &TopicMetrics{}
+		m.topics[topic] = tm
+	}
+	if failed {
+		tm.Failed++
+	} else {
+		tm.Handled++
+	}
+	tm.Time += took
+	if took > tm.Max {
+		tm.Max = took
+	}
+}
+
+// The metrics so far, by topic.
+func (m *Metrics) Topics() map[string]TopicMetrics {
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	topics := make(map[string]TopicMetrics, len(m.topics))
+	for topic, tm := range m.topics {
+		topics[topic] = *tm
+	}
+	return topics
+}
+
+func (m *Metrics) String() string {
+
+	topics := m.Topics()
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+
+	s := ""
+	for _, topic := range names {
+		tm := topics[topic]
+		s += fmt.Sprintf("%s: handled %d, failed %d, took %s, longest %s\n", topic, tm.Handled, tm.Failed, tm.Time, tm.Max)
+	}
+	return s
+}
+
+type decodedKey struct{}
+
+// Decode each message into what newValue returns, which should be a pointer, e.g. func() interface{} { return
+// new(Order) }. The handler gets it from the context with Decoded. A message that can't be decoded isn't handled.
+func Decoding(newValue func() interface{}) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, env *types.Envelope) error {
+			v := newValue()
+			if err := Decode(env, v); err != nil {
+				return fmt.Errorf("cannot decode message %d on %s: %v", env.Sequence, env.Topic, err)
+			}
+			return next.Handle(context.WithValue(ctx, decodedKey{}, v), env)
+		})
+	}
+}
+
+// The message Decoding decoded; nil without it.
+func Decoded(ctx context.Context) interface{} {
+	return ctx.Value(decodedKey{})
+}
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The outbox. A publisher that can't always reach the storenforward can publish through an Outbox, which keeps what
+can't be sent yet in a directory, one file per message, and sends it when the storenforward's back:
+
+	o, err := client.NewOutbox(p, "/var/spool/orders", client.OUTBOX_MAX, client.OUTBOX_MAX_BYTES)
+	go o.Run(ctx)
+	err = o.Publish(ctx, "Orders", env)
+
+A message is sent straight away if nothing's waiting, otherwise it goes to the back of the queue, so they all arrive
+in the order they were published. Messages are only taken out of the outbox once the storenforward has them, and
+each has its idempotency key before it's written, so one that was sent but not acknowledged isn't stored twice when
+it's sent again. Run keeps trying until the queue's empty, waiting Retry after a failure, then twice as long after
+each failure in a row, up to OUTBOX_MAX_RETRY. Only a message the storenforward turns down as bad - a 4xx other than
+408 or 429 - is thrown away, as sending it again won't help; anything else, a 500 included, may go away, so the
+message is kept. Whatever's in the directory when the outbox is opened, e.g. after a restart, is sent first.
+
+The outbox holds at most a given number of messages and bytes; when it's full, Publish returns ErrOutboxFull.
+Stats says how it's getting on.
+*/
+
+const (
+	OUTBOX_MAX       = 100000          // The most messages an outbox holds, by default
+	OUTBOX_MAX_BYTES = 100 << 20       // and the most bytes
+	OUTBOX_RETRY     = 2 * time.Second // How long to wait before trying the storenforward again
+	OUTBOX_MAX_RETRY = time.Minute     // The longest to wait, however many times it's failed
+	OUTBOX_SUFFIX    = ".msg"
+)
+
+var ErrOutboxFull = errors.New("the outbox is full")
+
+// What the outbox has done so far.
+type OutboxStats struct {
+	Pending  int    // Messages waiting to be sent
+	Bytes    int64  // The size of their files
+	Direct   uint64 // Sent without being queued
+	Queued   uint64 // Queued because they couldn't be sent
+	Replayed uint64 // Sent from the queue
+	Rejected uint64 // Turned down by the storenforward as bad, and thrown away
+	Full     uint64 // Turned away because the outbox was full
+}
+
+// A message in the outbox, as it's written to its file.
+type outboxEntry struct {
+	Topic string          `json:"topic"`
+	Env   *types.Envelope `json:"env"`
+}
+
+type Outbox struct {
+	Retry time.Duration // How long to wait before trying the storenforward again; OUTBOX_RETRY unless it's changed
+
+	p        *Publisher
+	dir      string
+	max      int
+	maxBytes int64
+
+	mut   sync.Mutex // Guards everything below
+	files []string   // The messages waiting, oldest first
+	sizes map[string]int64
+	next  uint64 // The number for the next file
+	stats OutboxStats
+	wake  chan struct{} // Tells Run there's something new
+
+	send sync.Mutex // Held while sending, so messages go one at a time, in order
+}
+
+// Open an outbox in a directory, which is made if it isn't there. Anything that's already in it is queued.
+func NewOutbox(p *Publisher, dir string, max int, maxBytes int64) (*Outbox, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		Retry:    OUTBOX_RETRY,
+		p:        p,
+		dir:      dir,
+		max:      max,
+		maxBytes: maxBytes,
+		sizes:    make(map[string]int64),
+		next:     1,
+		wake:     make(chan struct{}, 1),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, OUTBOX_SUFFIX), 10, 64)
+		if err != nil || !strings.HasSuffix(name, OUTBOX_SUFFIX) {
+			continue
+		}
+		o.files = append(o.files, name)
+		o.sizes[name] = info.Size()
+		o.stats.Bytes += info.Size()
+		if n >= o.next {
+			o.next = n + 1
+		}
+	}
+	sort.Strings(o.files) // The names are zero padded, so this is oldest first
+	o.stats.Pending = len(o.files)
+	return o, nil
+}
+
+// Publish a message, or queue it if it can't be sent now or there are others waiting. The error is nil once it's
+// been sent or queued.
+func (o *Outbox) Publish(ctx context.Context, topic string, env *types.Envelope) error {
+
+	if env.Key == "" {
+		env.Key = o.p.nextKey()
+	}
+	if env.ProducerId == "" {
+		env.ProducerId = o.p.ProducerId
+	}
+
+	o.send.Lock()
+	o.mut.Lock()
+	waiting := len(o.files) > 0
+	o.mut.Unlock()
+
+	if !waiting {
+		_, err := o.p.PublishEnvelope(ctx, topic, env)
+		if err == nil || rejected(err) {
+			o.send.Unlock()
+			if err == nil {
+				o.mut.Lock()
+				o.stats.Direct++
+				o.mut.Unlock()
+			}
+			return err
+		}
+		fmt.Printf("Cannot publish to the storenforward, queueing: %+v\n", err)
+	}
+
+	// Queue it before letting anything else be sent, so nothing overtakes it
+	err := o.enqueue(topic, env)
+	o.send.Unlock()
+	return err
+}
+
+// Write a message to the back of the queue.
+func (o *Outbox) enqueue(topic string, env *types.Envelope) error {
+
+	raw, err := json.Marshal(&outboxEntry{Topic: topic, Env: env})
+	if err != nil {
+		return err
+	}
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	if len(o.files) >= o.max || o.stats.Bytes+int64(len(raw)) > o.maxBytes {
+		o.stats.Full++
+		return ErrOutboxFull
+	}
+
+	name := fmt.Sprintf("%020d%s", o.next, OUTBOX_SUFFIX)
+	if err := o.write(name, raw); err != nil {
+		return err
+	}
+
+	o.next++
+	o.files = append(o.files, name)
+	o.sizes[name] = int64(len(raw))
+	o.stats.Bytes += int64(len(raw))
+	o.stats.Pending = len(o.files)
+	o.stats.Queued++
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Write a message's file under another name, sync it, and rename it, then sync the directory, so there's never half a
+// message in the queue, and once this returns the message is on disk even if the power goes.
+func (o *Outbox) write(name string, raw []byte) error {
+
+	tmp := filepath.Join(o.dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(raw); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(o.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// If the rename can't be made to stick, then the message isn't queued
+	dir, err := os.Open(o.dir)
+	if err == nil {
+		err = dir.Sync()
+		dir.Close()
+	}
+	if err != nil {
+		os.Remove(filepath.Join(o.dir, name))
+	}
+	return err
+}
+
+// Send what's queued, oldest first, until the context's done.
+func (o *Outbox) Run(ctx context.Context) {
+
+	retry := o.Retry
+	for {
+		sent, err := o.sendOldest(ctx)
+		if sent {
+			retry = o.Retry
+			continue
+		}
+
+		var wait <-chan time.Time
+		if err != nil {
+			fmt.Printf("Cannot send from the outbox, trying again in %s: %+v\n", retry, err)
+			wait = time.After(retry)
+			if retry *= 2; retry > OUTBOX_MAX_RETRY {
+				retry = OUTBOX_MAX_RETRY
+			}
+		}
+		select {
+		case <-wait:
+		case <-o.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Send the oldest message in the queue. It says whether it took one off the queue, and why not if it should have.
+func (o *Outbox) sendOldest(ctx context.Context) (bool, error) {
+
+	o.send.Lock()
+	defer o.send.Unlock()
+
+	o.mut.Lock()
+	if len(o.files) == 0 {
+		o.mut.Unlock()
+		return false, nil
+	}
+	name := o.files[0]
+	o.mut.Unlock()
+
+	path := filepath.Join(o.dir, name)
+	raw, err := ioutil.ReadFile(path)
+	var entry outboxEntry
+	if err == nil {
+		err = json.Unmarshal(raw, &entry)
+	}
+	if err != nil || entry.Env == nil {
+		fmt.Printf("Throwing away unreadable %s: %+v\n", path, err)
+		o.remove(name, &o.stats.Rejected)
+		return true, nil
+	}
+
+	_, err = o.p.PublishEnvelope(ctx, entry.Topic, entry.Env)
+	if rejected(err) {
+		fmt.Printf("Throwing away message for %s from the outbox: %+v\n", entry.Topic, err)
+		o.remove(name, &o.stats.Rejected)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	o.remove(name, &o.stats.Replayed)
+	return true, nil
+}
+
+// Whether the storenforward has turned a message down for good: a 4xx, apart from a timeout or being told to slow
+// down. A 5xx, or not getting an answer, may go away.
+func rejected(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Status/100 == 4 && e.Status != http.StatusRequestTimeout && e.Status != http.StatusTooManyRequests
+}
+
+// Take the oldest message off the queue, and count it.
+func (o *Outbox) remove(name string, counter *uint64) {
+
+	os.Remove(filepath.Join(o.dir, name))
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	o.files = o.files[1:]
+	o.stats.Bytes -= o.sizes[name]
+	delete(o.sizes, name)
+	o.stats.Pending = len(o.files)
+	*counter++
+}
+
+func (o *Outbox) Stats() OutboxStats {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	return o.stats
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"gsamples/types"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A storenforward that can be taken down, and remembers what it's stored.
+type downBroker struct {
+	mut    sync.Mutex
+	down   bool
+	status int // What it answers with while it's down; 503 unless it's set
+	bodies []string
+}
+
+func (d *downBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.down {
+		status := d.status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "down", status)
+		return
+	}
+	if string(body) == "bad" {
+		http.Error(w, "invalid", http.StatusBadRequest)
+		return
+	}
+	d.bodies = append(d.bodies, string(body))
+}
+
+func (d *downBroker) stored() string {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return strings.Join(d.bodies, ",")
+}
+
+func TestOutbox(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &downBroker{down: true}
+	srv := httptest.NewServer(d)
+	defer srv.Close()
+	p := testPublisher(srv.URL)
+	p.Broker.Retries = 0
+
+	o, err := NewOutbox(p, dir, 10, OUTBOX_MAX_BYTES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, body := range []string{"1", "bad", "2", "3"} {
+		if err := o.Publish(ctx, "Orders", &types.Envelope{Body: []byte(body)}); err != nil {
+			t.Fatalf("Publish(%s): %v", body, err)
+		}
+	}
+	if s := o.Stats(); s.Pending != 4 || s.Queued != 4 {
+		t.Fatalf("Outbox stats %+v", s)
+	}
+
+	// What's queued survives a restart, and goes out in order once the storenforward's back
+	o, err = NewOutbox(p, dir, 10, OUTBOX_MAX_BYTES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Retry = 10 * time.Millisecond
+	if s := o.Stats(); s.Pending != 4 {
+		t.Fatalf("Reopened outbox has %d pending", s.Pending)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go o.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	d.mut.Lock()
+	d.down = false
+	d.mut.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for o.Stats().Pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := o.Publish(ctx, "Orders", &types.Envelope{Body: []byte("4")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := d.stored(); got != "1,2,3,4" {
+		t.Errorf("Stored %s", got)
+	}
+	if s := o.Stats(); s.Pending != 0 || s.Replayed != 3 || s.Rejected != 1 || s.Direct != 1 || s.Bytes != 0 {
+		t.Errorf("Outbox stats %+v", s)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files left in the outbox", len(files))
+	}
+}
+
+func TestOutboxFull(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(&downBroker{down: true})
+	defer srv.Close()
+	p := testPublisher(srv.URL)
+	p.Broker.Retries = 0
+
+	o, _ := NewOutbox(p, dir, 2, OUTBOX_MAX_BYTES)
+	for i := 0; i < 2; i++ {
+		o.Publish(context.Background(), "Orders", &types.Envelope{Body: []byte("x")})
+	}
+	if err := o.Publish(context.Background(), "Orders", &types.Envelope{Body: []byte("x")}); err != ErrOutboxFull {
+		t.Errorf("Publishing to a full outbox got %v", err)
+	}
+}
+
+// A message's only thrown away when the storenforward's turned it down for good; after a 500 it's kept until it's
+// stored.
+func TestOutboxServerError(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &downBroker{down: true, status: http.StatusInternalServerError}
+	srv := httptest.NewServer(d)
+	defer srv.Close()
+	p := testPublisher(srv.URL)
+	p.Broker.Retries = 0
+
+	o, _ := NewOutbox(p, dir, 10, OUTBOX_MAX_BYTES)
+	o.Retry = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := o.Publish(ctx, "Orders", &types.Envelope{Body: []byte("1")}); err != nil {
+		t.Fatalf("Publish after a 500 got %v", err)
+	}
+	go o.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	if s := o.Stats(); s.Pending != 1 || s.Rejected != 0 {
+		t.Fatalf("Outbox stats after 500s %+v", s)
+	}
+
+	d.mut.Lock()
+	d.down = false
+	d.mut.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for o.Stats().Pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := d.stored(); got != "1" {
+		t.Errorf("Stored %s", got)
+	}
+
+	for status, want := range map[int]bool{400: true, 404: true, 413: true, 408: false, 429: false, 500: false, 503: false} {
+		if got := rejected(&Error{Status: status}); got != want {
+			t.Errorf("A %d is rejected: %t", status, got)
+		}
+	}
+	if rejected(context.DeadlineExceeded) {
+		t.Errorf("A timeout is rejected")
+	}
+}
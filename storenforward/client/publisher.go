@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"gsamples/storenforward/codec"
+	"gsamples/storenforward/trace"
+	"gsamples/types"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DUPLICATE_HEADER  = "X-Duplicate"  // Set when a message had already been published
+	DELIVER_AT_HEADER = "X-Deliver-At" // Set when a message is being held until later
+)
+
+// Publishes messages to a storenforward.
+type Publisher struct {
+	count      uint64 // Messages published, for the idempotency keys. First, so that it's 64 bit aligned for sync/atomic.
+	Broker     *Broker
+	Codec      codec.Codec   // How messages are marshalled; JSON unless it's set
+	Encoding   string        // The Content-Encoding to compress messages with; none if it's empty
+	ProducerId string        // Sent with every message, if it's set
+	Tracer     *trace.Tracer // Adds a span for each message sent to its trace; nil for none
+
+	keyPrefix string // Makes the idempotency keys unique to this publisher
+}
+
+func NewPublisher(broker string) *Publisher {
+	json, _ := codec.Get(codec.JSON)
+	return &Publisher{
+		Broker:    NewBroker(broker),
+		Codec:     json,
+		keyPrefix: strconv.FormatInt(time.Now().UnixNano(), 36) + "-",
+	}
+}
+
+// What the storenforward did with a message.
+type Receipt struct {
+	Seq       uint64    // The sequence number it was given; 0 if it's been held until later
+	Duplicate bool      // It had been published already, and Seq is the original's
+	DeliverAt time.Time // When it'll be stored, if it's been held until later
+}
+
+// Marshal a value with the publisher's codec, compress it if the publisher's been asked to, and publish it.
+func (p *Publisher) Publish(ctx context.Context, topic string, v interface{}) (*Receipt, error) {
+	env, err := p.Envelope(v)
+	if err != nil {
+		return nil, err
+	}
+	return p.PublishEnvelope(ctx, topic, env)
+}
+
+// Make the envelope that Publish would send for a value, for when something else needs setting on it.
+func (p *Publisher) Envelope(v interface{}) (*types.Envelope, error) {
+
+	body, err := p.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = codec.Compress(body, p.Encoding); err != nil {
+		return nil, err
+	}
+	return &types.Envelope{ContentType: p.Codec.ContentType(), Encoding: p.Encoding, Body: body}, nil
+}
+
+// Publish a message that's ready to go. If it hasn't got an idempotency key it's given one, so that if it's sent
+// more than once, when a try fails but the message did get there, it's only stored once.
+//
+// If the context carries a span, the message is part of its trace; see Tracing and the trace package.
+func (p *Publisher) PublishEnvelope(ctx context.Context, topic string, env *types.Envelope) (*Receipt, error) {
+
+	if env.Key == "" {
+		env.Key = p.nextKey()
+	}
+	if env.ProducerId == "" {
+		env.ProducerId = p.ProducerId
+	}
+	span := p.startSpan(ctx, "publish", topic, env)
+	h := http.Header{}
+	env.WriteHeaders(h)
+
+	resp, _, err := p.Broker.do(ctx, "publish to "+topic, "POST", MESSAGE_PATTERN, url.Values{"topic": {topic}}, env.Body, h, p.Broker.Timeout)
+	if err != nil {
+		span.SetError(err)
+		span.Finish()
+		return nil, err
+	}
+
+	r := &Receipt{Duplicate: resp.Header.Get(DUPLICATE_HEADER) != ""}
+	r.Seq, _ = strconv.ParseUint(resp.Header.Get(types.SEQUENCE_HEADER), 10, 64)
+	r.DeliverAt, _ = time.Parse(time.RFC3339Nano, resp.Header.Get(DELIVER_AT_HEADER))
+	span.SetAttribute("seq", strconv.FormatUint(r.Seq, 10))
+	span.Finish()
+	return r, nil
+}
+
+// Start the span for sending a message, as a child of the context's span, or failing that of the message's own
+// traceparent, and make it the message's traceparent. Without a Tracer there's no span, but the context's span is
+// still passed on.
+func (p *Publisher) startSpan(ctx context.Context, name string, topic string, env *types.Envelope) *trace.Span {
+
+	parent := trace.FromContext(ctx).SpanContext()
+	if !parent.IsValid() {
+		parent, _ = trace.Parse(env.TraceParent)
+	}
+	span := p.Tracer.Start(name, parent)
+	if span != nil {
+		span.SetAttribute("topic", topic)
+		env.TraceParent = span.TraceParent()
+	} else if parent.IsValid() {
+		env.TraceParent = parent.String()
+	}
+	return span
+}
+
+func (p *Publisher) nextKey() string {
+	return p.keyPrefix + strconv.FormatUint(atomic.AddUint64(&p.count, 1), 10)
+}
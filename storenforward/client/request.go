@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"gsamples/storenforward/codec"
+	"gsamples/types"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+Request/reply. Request sends a request and waits for the reply; Reply is how whoever handles the request sends one
+back:
+
+	reply, err := p.Request(ctx, "Prices", &types.Envelope{Body: []byte(`{"sku":"X1"}`)}, 5*time.Second)
+
+	// and in the subscriber to Prices
+	if env.ReplyTo != "" {
+		err := p.Reply(ctx, env, &types.Envelope{Body: price})
+	}
+
+A request isn't tried again when it fails, as it may have been handled.
+*/
+
+var (
+	ErrTimeout = errors.New("no reply in time")                         // Nothing replied to a request before it timed out
+	ErrNoOne   = errors.New("no one is waiting for the reply any more") // The request a reply was for has timed out, or been answered
+)
+
+// Publish a request to a topic and wait for the reply. The reply to, and the correlation id if there isn't one, are
+// filled in by the storenforward. The reply comes back decompressed.
+func (p *Publisher) Request(ctx context.Context, topic string, req *types.Envelope, timeout time.Duration) (*types.Envelope, error) {
+
+	params := url.Values{}
+	params.Set("topic", topic)
+	params.Set("timeout", strconv.FormatInt(int64(timeout/time.Millisecond), 10))
+	if req.ProducerId == "" {
+		req.ProducerId = p.ProducerId
+	}
+	span := p.startSpan(ctx, "request", topic, req)
+	defer span.Finish()
+	h := http.Header{}
+	req.WriteHeaders(h)
+
+	// Give the storenforward a little longer than the timeout, so it's the one that gives up
+	once := *p.Broker
+	once.Retries = 0
+	resp, body, err := once.do(ctx, "request on "+topic, "POST", REQUEST_PATTERN, params, req.Body, h, timeout+p.Broker.Timeout)
+	if e, ok := err.(*Error); ok && e.Status == http.StatusGatewayTimeout {
+		span.SetError(ErrTimeout)
+		return nil, ErrTimeout
+	}
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	reply := types.ReadEnvelope(resp.Header, body)
+	if reply.Body, err = codec.Decompress(reply.Body, reply.Encoding); err != nil {
+		return nil, err
+	}
+	reply.Encoding = ""
+	return reply, nil
+}
+
+// Send a reply to a request. It's given the request's correlation id.
+func (p *Publisher) Reply(ctx context.Context, req, reply *types.Envelope) error {
+
+	if req.ReplyTo == "" {
+		return errors.New("the message isn't a request: it hasn't got a reply to")
+	}
+
+	env := *reply
+	env.CorrelationId = req.CorrelationId
+	if env.ProducerId == "" {
+		env.ProducerId = p.ProducerId
+	}
+	span := p.startSpan(ctx, "reply", req.ReplyTo, &env)
+	defer span.Finish()
+	h := http.Header{}
+	env.WriteHeaders(h)
+
+	_, _, err := p.Broker.do(ctx, "reply to "+req.ReplyTo, "POST", MESSAGE_PATTERN, url.Values{"topic": {req.ReplyTo}}, env.Body, h, p.Broker.Timeout)
+	if e, ok := err.(*Error); ok && e.Status == http.StatusGone {
+		err = ErrNoOne
+	}
+	span.SetError(err)
+	return err
+}
+
+// Send a request through the storenforward at broker, with the default settings.
+func Request(broker, topic string, req *types.Envelope, timeout time.Duration) (*types.Envelope, error) {
+	return NewPublisher(broker).Request(context.Background(), topic, req, timeout)
+}
+
+// Reply to a request through the storenforward at broker, with the default settings.
+func Reply(broker string, req, reply *types.Envelope) error {
+	return NewPublisher(broker).Reply(context.Background(), req, reply)
+}
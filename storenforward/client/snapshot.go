@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+)
+
+const SNAPSHOT_PATTERN = "/snapshot"
+
+// Modes for Import: whether the messages keep their sequence numbers, or are stored as new ones. See the
+// storenforward's snapshot.go.
+const (
+	MODE_PRESERVE = "preserve"
+	MODE_APPEND   = "append"
+)
+
+// What an Import did.
+type ImportResult struct {
+	Topic    string
+	Imported int
+	Skipped  int    // Already there, expired, or duplicates
+	First    uint64 // The sequence numbers the imported messages were stored as
+	Last     uint64
+}
+
+// Export what's stored on a topic, as a snapshot that Import can read.
+func (b *Broker) Export(ctx context.Context, topic string) ([]byte, error) {
+	_, snapshot, err := b.do(ctx, "export "+topic, "GET", SNAPSHOT_PATTERN, url.Values{"topic": {topic}}, nil, nil, b.Timeout)
+	return snapshot, err
+}
+
+// Import a snapshot into a topic, which needn't be the one it was exported from. The mode is MODE_PRESERVE,
+// MODE_APPEND, or "" for the storenforward's default, which is to preserve. Preserving skips what's already there,
+// so it's tried again if it fails, but appending stores everything as new messages, so it's only tried once: if it
+// fails without an answer, it may have been stored, and it's up to the caller to look before importing it again.
+func (b *Broker) Import(ctx context.Context, topic, mode string, snapshot []byte) (*ImportResult, error) {
+
+	params := url.Values{"topic": {topic}}
+	if mode != "" {
+		params.Set("mode", mode)
+	}
+	once := *b
+	if mode == MODE_APPEND {
+		once.Retries = 0
+	}
+	_, reply, err := once.do(ctx, "import "+topic, "POST", SNAPSHOT_PATTERN, params, snapshot, nil, b.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	var res ImportResult
+	if err := json.Unmarshal(reply, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// The topic a snapshot was exported from, from its first line.
+func SnapshotTopic(snapshot []byte) (string, error) {
+
+	line, _ := bufio.NewReader(bytes.NewReader(snapshot)).ReadBytes('\n')
+	var h struct{ Topic string }
+	if err := json.Unmarshal(line, &h); err != nil || h.Topic == "" {
+		return "", errors.New("not a snapshot")
+	}
+	return h.Topic, nil
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// A preserving import is tried again after a failure that may go away, but an appending one isn't, as it would store
+// the messages twice.
+func TestImportRetries(t *testing.T) {
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			http.Error(w, "not now", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"Topic":"Orders","Imported":1,"First":1,"Last":1}`))
+	}))
+	defer srv.Close()
+	b := NewBroker(srv.URL)
+	b.Backoff = 0
+
+	if res, err := b.Import(context.Background(), "Orders", MODE_PRESERVE, []byte("{}\n")); err != nil || res.Imported != 1 || calls != 2 {
+		t.Errorf("Preserving got %+v, %v after %d calls", res, err, calls)
+	}
+	atomic.StoreInt32(&calls, 0)
+	if _, err := b.Import(context.Background(), "Orders", MODE_APPEND, []byte("{}\n")); err == nil || calls != 1 {
+		t.Errorf("Appending got %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"gsamples/storenforward/codec"
+	"gsamples/types"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Subscribes to a topic on a storenforward. Apart from the topic, the id and where to send the messages, it's all
+// optional, and left to the storenforward if it isn't set.
+type Subscriber struct {
+	Broker   *Broker
+	Topic    string
+	Id       string // Unique among the topic's subscribers; subscribing again with the same one replaces the old
+	ReplyTo  string // The URL the messages are POSTed to
+	Batch    int    // The most messages to send in one POST
+	Linger   time.Duration
+	Queue    int    // How many messages the storenforward can queue for us
+	Overflow string // What it does when the queue's full, e.g. drop-oldest
+	Accept   string // The content types we'd like the messages in
+	Encoding string // The Content-Encodings we can take compressed messages in
+	From     uint64 // Only send what's stored from this sequence number on; 0 for all of it
+	Epoch    string // The store From is in; if it's not the one the storenforward has now, everything's sent
+}
+
+func NewSubscriber(broker, topic, id, replyTo string) *Subscriber {
+	return &Subscriber{Broker: NewBroker(broker), Topic: topic, Id: id, ReplyTo: replyTo}
+}
+
+// What the storenforward agreed to, which may be less than was asked for.
+type Subscription struct {
+	Batch    int
+	Linger   time.Duration
+	Queue    int
+	Overflow string
+	Accept   string // Empty if the messages come as they were published
+	Encoding string // Empty if compressed messages come decompressed
+	Broker   string // The storenforward's name, if it has one
+}
+
+// Subscribe, or subscribe again, which replays what's stored.
+func (s *Subscriber) Subscribe(ctx context.Context) (*Subscription, error) {
+
+	params := url.Values{}
+	params.Set("id", s.Id)
+	params.Set("topic", s.Topic)
+	params.Set("replyto", s.ReplyTo)
+	if s.Batch > 0 {
+		params.Set("batch", strconv.Itoa(s.Batch))
+	}
+	if s.Linger > 0 {
+		params.Set("linger", strconv.FormatInt(int64(s.Linger/time.Millisecond), 10))
+	}
+	if s.Queue > 0 {
+		params.Set("queue", strconv.Itoa(s.Queue))
+	}
+	if s.Overflow != "" {
+		params.Set("overflow", s.Overflow)
+	}
+	if s.Accept != "" {
+		params.Set("accept", s.Accept)
+	}
+	if s.From > 0 {
+		params.Set("from", strconv.FormatUint(s.From, 10))
+	}
+	if s.Epoch != "" {
+		params.Set("epoch", s.Epoch)
+	}
+
+	// Without this, Go's HTTP client would ask for gzip on our behalf
+	h := http.Header{"Accept-Encoding": {"identity"}}
+	if s.Encoding != "" {
+		h.Set("Accept-Encoding", s.Encoding)
+	}
+
+	resp, _, err := s.Broker.do(ctx, "subscribe to "+s.Topic, "GET", SUBSCRIBE_PATTERN, params, nil, h, s.Broker.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	h = resp.Header
+	sub := &Subscription{
+		Overflow: h.Get("X-Overflow"),
+		Accept:   h.Get("X-Accept"),
+		Encoding: h.Get("X-Accept-Encoding"),
+		Broker:   h.Get("X-Broker"),
+	}
+	sub.Batch, _ = strconv.Atoi(h.Get(BATCH_HEADER))
+	sub.Queue, _ = strconv.Atoi(h.Get("X-Queue-Size"))
+	if ms, err := strconv.Atoi(h.Get("X-Linger")); err == nil {
+		sub.Linger = time.Duration(ms) * time.Millisecond
+	}
+	return sub, nil
+}
+
+// Stop subscribing, so the storenforward stops sending to ReplyTo, e.g. before shutting down. It's not an error if
+// the storenforward had already let us go.
+func (s *Subscriber) Unsubscribe(ctx context.Context) error {
+
+	params := url.Values{"id": {s.Id}, "topic": {s.Topic}}
+	_, _, err := s.Broker.do(ctx, "unsubscribe from "+s.Topic, "POST", UNSUBSCRIBE_PATTERN, params, nil, nil, s.Broker.Timeout)
+	if e, ok := err.(*Error); ok && e.Status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// A new random (version 4) UUID, for a subscriber that doesn't have an id of its own.
+func NewId() string {
+
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic("client: cannot read random bytes: " + err.Error())
+	}
+	u[6] = u[6]&0x0f | 0x40 // Version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// Read the messages in a delivery from the storenforward: a JSON array of envelopes for a batch, otherwise one
+// message with its metadata in the headers.
+func ReadDelivery(r *http.Request) ([]*types.Envelope, error) {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Header.Get(BATCH_HEADER) == "" {
+		return []*types.Envelope{types.ReadEnvelope(r.Header, body)}, nil
+	}
+	var envs []*types.Envelope
+	if err := json.Unmarshal(body, &envs); err != nil {
+		return nil, fmt.Errorf("invalid batch: %v", err)
+	}
+	return envs, nil
+}
+
+// Decompress a message's body, if it needs it, and unmarshal it into v with the codec for its content type.
+func Decode(env *types.Envelope, v interface{}) error {
+
+	dec, err := codec.Get(env.ContentType)
+	if err != nil {
+		return err
+	}
+	plain, err := codec.Decompress(env.Body, env.Encoding)
+	if err != nil {
+		return err
+	}
+	return dec.Unmarshal(plain, v)
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"gsamples/types"
+	"hash/fnv"
+	"net/http"
+	"sync"
+)
+
+/*
+Concurrent handling. With Workers set, a Consumer handles messages on that many goroutines rather than on the one
+the delivery came in on. Each message has a key, from OrderKey, and the messages with the same key always go to the
+same worker, in the order they arrived, so they're handled one at a time and in order, while messages with different
+keys can be handled at the same time. By default the key is the topic: the topics are handled in parallel, each one
+in order. ByHeader orders by one of the messages' headers within each topic instead, e.g. a customer id, for more
+parallelism where only each customer's messages need to be in order.
+
+A delivery is only answered once every message in it has been handled, so the storenforward never hears that a
+message is done before it is. If one fails, the messages after it with the same key are skipped, to keep them in
+order, and the answer is a 500; those with other keys are handled anyway. A worker that's behind holds up the
+deliveries with messages for it, which holds up the storenforward's sending, rather than messages piling up here.
+
+ExactlyOnce keeps one offset per topic, so it needs the messages on a topic handled in order: leave OrderKey as it is
+when using it.
+*/
+
+const WORKER_QUEUE = 100 // Messages waiting for each worker
+
+var ErrStopped = errors.New("the consumer has stopped")
+
+// Order by topic, which is the default.
+func ByTopic(env *types.Envelope) string { return env.Topic }
+
+// Order by one of the messages' headers, within each topic. The messages without it are ordered by topic.
+func ByHeader(name string) func(env *types.Envelope) string {
+	name = http.CanonicalHeaderKey(name)
+	return func(env *types.Envelope) string {
+		return env.Topic + "\x00" + env.Headers[name]
+	}
+}
+
+// What's happened to the messages in one delivery so far.
+type delivery struct {
+	wg     sync.WaitGroup
+	mut    sync.Mutex
+	failed map[string]bool // The keys a message has failed for
+	err    error           // The first failure
+}
+
+// Whether a message with the key can be handled, or has to be skipped as an earlier one failed.
+func (d *delivery) ok(key string) bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return !d.failed[key]
+}
+
+func (d *delivery) fail(key string, err error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.failed[key] = true
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+type job struct {
+	ctx context.Context
+	env *types.Envelope
+	key string
+	d   *delivery
+}
+
+type workerPool struct {
+	queues  []chan job
+	handle  func(ctx context.Context, env *types.Envelope) error
+	key     func(env *types.Envelope) string
+	mut     sync.RWMutex // Held to submit, and to stop, so nothing's sent to a closed queue
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(workers int, key func(env *types.Envelope) string, handle func(ctx context.Context, env *types.Envelope) error) *workerPool {
+
+	if key == nil {
+		key = ByTopic
+	}
+	p := &workerPool{queues: make([]chan job, workers), handle: handle, key: key}
+	for i := range p.queues {
+		p.queues[i] = make(chan job, WORKER_QUEUE)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *workerPool) work(queue chan job) {
+	defer p.wg.Done()
+	for j := range queue {
+		if !j.d.ok(j.key) {
+			j.d.wg.Done()
+			continue
+		}
+		if err := p.handle(j.ctx, j.env); err != nil {
+			j.d.fail(j.key, err)
+		}
+		j.d.wg.Done()
+	}
+}
+
+// Hand the messages in a delivery to their workers, and wait for them all to be done with. It returns the first
+// failure, if there was one.
+func (p *workerPool) submit(ctx context.Context, envs []*types.Envelope) error {
+
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	if p.stopped {
+		return ErrStopped
+	}
+
+	d := &delivery{failed: make(map[string]bool)}
+	for _, env := range envs {
+		key := p.key(env)
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+		d.wg.Add(1)
+		select {
+		case queue <- job{ctx: ctx, env: env, key: key, d: d}:
+		case <-ctx.Done():
+			d.wg.Done()
+			d.fail(key, ctx.Err())
+		}
+	}
+	d.wg.Wait()
+	return d.err
+}
+
+// Stop the workers once they've finished what they've been given.
+func (p *workerPool) stop() {
+
+	p.mut.Lock()
+	if !p.stopped {
+		p.stopped = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mut.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+
+	var mut sync.Mutex
+	got := make(map[string][]uint64)
+	running, most := 0, 0
+	handle := func(ctx context.Context, env *types.Envelope) error {
+		mut.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mut.Unlock()
+		time.Sleep(time.Millisecond)
+		mut.Lock()
+		running--
+		customer := env.Headers["Customer"]
+		got[customer] = append(got[customer], env.Sequence)
+		mut.Unlock()
+		return nil
+	}
+
+	p := newWorkerPool(8, ByHeader("customer"), handle)
+	defer p.stop()
+
+	var envs []*types.Envelope
+	for i := 1; i <= 200; i++ {
+		envs = append(envs, &types.Envelope{Topic: "Orders", Sequence: uint64(i), Headers: map[string]string{"Customer": fmt.Sprint(i % 10)}})
+	}
+	if err := p.submit(context.Background(), envs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything's been handled by the time submit returns, in order for each customer
+	mut.Lock()
+	defer mut.Unlock()
+	n := 0
+	for customer, seqs := range got {
+		n += len(seqs)
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] <= seqs[i-1] {
+				t.Errorf("Customer %s out of order: %v", customer, seqs)
+				break
+			}
+		}
+	}
+	if n != 200 {
+		t.Errorf("Handled %d messages", n)
+	}
+	if most < 2 {
+		t.Errorf("At most %d handled at once", most)
+	}
+}
+
+func TestWorkerPoolFailure(t *testing.T) {
+
+	var mut sync.Mutex
+	var got []uint64
+	p := newWorkerPool(4, nil, func(ctx context.Context, env *types.Envelope) error {
+		if string(env.Body) == "bad" {
+			return errors.New("bad message")
+		}
+		mut.Lock()
+		got = append(got, env.Sequence)
+		mut.Unlock()
+		return nil
+	})
+
+	envs := []*types.Envelope{
+		{Topic: "Orders", Sequence: 1},
+		{Topic: "Orders", Sequence: 2, Body: []byte("bad")},
+		{Topic: "Orders", Sequence: 3}, // Skipped, as it's after the failure on the same topic
+		{Topic: "Prices", Sequence: 1},
+	}
+	if err := p.submit(context.Background(), envs); err == nil || err.Error() != "bad message" {
+		t.Errorf("Submit got %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("Handled %v", got)
+	}
+
+	p.stop()
+	if err := p.submit(context.Background(), envs[:1]); err != ErrStopped {
+		t.Errorf("Submit after stopping got %v", err)
+	}
+}
@@ -0,0 +1,1148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Clustering. Several storenforwards can run as one, each started with the same -peers list of all the nodes' URLs and
+its own URL in -self. Every topic has a leader node, which stores its messages and forwards them to its subscribers,
+and the other nodes are followers that keep a copy of the topic's ring.
+
+Each topic works like a small Raft group of all the nodes:
+
+  - The nodes elect a leader for the topic. Every election has a new term number, each node votes at most once per
+    term, and only for a node whose copy of the topic is at least as up to date as its own. The node that wins most
+    of the votes leads for that term. Topics are spread over the nodes by ranking the nodes for each topic with a
+    hash; the top ranked node stands first, and the others wait a little longer the lower they're ranked.
+
+  - The leader gives each message a sequence number and sends it to the followers, along with the term it was
+    stored in. A follower only takes messages that carry on from what it has; otherwise the leader works back until
+    they agree, or sends the follower the whole ring if it's too far behind.
+
+  - A message is committed once most of the nodes have stored it, and only then is the publisher told it's been
+    stored and the message passed on to the subscribers. So an acknowledged message survives the loss of any node,
+    as long as most of the nodes are still running.
+
+  - The leader sends the followers a heartbeat every so often, even when there's nothing new. A follower that stops
+    hearing from the leader stands for election, and a leader that stops hearing from most of the followers steps
+    down.
+
+Publishes and subscribes can go to any node. /message and /subscribe are passed on to the topic's leader, a batch
+is split up and each part sent to its topic's leader, and a message that was scheduled for later is passed on when
+it's due. A transaction is held by the node it was opened on and passed on to the leader of its topics when it's
+committed, which only works if they all have the same leader - see txn.go. Schemas are registered on every node, and a
+reply is passed on to the node whose request is waiting for it.
+
+Subscriptions are held by the leader alone; when a topic's leader changes its subscribers are dropped and have to
+subscribe again, which replays what's in the store.
+
+Everything is held in memory, as it is on a single node, and that includes what Raft keeps on disk: each topic's
+term, who the node voted for in it, and its copy of the messages. A node that's restarted comes back empty, at term
+0, and catches up from the leaders. That's safe one node at a time, but it limits what's promised:
+
+  - A restarted node has forgotten its votes, so it can vote a second time in a term it voted in before it went
+    down, and two leaders can be elected for a topic in one term, each with a majority that counts the restarted
+    node. Both can then commit, and acknowledge, different messages with the same sequence numbers. Nothing sorts
+    that out afterwards: a follower takes an entry with the term and sequence number of one it's got as one it's
+    already got, so the nodes' copies of the topic stay different, and which messages a subscriber gets depends
+    on which node ends up leading. Acknowledged messages can be lost this way.
+
+  - An acknowledged message survives as long as most of the nodes that stored it are still running. If most of the
+    nodes are restarted together, or before those restarted earlier have caught up, the messages are gone.
+
+So nodes should be restarted one at a time, waiting for each to catch up before restarting the next.
+*/
+
+const (
+	APPEND_PATTERN   = "/cluster/append"   // A leader sends messages and heartbeats to its followers here
+	VOTE_PATTERN     = "/cluster/vote"     // A node standing for leader asks for votes here
+	PUBLISH_PATTERN  = "/cluster/publish"  // Messages for a topic are passed on to its leader here
+	PASS_TXN_PATTERN = "/cluster/txn"      // A transaction is passed on to the leader of its topics here
+	CAMPAIGN_PATTERN = "/cluster/campaign" // A node is asked to stand for leader of a topic that hasn't got one here
+	FORWARDED_HEADER = "X-Forwarded-By"    // Set, to the node's URL, on a request passed on to another node
+	LEADER_HEADER    = "X-Leader"          // Set on a 503 to say which node we think is the topic's leader
+
+	HEARTBEAT_INTERVAL = 100 * time.Millisecond
+	ELECTION_TIMEOUT   = time.Second     // How long before a follower that's heard nothing from the leader stands
+	CLUSTER_TIMEOUT    = time.Second     // How long to wait for another node to answer
+	COMMIT_TIMEOUT     = 5 * time.Second // How long a publisher waits for most of the nodes to store a message
+	LEADER_WAIT        = 3 * time.Second // How long a request waits for a topic to get a leader
+	MAX_APPEND         = BUFF_SIZE       // The most messages sent to a follower in one go
+)
+
+var (
+	errNotLeader = errors.New("this node isn't the topic's leader any more; the message may or may not have been stored")
+	errNoLeader  = errors.New("no leader could be found for the topic")
+	errNoCommit  = errors.New("most of the nodes didn't store the message in time; it may or may not have been stored")
+	errStopped   = errors.New("the node is stopping")
+)
+
+// The nodes in the cluster, as seen from this one.
+type cluster struct {
+	b               *broker
+	self            string        // This node's URL
+	nodes           []string      // All the nodes' URLs, this one included
+	client          *http.Client  // For talking to the other nodes
+	forwarder       *http.Client  // For passing messages on to a leader, which takes longer
+	heartbeat       time.Duration // How often a leader sends heartbeats
+	electionTimeout time.Duration // How long a follower waits to hear from the leader
+}
+
+// A topic's share of the cluster state. It's guarded by the topic's ring lock.
+type topicState struct {
+	term        uint64            // The latest term we've seen
+	votedFor    string            // Who we voted for in this term
+	leader      string            // The leader for this term, if we know it
+	heard       time.Time         // When we last heard from the leader, or last voted
+	terms       [BUFF_SIZE]uint64 // The term each message in the ring was stored in, by sequence number mod BUFF_SIZE
+	campaigning bool              // We're standing for leader
+
+	// Only used while we're the leader
+	match     map[string]uint64        // The last sequence number each follower's known to have
+	next      map[string]uint64        // The next sequence number to send each follower
+	acked     map[string]time.Time     // When each follower last answered
+	kicks     map[string]chan struct{} // Tells a follower's replicate() there's something new
+	stop      chan struct{}            // Closed when we stop leading, which stops the replicate()s
+	committed chan struct{}            // Closed, and replaced, whenever the commit moves on or we stop leading
+}
+
+type logEntry struct {
+	Seq  uint64          `json:"seq"`
+	Term uint64          `json:"term"`
+	Env  *types.Envelope `json:"env,omitempty"` // Nil if the message has expired and been swept away
+}
+
+type appendRequest struct {
+	Topic    string     `json:"topic"`
+	Term     uint64     `json:"term"`
+	Leader   string     `json:"leader"`
+	PrevSeq  uint64     `json:"prevSeq"`         // The entries carry on from this one
+	PrevTerm uint64     `json:"prevTerm"`        // which was stored in this term
+	Reset    bool       `json:"reset,omitempty"` // Throw away the ring and start again from PrevSeq
+	Entries  []logEntry `json:"entries,omitempty"`
+	Commit   uint64     `json:"commit"` // The leader's commit
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Ok      bool   `json:"ok"`
+	LastSeq uint64 `json:"lastSeq"` // If Ok, the last sequence number that matches the leader's; otherwise where to try next
+}
+
+type voteRequest struct {
+	Topic     string `json:"topic"`
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastSeq   uint64 `json:"lastSeq"`
+	LastTerm  uint64 `json:"lastTerm"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type publishRequest struct {
+	Topic string            `json:"topic"`
+	Envs  []*types.Envelope `json:"envs"`
+}
+
+type publishResponse struct {
+	Seqs []uint64 `json:"seqs"`
+	Dups []bool   `json:"dups"`
+}
+
+type campaignRequest struct {
+	Topic string `json:"topic"`
+}
+
+// Make the broker one of the nodes in a cluster. This has to be done before it's started.
+func (b *broker) joinCluster(self string, nodes []string) error {
+
+	c := &cluster{
+		b:               b,
+		self:            strings.TrimRight(strings.TrimSpace(self), "/"),
+		client:          &http.Client{Timeout: CLUSTER_TIMEOUT},
+		forwarder:       &http.Client{Timeout: LEADER_WAIT + COMMIT_TIMEOUT},
+		heartbeat:       HEARTBEAT_INTERVAL,
+		electionTimeout: ELECTION_TIMEOUT,
+	}
+	if c.self == "" {
+		return errors.New("a node needs its own URL to join a cluster")
+	}
+
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		n = strings.TrimRight(strings.TrimSpace(n), "/")
+		if n == "" || seen[n] {
+			continue
+		}
+		if u, err := url.Parse(n); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%q isn't a node URL", n)
+		}
+		seen[n] = true
+		c.nodes = append(c.nodes, n)
+	}
+	if !seen[c.self] {
+		return fmt.Errorf("%s isn't one of the nodes", c.self)
+	}
+
+	b.cluster = c
+	return nil
+}
+
+func newTopicState() *topicState {
+	return &topicState{
+		heard:     time.Now(), // Give any leader a chance to make itself known
+		committed: make(chan struct{}),
+	}
+}
+
+// The term of the last message stored on the topic.
+func (t *topicState) lastTerm(rb *ringBuf) uint64 {
+	if rb.seq == 0 {
+		return 0
+	}
+	return t.terms[rb.seq%BUFF_SIZE]
+}
+
+// Tell the topic's replicate()s there's something new to send. The caller must hold the ring lock.
+func (t *topicState) kick() {
+	for _, kick := range t.kicks {
+		select {
+		case kick <- struct{}{}:
+		default: // Already kicked
+		}
+	}
+}
+
+// Wake up anyone waiting for the commit to move on.
+func (t *topicState) signal() {
+	close(t.committed)
+	t.committed = make(chan struct{})
+}
+
+// Add the cluster's endpoints.
+func (c *cluster) register(mux *http.ServeMux) {
+	mux.HandleFunc(APPEND_PATTERN, c.handleAppend)
+	mux.HandleFunc(VOTE_PATTERN, c.handleVote)
+	mux.HandleFunc(PUBLISH_PATTERN, c.handlePublish)
+	mux.HandleFunc(PASS_TXN_PATTERN, c.handleTxn)
+	mux.HandleFunc(CAMPAIGN_PATTERN, c.handleCampaign)
+}
+
+// The other nodes.
+func (c *cluster) peers() []string {
+	peers := make([]string, 0, len(c.nodes)-1)
+	for _, n := range c.nodes {
+		if n != c.self {
+			peers = append(peers, n)
+		}
+	}
+	return peers
+}
+
+// How many nodes make a majority.
+func (c *cluster) majority() int {
+	return len(c.nodes)/2 + 1
+}
+
+// The nodes in the order they should lead a topic, by rendezvous hashing, so each topic has its own order and
+// adding a node only moves the topics it comes top for.
+func (c *cluster) preference(topic string) []string {
+
+	score := func(node string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(node + "|" + topic))
+		return h.Sum64()
+	}
+
+	nodes := append([]string(nil), c.nodes...)
+	sort.Slice(nodes, func(i, j int) bool { return score(nodes[i]) > score(nodes[j]) })
+	return nodes
+}
+
+// How long this node waits without hearing from a topic's leader before standing itself. Nodes lower down the
+// topic's preference wait longer, so the top one usually gets there first, and the randomness stops ties.
+func (c *cluster) timeoutFor(topic string) time.Duration {
+
+	rank := 0
+	for i, n := range c.preference(topic) {
+		if n == c.self {
+			rank = i
+		}
+	}
+	stagger := c.electionTimeout / 4
+	return c.electionTimeout + time.Duration(rank)*stagger + time.Duration(rand.Int63n(int64(stagger)))
+}
+
+// Send a request to another node and decode its answer, if resp isn't nil.
+func (c *cluster) call(client *http.Client, node, pattern string, req, resp interface{}) error {
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hr, err := http.NewRequest("POST", node+pattern, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set(FORWARDED_HEADER, c.self)
+
+	res, err := client.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s%s: %s %s", node, pattern, res.Status, strings.TrimSpace(string(msg)))
+	}
+	if resp == nil {
+		ioutil.ReadAll(res.Body)
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Wrap a handler so that a request for a topic is handled by the topic's leader, passing it on if that isn't us.
+func (b *broker) route(h http.HandlerFunc) http.HandlerFunc {
+
+	if b.cluster == nil {
+		return h
+	}
+	c := b.cluster
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		topic := r.URL.Query().Get("topic")
+		if topic == "" {
+			h(w, r) // It'll complain
+			return
+		}
+		if txnId(r) != "" && !isReplyTopic(topic) {
+			h(w, r) // It's held by the node the transaction was opened on until the commit
+			return
+		}
+
+		// A reply goes to the node that's waiting for it; anything else to the topic's leader
+		var leader string
+		var err error
+		if isReplyTopic(topic) {
+			if leader = c.replyOwner(topic); leader == "" {
+				http.Error(w, "No one is waiting for a reply on "+topic, GONE)
+				return
+			}
+		} else if leader, err = c.leaderFor(topic); err != nil {
+			http.Error(w, err.Error(), UNAVAILABLE)
+			return
+		}
+		if leader == c.self {
+			h(w, r)
+			return
+		}
+		if r.Header.Get(FORWARDED_HEADER) != "" {
+			// It's already been passed on once; don't pass it round in circles while the nodes disagree
+			w.Header().Set(LEADER_HEADER, leader)
+			http.Error(w, "Not the leader for "+topic, UNAVAILABLE)
+			return
+		}
+
+		u, err := url.Parse(leader)
+		if err != nil {
+			http.Error(w, err.Error(), UNAVAILABLE)
+			return
+		}
+		fmt.Printf("Passing %s for %s on to %s\n", r.URL.Path, topic, leader)
+		r.Header.Set(FORWARDED_HEADER, c.self)
+		httputil.NewSingleHostReverseProxy(u).ServeHTTP(w, r)
+	}
+}
+
+// Find the leader for a topic, getting one elected if need be.
+func (c *cluster) leaderFor(topic string) (string, error) {
+
+	rb := c.b.getRingBuf(topic)
+	deadline := time.Now().Add(LEADER_WAIT)
+	var asked time.Time
+
+	for {
+		rb.mut.Lock()
+		leader := rb.raft.leader
+		rb.mut.Unlock()
+
+		if leader != "" {
+			return leader, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errNoLeader
+		}
+		if time.Since(asked) > c.electionTimeout {
+			asked = time.Now()
+			c.elect(topic)
+		}
+
+		select {
+		case <-time.After(c.heartbeat / 2):
+		case <-c.b.done:
+			return "", errStopped
+		}
+	}
+}
+
+// Ask the nodes, in order of preference, to stand for leader of a topic until one says it will.
+func (c *cluster) elect(topic string) {
+	for _, n := range c.preference(topic) {
+		if n == c.self {
+			go c.campaign(topic)
+			return
+		}
+		if err := c.call(c.client, n, CAMPAIGN_PATTERN, campaignRequest{Topic: topic}, nil); err == nil {
+			return
+		}
+	}
+}
+
+// Store messages through the topic's leader, which might be us.
+func (c *cluster) store(envs []*types.Envelope, topic string) ([]uint64, []bool, error) {
+
+	leader, err := c.leaderFor(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if leader == c.self {
+		return c.storeAsLeader(envs, topic)
+	}
+
+	var resp publishResponse
+	if err := c.call(c.forwarder, leader, PUBLISH_PATTERN, publishRequest{Topic: topic, Envs: envs}, &resp); err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Seqs) != len(envs) || len(resp.Dups) != len(envs) {
+		return nil, nil, fmt.Errorf("%s stored %d messages out of %d", leader, len(resp.Seqs), len(envs))
+	}
+	return resp.Seqs, resp.Dups, nil
+}
+
+// Commit a transaction through the leader of its topics, which might be us.
+func (c *cluster) commitTxn(envs []*types.Envelope) ([]uint64, []bool, error) {
+
+	topics, _ := txnTopics(envs)
+	leader := ""
+	for _, topic := range topics {
+		l, err := c.leaderFor(topic)
+		if err != nil {
+			return nil, nil, err
+		}
+		if leader != "" && l != leader {
+			return nil, nil, errTxnLeaders
+		}
+		leader = l
+	}
+	if leader == c.self {
+		return c.commitTxnAsLeader(envs)
+	}
+
+	var resp publishResponse
+	if err := c.call(c.forwarder, leader, PASS_TXN_PATTERN, publishRequest{Envs: envs}, &resp); err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Seqs) != len(envs) || len(resp.Dups) != len(envs) {
+		return nil, nil, fmt.Errorf("%s stored %d messages out of %d", leader, len(resp.Seqs), len(envs))
+	}
+	return resp.Seqs, resp.Dups, nil
+}
+
+// Store a transaction's messages on topics we lead, all together, then wait for most of the nodes to have them.
+func (c *cluster) commitTxnAsLeader(envs []*types.Envelope) ([]uint64, []bool, error) {
+
+	topics, byTopic := txnTopics(envs)
+	rbs := c.b.lockTopics(topics)
+	unlock := func() {
+		for _, rb := range rbs {
+			rb.mut.Unlock()
+		}
+	}
+	for _, rb := range rbs {
+		if rb.raft.leader != c.self {
+			unlock()
+			return nil, nil, errNotLeader
+		}
+	}
+
+	seqs, dups := appendTxn(envs, topics, byTopic, rbs)
+	last := make(map[string]uint64)
+	for i, env := range envs {
+		if t := rbs[env.Topic].raft; !dups[i] {
+			t.terms[seqs[i]%BUFF_SIZE] = t.term
+		}
+		if seqs[i] > last[env.Topic] {
+			last[env.Topic] = seqs[i]
+		}
+	}
+	for _, rb := range rbs {
+		c.advanceCommit(rb)
+		rb.raft.kick()
+	}
+	unlock()
+
+	for _, topic := range topics {
+		if err := c.waitForCommit(rbs[topic], last[topic]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return seqs, dups, nil
+}
+
+// Store messages on a topic we lead, then wait for most of the nodes to have them.
+func (c *cluster) storeAsLeader(envs []*types.Envelope, topic string) ([]uint64, []bool, error) {
+
+	rb := c.b.getRingBuf(topic)
+	rb.mut.Lock()
+	t := rb.raft
+	if t.leader != c.self {
+		rb.mut.Unlock()
+		return nil, nil, errNotLeader
+	}
+
+	seqs, dups := rb.appendAll(envs, topic)
+	var last uint64
+	for i, seq := range seqs {
+		if !dups[i] {
+			t.terms[seq%BUFF_SIZE] = t.term
+		}
+		if seq > last {
+			last = seq
+		}
+	}
+	c.advanceCommit(rb)
+	t.kick()
+	rb.mut.Unlock()
+
+	if err := c.waitForCommit(rb, last); err != nil {
+		return nil, nil, err
+	}
+	return seqs, dups, nil
+}
+
+// Wait for the commit to reach a sequence number.
+func (c *cluster) waitForCommit(rb *ringBuf, seq uint64) error {
+
+	timer := time.NewTimer(COMMIT_TIMEOUT)
+	defer timer.Stop()
+
+	for {
+		rb.mut.Lock()
+		done := rb.commit >= seq
+		leading := rb.raft.leader == c.self
+		committed := rb.raft.committed
+		rb.mut.Unlock()
+
+		switch {
+		case done:
+			return nil
+		case !leading:
+			return errNotLeader
+		}
+
+		select {
+		case <-committed:
+		case <-timer.C:
+			return errNoCommit
+		case <-c.b.done:
+			return errStopped
+		}
+	}
+}
+
+// Move the commit on to the latest message that most of the nodes have. As in Raft, only messages from the current
+// term are counted; earlier ones are committed along with them. The caller must hold the ring lock.
+func (c *cluster) advanceCommit(rb *ringBuf) {
+
+	t := rb.raft
+	matches := []uint64{rb.seq}
+	for _, peer := range c.peers() {
+		matches = append(matches, t.match[peer])
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+
+	n := matches[c.majority()-1]
+	if n > rb.commit && n >= rb.oldest() && t.terms[n%BUFF_SIZE] == t.term {
+		c.b.commitTo(rb, n)
+		t.signal()
+	}
+}
+
+// Start leading a topic. The caller must hold the ring lock.
+func (c *cluster) becomeLeader(rb *ringBuf, topic string) {
+
+	t := rb.raft
+	fmt.Printf("Node %s is now the leader of %s for term %d\n", c.self, topic, t.term)
+
+	t.leader = c.self
+	t.heard = time.Now()
+	t.match = make(map[string]uint64)
+	t.next = make(map[string]uint64)
+	t.acked = make(map[string]time.Time)
+	t.kicks = make(map[string]chan struct{})
+	t.stop = make(chan struct{})
+
+	for _, peer := range c.peers() {
+		t.next[peer] = rb.seq + 1
+		t.acked[peer] = time.Now()
+		t.kicks[peer] = make(chan struct{}, 1)
+		go c.replicate(rb, topic, peer, t.term, t.stop, t.kicks[peer])
+	}
+	c.advanceCommit(rb)
+}
+
+// Stop leading a topic, if we were, and move on to a new term, if it's later. The caller must hold the ring lock.
+func (c *cluster) becomeFollower(rb *ringBuf, topic string, term uint64) {
+
+	t := rb.raft
+	wasLeader := t.leader == c.self
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+		t.kicks = nil
+	}
+	if term > t.term {
+		t.term = term
+		t.votedFor = ""
+	}
+	t.leader = ""
+	t.signal()
+
+	if wasLeader {
+		fmt.Printf("Node %s is no longer the leader of %s\n", c.self, topic)
+		c.b.dropSubscribers(topic)
+	}
+}
+
+// Take all the subscribers off a topic. They'll have to subscribe again.
+func (b *broker) dropSubscribers(topic string) {
+
+	b.subMut.Lock()
+	subs := b.submap[topic]
+	delete(b.submap, topic)
+	b.subMut.Unlock()
+
+	for _, s := range subs {
+		fmt.Printf("Dropped subscriber %s from topic %s\n", s.id, topic)
+		s.close()
+	}
+}
+
+// Keep a follower up to date with a topic we lead, until we stop leading it.
+func (c *cluster) replicate(rb *ringBuf, topic, peer string, term uint64, stop, kick <-chan struct{}) {
+
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		rb.mut.Lock()
+		t := rb.raft
+		if t.leader != c.self || t.term != term {
+			rb.mut.Unlock()
+			return
+		}
+		req := c.appendRequest(rb, topic, peer)
+		rb.mut.Unlock()
+
+		var resp appendResponse
+		err := c.call(c.client, peer, APPEND_PATTERN, &req, &resp)
+
+		more := false
+		rb.mut.Lock()
+		if err == nil && t.leader == c.self && t.term == term {
+			t.acked[peer] = time.Now()
+			switch {
+			case resp.Term > t.term:
+				c.becomeFollower(rb, topic, resp.Term)
+			case resp.Ok:
+				if resp.LastSeq > t.match[peer] {
+					t.match[peer] = resp.LastSeq
+				}
+				t.next[peer] = resp.LastSeq + 1
+				c.advanceCommit(rb)
+				more = t.next[peer] <= rb.seq
+			default:
+				// Work back until we find where the follower agrees with us
+				if resp.LastSeq+1 < t.next[peer] {
+					t.next[peer] = resp.LastSeq + 1
+				} else if t.next[peer] > 1 {
+					t.next[peer]--
+				}
+				more = true
+			}
+		}
+		rb.mut.Unlock()
+
+		if more {
+			select {
+			case <-stop:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-kick:
+		case <-stop:
+			return
+		case <-c.b.done:
+			return
+		}
+	}
+}
+
+// Build the next request for a follower: whatever it hasn't got yet, or just a heartbeat. The caller must hold the
+// ring lock.
+func (c *cluster) appendRequest(rb *ringBuf, topic, peer string) appendRequest {
+
+	t := rb.raft
+	next := t.next[peer]
+	if next > rb.seq+1 {
+		next = rb.seq + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+
+	req := appendRequest{Topic: topic, Term: t.term, Leader: c.self, Commit: rb.commit}
+
+	// If what the follower needs has gone from the ring, it gets the whole ring
+	oldest := rb.oldest()
+	if oldest > 1 && next <= oldest {
+		next = oldest
+		req.Reset = true
+	}
+	req.PrevSeq = next - 1
+	if req.PrevSeq > 0 && req.PrevSeq >= oldest {
+		req.PrevTerm = t.terms[req.PrevSeq%BUFF_SIZE]
+	}
+
+	for seq := next; seq <= rb.seq && len(req.Entries) < MAX_APPEND; seq++ {
+		req.Entries = append(req.Entries, logEntry{Seq: seq, Term: t.terms[seq%BUFF_SIZE], Env: rb.entry(seq)})
+	}
+	t.next[peer] = next
+	return req
+}
+
+// A leader has sent us messages, or a heartbeat.
+func (c *cluster) handleAppend(w http.ResponseWriter, r *http.Request) {
+
+	var req appendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Topic == "" {
+		http.Error(w, "Invalid append request", BAD_REQUEST)
+		return
+	}
+
+	rb := c.b.getRingBuf(req.Topic)
+	rb.mut.Lock()
+	resp := c.appendEntries(rb, &req)
+	rb.mut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Take the messages from the leader, if they carry on from what we've got. The caller must hold the ring lock.
+func (c *cluster) appendEntries(rb *ringBuf, req *appendRequest) appendResponse {
+
+	t := rb.raft
+	if req.Term < t.term {
+		return appendResponse{Term: t.term, LastSeq: rb.seq}
+	}
+	if req.Term > t.term {
+		c.becomeFollower(rb, req.Topic, req.Term)
+	}
+	t.leader = req.Leader
+	t.heard = time.Now()
+
+	switch {
+	case req.Reset:
+		for i := 0; i < BUFF_SIZE; i++ {
+			rb.buf.Value = nil
+			rb.buf = rb.buf.Next()
+		}
+		rb.seq = req.PrevSeq
+		rb.staged = nil
+		rb.epoch = "" // Take the leader's from its messages
+		t.terms[rb.seq%BUFF_SIZE] = req.PrevTerm
+		if rb.commit < rb.seq {
+			rb.commit = rb.seq
+		}
+	case req.PrevSeq > rb.seq:
+		return appendResponse{Term: t.term, LastSeq: rb.seq} // We're missing some
+	case req.PrevSeq > 0 && (req.PrevSeq < rb.oldest() || t.terms[req.PrevSeq%BUFF_SIZE] != req.PrevTerm):
+		return appendResponse{Term: t.term, LastSeq: req.PrevSeq - 1} // We disagree, so try further back
+	}
+
+	matched := req.PrevSeq
+	for _, e := range req.Entries {
+		if e.Seq <= rb.seq {
+			if e.Seq >= rb.oldest() && t.terms[e.Seq%BUFF_SIZE] == e.Term {
+				matched = e.Seq
+				continue // Already got it
+			}
+			rb.truncate(e.Seq - 1)
+		}
+		if e.Seq != rb.seq+1 {
+			break
+		}
+
+		if e.Env == nil {
+			rb.seq = e.Seq
+			rb.buf.Value = nil
+			rb.buf = rb.buf.Next()
+		} else {
+			e.Env.Sequence = e.Seq
+			rb.append(e.Env)
+		}
+		t.terms[e.Seq%BUFF_SIZE] = e.Term
+		matched = e.Seq
+	}
+
+	if commit := req.Commit; commit > rb.commit {
+		if commit > matched {
+			commit = matched
+		}
+		c.b.commitTo(rb, commit)
+	}
+	return appendResponse{Term: t.term, Ok: true, LastSeq: matched}
+}
+
+// Throw away the messages after a sequence number, which a new leader never had. They were never committed.
+// The caller must hold the ring lock.
+func (rb *ringBuf) truncate(seq uint64) {
+	for i := 0; rb.seq > seq && i < BUFF_SIZE; i++ {
+		rb.buf = rb.buf.Prev()
+		if env, ok := rb.buf.Value.(*types.Envelope); ok {
+			rb.dedup.forget(env.Key)
+		}
+		rb.buf.Value = nil
+		rb.seq--
+	}
+	rb.seq = seq // Anything further back had already gone from the ring
+	for len(rb.staged) > 0 && rb.staged[len(rb.staged)-1].Sequence > seq {
+		rb.dedup.forget(rb.staged[len(rb.staged)-1].Key)
+		rb.staged = rb.staged[:len(rb.staged)-1]
+	}
+}
+
+// Another node is standing for leader of a topic and wants our vote.
+func (c *cluster) handleVote(w http.ResponseWriter, r *http.Request) {
+
+	var req voteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Topic == "" {
+		http.Error(w, "Invalid vote request", BAD_REQUEST)
+		return
+	}
+
+	rb := c.b.getRingBuf(req.Topic)
+	rb.mut.Lock()
+	resp := c.vote(rb, &req)
+	rb.mut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Decide whether to vote for a node. The caller must hold the ring lock.
+func (c *cluster) vote(rb *ringBuf, req *voteRequest) voteResponse {
+
+	t := rb.raft
+
+	// A node that's lost touch with a leader that's still going mustn't be able to unseat it
+	if t.leader != "" && t.leader != req.Candidate {
+		if (t.leader == c.self && c.hasQuorum(t)) || (t.leader != c.self && time.Since(t.heard) < c.electionTimeout) {
+			return voteResponse{Term: t.term}
+		}
+	}
+
+	if req.Term < t.term {
+		return voteResponse{Term: t.term}
+	}
+	if req.Term > t.term {
+		c.becomeFollower(rb, req.Topic, req.Term)
+	}
+
+	lastTerm := t.lastTerm(rb)
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastSeq >= rb.seq)
+	if (t.votedFor == "" || t.votedFor == req.Candidate) && upToDate {
+		t.votedFor = req.Candidate
+		t.heard = time.Now()
+		return voteResponse{Term: t.term, Granted: true}
+	}
+	return voteResponse{Term: t.term}
+}
+
+// Whether most of the followers have answered a leader lately. The caller must hold the ring lock.
+func (c *cluster) hasQuorum(t *topicState) bool {
+	count := 1
+	for _, peer := range c.peers() {
+		if time.Since(t.acked[peer]) < c.electionTimeout {
+			count++
+		}
+	}
+	return count >= c.majority()
+}
+
+// Stand for leader of a topic.
+func (c *cluster) campaign(topic string) {
+
+	rb := c.b.getRingBuf(topic)
+	rb.mut.Lock()
+	t := rb.raft
+	if t.campaigning || t.leader == c.self {
+		rb.mut.Unlock()
+		return
+	}
+	t.campaigning = true
+	t.term++
+	t.votedFor = c.self
+	t.leader = ""
+	t.heard = time.Now()
+	req := voteRequest{Topic: topic, Term: t.term, Candidate: c.self, LastSeq: rb.seq, LastTerm: t.lastTerm(rb)}
+	rb.mut.Unlock()
+
+	fmt.Printf("Node %s is standing for leader of %s in term %d\n", c.self, topic, req.Term)
+
+	peers := c.peers()
+	answers := make(chan voteResponse, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			var resp voteResponse
+			if err := c.call(c.client, peer, VOTE_PATTERN, &req, &resp); err != nil {
+				resp = voteResponse{}
+			}
+			answers <- resp
+		}(peer)
+	}
+
+	votes := 1
+	highest := req.Term
+	for range peers {
+		if votes >= c.majority() {
+			break
+		}
+		resp := <-answers
+		if resp.Granted {
+			votes++
+		}
+		if resp.Term > highest {
+			highest = resp.Term
+		}
+	}
+
+	rb.mut.Lock()
+	defer rb.mut.Unlock()
+	t.campaigning = false
+	switch {
+	case highest > t.term:
+		c.becomeFollower(rb, topic, highest)
+	case t.term == req.Term && t.leader == "" && votes >= c.majority():
+		c.becomeLeader(rb, topic)
+	}
+}
+
+// Another node wants us to stand for leader of a topic that has no leader.
+func (c *cluster) handleCampaign(w http.ResponseWriter, r *http.Request) {
+
+	var req campaignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Topic == "" {
+		http.Error(w, "Invalid campaign request", BAD_REQUEST)
+		return
+	}
+
+	rb := c.b.getRingBuf(req.Topic)
+	rb.mut.Lock()
+	t := rb.raft
+	stand := t.leader == "" || (t.leader != c.self && time.Since(t.heard) > c.electionTimeout)
+	rb.mut.Unlock()
+
+	if stand {
+		go c.campaign(req.Topic)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Another node has passed on a transaction for topics we lead.
+func (c *cluster) handleTxn(w http.ResponseWriter, r *http.Request) {
+
+	var req publishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Envs) == 0 {
+		http.Error(w, "Invalid transaction", BAD_REQUEST)
+		return
+	}
+
+	seqs, dups, err := c.commitTxnAsLeader(req.Envs)
+	if err != nil {
+		http.Error(w, err.Error(), UNAVAILABLE)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(publishResponse{Seqs: seqs, Dups: dups})
+}
+
+// Another node has passed on messages for a topic we lead.
+func (c *cluster) handlePublish(w http.ResponseWriter, r *http.Request) {
+
+	var req publishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Topic == "" {
+		http.Error(w, "Invalid publish request", BAD_REQUEST)
+		return
+	}
+
+	seqs, dups, err := c.storeAsLeader(req.Envs, req.Topic)
+	if err != nil {
+		http.Error(w, err.Error(), UNAVAILABLE)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(publishResponse{Seqs: seqs, Dups: dups})
+}
+
+// Store a batch, sending each topic's messages to its leader. Each leader is sent its share as a batch of its own.
+func (c *cluster) storeBatch(items []batchItem, defTopic string) []batchResult {
+
+	results := make([]batchResult, len(items))
+	byLeader := make(map[string][]int) // The index of each message, grouped by the leader of its topic
+	var leaders []string               // The leaders, in the order we first saw them
+	leaderOf := make(map[string]string)
+
+	for i := range items {
+		if items[i].Topic == "" {
+			items[i].Topic = defTopic
+		}
+
+		leader := c.self // A message without a topic, or for a reply topic, is turned down by storeBatch
+		if topic := items[i].Topic; topic != "" && !isReplyTopic(topic) {
+			var ok bool
+			if leader, ok = leaderOf[topic]; !ok {
+				var err error
+				if leader, err = c.leaderFor(topic); err != nil {
+					leader = ""
+				}
+				leaderOf[topic] = leader
+			}
+		}
+		if leader == "" {
+			results[i] = batchResult{Index: i, Topic: items[i].Topic, Status: UNAVAILABLE, Error: errNoLeader.Error()}
+			continue
+		}
+
+		if _, ok := byLeader[leader]; !ok {
+			leaders = append(leaders, leader)
+		}
+		byLeader[leader] = append(byLeader[leader], i)
+	}
+
+	for _, leader := range leaders {
+		idx := byLeader[leader]
+		part := make([]batchItem, len(idx))
+		for j, i := range idx {
+			part[j] = items[i]
+		}
+
+		var partResults []batchResult
+		var err error
+		if leader == c.self {
+			partResults = c.b.storeBatch(part, defTopic)
+		} else {
+			err = c.call(c.forwarder, leader, BATCH_PATTERN, part, &partResults)
+			if err == nil && len(partResults) != len(part) {
+				err = fmt.Errorf("%s returned %d results for %d messages", leader, len(partResults), len(part))
+			}
+		}
+
+		for j, i := range idx {
+			if err != nil {
+				results[i] = batchResult{Index: i, Topic: items[i].Topic, Status: UNAVAILABLE, Error: err.Error()}
+				continue
+			}
+			results[i] = partResults[j]
+			results[i].Index = i
+		}
+	}
+	return results
+}
+
+// Register a schema on the other nodes too, so that it's there whichever node leads the topic. A node that's down
+// misses out.
+func (c *cluster) broadcastSchema(query url.Values, raw []byte) {
+
+	for _, peer := range c.peers() {
+		req, err := http.NewRequest("POST", peer+SCHEMA_PATTERN+"?"+query.Encode(), bytes.NewReader(raw))
+		if err != nil {
+			fmt.Printf("Cannot send schema to %s: %+v\n", peer, err)
+			continue
+		}
+		req.Header.Set(FORWARDED_HEADER, c.self)
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			fmt.Printf("Cannot send schema to %s: %+v\n", peer, err)
+			continue
+		}
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("%s didn't take the schema: %s %s\n", peer, resp.Status, msg)
+		}
+	}
+}
+
+// Keep an eye on the topics: stand for leader of those whose leader has gone quiet, and stop leading those where
+// we've lost touch with most of the followers. This carries on until the broker's stopped.
+func (c *cluster) run() {
+
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.b.done:
+			return
+		}
+
+		for topic, rb := range c.b.ringBufs() {
+			rb.mut.Lock()
+			t := rb.raft
+			stand := false
+			if t.leader == c.self {
+				if !c.hasQuorum(t) {
+					fmt.Printf("Node %s has lost touch with most of the nodes\n", c.self)
+					c.becomeFollower(rb, topic, t.term)
+				}
+			} else {
+				stand = !t.campaigning && time.Since(t.heard) > c.timeoutFor(topic)
+			}
+			rb.mut.Unlock()
+
+			if stand {
+				go c.campaign(topic)
+			}
+		}
+	}
+}
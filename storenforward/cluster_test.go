@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/types"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// One node of a test cluster, listening on loopback.
+type testNode struct {
+	url string
+	b   *broker
+	srv *http.Server
+}
+
+func (n *testNode) kill() {
+	n.srv.Close()
+	n.b.stop()
+}
+
+// Start a cluster of brokers in this process, with short timeouts so the tests don't take long.
+func startCluster(t *testing.T, size int) []*testNode {
+
+	var listeners []net.Listener
+	var urls []string
+	for i := 0; i < size; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Cannot listen: %v", err)
+		}
+		listeners = append(listeners, ln)
+		urls = append(urls, "http://"+ln.Addr().String())
+	}
+
+	var nodes []*testNode
+	for i, ln := range listeners {
+		b := newBroker()
+		if err := b.joinCluster(urls[i], urls); err != nil {
+			t.Fatalf("Cannot join cluster: %v", err)
+		}
+		b.cluster.heartbeat = 20 * time.Millisecond
+		b.cluster.electionTimeout = 300 * time.Millisecond
+		b.start()
+
+		n := &testNode{url: urls[i], b: b, srv: &http.Server{Handler: b.handler()}}
+		go n.srv.Serve(ln)
+		nodes = append(nodes, n)
+	}
+
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.kill()
+		}
+	})
+	return nodes
+}
+
+// Restart a node of a cluster on the same address, as a new process would, with nothing carried over.
+func restart(t *testing.T, n *testNode, urls []string) *testNode {
+
+	n.kill()
+	var ln net.Listener
+	eventually(t, "the address to be free", func() bool {
+		var err error
+		ln, err = net.Listen("tcp", strings.TrimPrefix(n.url, "http://"))
+		return err == nil
+	})
+	b := newBroker()
+	if err := b.joinCluster(n.url, urls); err != nil {
+		t.Fatalf("Cannot join cluster: %v", err)
+	}
+	b.cluster.heartbeat = 20 * time.Millisecond
+	b.cluster.electionTimeout = 300 * time.Millisecond
+	b.start()
+
+	restarted := &testNode{url: n.url, b: b, srv: &http.Server{Handler: b.handler()}}
+	go restarted.srv.Serve(ln)
+	t.Cleanup(restarted.kill)
+	return restarted
+}
+
+// Publish a message, retrying while the cluster sorts itself out, and return its sequence number.
+func publish(t *testing.T, node *testNode, topic, content string) string {
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Post(node.url+IN_PATTERN+"?topic="+topic, types.DEFAULT_TYPE, strings.NewReader(content))
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return resp.Header.Get(types.SEQUENCE_HEADER)
+			}
+			err = fmt.Errorf("%s: %s", resp.Status, body)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Cannot publish %s to %s: %v", content, node.url, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// The bodies of the messages a node has stored for a topic, oldest first.
+func stored(n *testNode, topic string) []string {
+
+	rb := n.b.getRingBuf(topic)
+	rb.mut.Lock()
+	defer rb.mut.Unlock()
+
+	var bodies []string
+	rb.buf.Do(func(val interface{}) {
+		if env, ok := val.(*types.Envelope); ok {
+			bodies = append(bodies, string(env.Body))
+		}
+	})
+	return bodies
+}
+
+// Who a node thinks the leader of a topic is.
+func leaderOf(n *testNode, topic string) string {
+	rb := n.b.getRingBuf(topic)
+	rb.mut.Lock()
+	defer rb.mut.Unlock()
+	return rb.raft.leader
+}
+
+// Wait for something to be true, failing the test if it isn't in time.
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClusterReplicates(t *testing.T) {
+
+	nodes := startCluster(t, 3)
+
+	// Publish through each of the nodes in turn; they all go to the same leader
+	for i := 1; i <= 6; i++ {
+		seq := publish(t, nodes[i%3], "Bernie", fmt.Sprintf(`{"Id":%d}`, i))
+		if seq != fmt.Sprint(i) {
+			t.Fatalf("Message %d got sequence %s", i, seq)
+		}
+	}
+
+	// A majority has every message as soon as it's acknowledged, and the rest catch up
+	have := 0
+	for _, n := range nodes {
+		if len(stored(n, "Bernie")) == 6 {
+			have++
+		}
+	}
+	if have < 2 {
+		t.Errorf("Only %d nodes had all the messages once they were acknowledged", have)
+	}
+	eventually(t, "every node to have every message", func() bool {
+		for _, n := range nodes {
+			if len(stored(n, "Bernie")) != 6 {
+				return false
+			}
+		}
+		return true
+	})
+
+	leader := leaderOf(nodes[0], "Bernie")
+	for _, n := range nodes[1:] {
+		if l := leaderOf(n, "Bernie"); l != leader {
+			t.Errorf("%s thinks the leader is %q, %s thinks it's %q", n.url, l, nodes[0].url, leader)
+		}
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+
+	nodes := startCluster(t, 3)
+	for i := 1; i <= 3; i++ {
+		publish(t, nodes[0], "Sanders", fmt.Sprintf(`{"Id":%d}`, i))
+	}
+
+	// Kill the leader
+	leader := leaderOf(nodes[0], "Sanders")
+	var survivors []*testNode
+	for _, n := range nodes {
+		if n.url == leader {
+			n.kill()
+		} else {
+			survivors = append(survivors, n)
+		}
+	}
+	if len(survivors) != 2 {
+		t.Fatalf("Leader %q isn't one of the nodes", leader)
+	}
+
+	// The survivors elect a new leader, which carries on from where the old one left off
+	if seq := publish(t, survivors[0], "Sanders", `{"Id":4}`); seq != "4" {
+		t.Errorf("First message after failover got sequence %s", seq)
+	}
+	newLeader := leaderOf(survivors[0], "Sanders")
+	if newLeader == leader || newLeader == "" {
+		t.Errorf("Leader didn't change from %s", leader)
+	}
+
+	// A subscriber, subscribing through either node, gets everything that was acknowledged, in order
+	var mut sync.Mutex
+	var got []string
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mut.Lock()
+		got = append(got, string(body))
+		mut.Unlock()
+	}))
+	defer sub.Close()
+
+	params := url.Values{"id": {"1"}, "topic": {"Sanders"}, "replyto": {sub.URL}}
+	resp, err := http.Get(survivors[1].url + SUB_PATTERN + "?" + params.Encode())
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Subscribe failed: %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	publish(t, survivors[1], "Sanders", `{"Id":5}`)
+
+	want := `{"Id":1}|{"Id":2}|{"Id":3}|{"Id":4}|{"Id":5}`
+	eventually(t, "the subscriber to get every message", func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		return len(got) >= 5
+	})
+	mut.Lock()
+	defer mut.Unlock()
+	if strings.Join(got, "|") != want {
+		t.Errorf("Subscriber got %s, expected %s", strings.Join(got, "|"), want)
+	}
+}
+
+// The Raft state is only held in memory. A restarted node catches up, but it's forgotten its votes, and a cluster
+// that's restarted all at once has lost everything it acknowledged.
+func TestClusterRestart(t *testing.T) {
+
+	nodes := startCluster(t, 3)
+	var urls []string
+	for _, n := range nodes {
+		urls = append(urls, n.url)
+	}
+	for i := 1; i <= 3; i++ {
+		publish(t, nodes[0], "Sanders", fmt.Sprintf(`{"Id":%d}`, i))
+	}
+
+	// A follower that's restarted comes back empty, at term 0, and catches up
+	i := 0
+	for nodes[i].url == leaderOf(nodes[0], "Sanders") {
+		i++
+	}
+	nodes[i] = restart(t, nodes[i], urls)
+	rb := nodes[i].b.getRingBuf("Sanders")
+	eventually(t, "the restarted node to catch up", func() bool { return len(stored(nodes[i], "Sanders")) == 3 })
+	rb.mut.Lock()
+	term := rb.raft.term
+	rb.mut.Unlock()
+	if term == 0 {
+		t.Errorf("The restarted node is still at term 0")
+	}
+
+	// but it'll vote again in a term it's already voted in
+	vote := func(n *testNode, candidate string) bool {
+		rb := n.b.getRingBuf("Votes")
+		rb.mut.Lock()
+		defer rb.mut.Unlock()
+		return n.b.cluster.vote(rb, &voteRequest{Topic: "Votes", Term: 100, Candidate: candidate}).Granted
+	}
+	if !vote(nodes[i], "a") || vote(nodes[i], "b") {
+		t.Fatalf("Voted for both candidates in one term without restarting")
+	}
+	nodes[i] = restart(t, nodes[i], urls)
+	if !vote(nodes[i], "b") {
+		t.Errorf("A restarted node didn't vote again in the same term")
+	}
+
+	// Restarting them all loses what was acknowledged
+	for i := range nodes {
+		nodes[i] = restart(t, nodes[i], urls)
+	}
+	if seq := publish(t, nodes[0], "Sanders", `{"Id":4}`); seq != "1" {
+		t.Errorf("After restarting every node the next message got sequence %s", seq)
+	}
+}
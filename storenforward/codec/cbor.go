@@ -0,0 +1,309 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CBOR, see RFC 8949. Everything is encoded with definite lengths and floats as 64 bits; indefinite lengths and half
+// and single precision floats can be decoded. Tags are decoded as the value they're tagging.
+type cborCodec struct{}
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+
+	cborBreak = 0xff // Ends an indefinite length item
+)
+
+func (cborCodec) ContentType() string  { return CBOR }
+func (cborCodec) SelfDescribing() bool { return true }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := cborEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	d := &decoder{data: data}
+	g, err := d.cborValue(0)
+	if err != nil {
+		return err
+	}
+	if g == cborBreakMarker {
+		return errors.New("cbor: unexpected break")
+	}
+	if d.pos != len(data) {
+		return errors.New("cbor: unexpected data after value")
+	}
+	return fromGeneric(g, v)
+}
+
+func cborEncode(buf *bytes.Buffer, v interface{}) error {
+
+	switch x := v.(type) {
+	case nil:
+		buf.WriteByte(cborSimple | 22)
+	case bool:
+		if x {
+			buf.WriteByte(cborSimple | 21)
+		} else {
+			buf.WriteByte(cborSimple | 20)
+		}
+	case int:
+		cborInt(buf, int64(x))
+	case int8:
+		cborInt(buf, int64(x))
+	case int16:
+		cborInt(buf, int64(x))
+	case int32:
+		cborInt(buf, int64(x))
+	case int64:
+		cborInt(buf, x)
+	case uint:
+		cborHead(buf, cborUint, uint64(x))
+	case uint8:
+		cborHead(buf, cborUint, uint64(x))
+	case uint16:
+		cborHead(buf, cborUint, uint64(x))
+	case uint32:
+		cborHead(buf, cborUint, uint64(x))
+	case uint64:
+		cborHead(buf, cborUint, x)
+	case float32:
+		return cborEncode(buf, float64(x))
+	case float64:
+		buf.WriteByte(cborSimple | 27)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(x))
+	case json.Number:
+		n, err := fromNumber(x)
+		if err != nil {
+			return err
+		}
+		return cborEncode(buf, n)
+	case string:
+		cborHead(buf, cborText, uint64(len(x)))
+		buf.WriteString(x)
+	case []byte:
+		cborHead(buf, cborBytes, uint64(len(x)))
+		buf.Write(x)
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(x)))
+		for _, e := range x {
+			if err := cborEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		cborHead(buf, cborMap, uint64(len(x)))
+		for k, e := range x {
+			cborEncode(buf, k)
+			if err := cborEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	default:
+		g, err := toGeneric(v)
+		if err != nil {
+			return err
+		}
+		return cborEncode(buf, g)
+	}
+	return nil
+}
+
+func cborInt(buf *bytes.Buffer, i int64) {
+	if i >= 0 {
+		cborHead(buf, cborUint, uint64(i))
+	} else {
+		cborHead(buf, cborNegInt, uint64(-1-i))
+	}
+}
+
+// Write the major type and the argument, which is a value or a length, in as few bytes as it'll fit.
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{major | 24, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// Returned by cborValue when it finds the end of an indefinite length item.
+var cborBreakMarker = &struct{}{}
+
+func (d *decoder) cborValue(depth int) (interface{}, error) {
+
+	if depth > MAX_DEPTH {
+		return nil, errTooDeep
+	}
+	b, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	if b == cborBreak {
+		return cborBreakMarker, nil
+	}
+
+	major, info := b&0xe0, b&0x1f
+	indefinite := info == 31
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		if arg, err = d.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	case indefinite && major >= cborBytes && major <= cborMap:
+	default:
+		return nil, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+
+	switch major {
+	case cborUint:
+		return unsigned(arg), nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return -1 - float64(arg), nil // Doesn't fit in an int64
+		}
+		return -1 - int64(arg), nil
+	case cborBytes, cborText:
+		var data []byte
+		if indefinite {
+			// A series of definite length chunks
+			for {
+				chunk, err := d.cborValue(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				if chunk == cborBreakMarker {
+					break
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					data = append(data, c...)
+				case string:
+					data = append(data, c...)
+				default:
+					return nil, errors.New("cbor: bad chunk in indefinite length string")
+				}
+			}
+		} else if data, err = d.bytes(cborLen(arg)); err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(data), nil
+		}
+		return data, nil
+	case cborArray:
+		arr := []interface{}{}
+		for i := 0; indefinite || i < cborLen(arg); i++ {
+			v, err := d.cborValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if v == cborBreakMarker {
+				if indefinite {
+					break
+				}
+				return nil, errors.New("cbor: unexpected break")
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case cborMap:
+		m := map[string]interface{}{}
+		for i := 0; indefinite || i < cborLen(arg); i++ {
+			k, err := d.cborValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if k == cborBreakMarker {
+				if indefinite {
+					break
+				}
+				return nil, errors.New("cbor: unexpected break")
+			}
+			v, err := d.cborValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if v == cborBreakMarker {
+				return nil, errors.New("cbor: unexpected break")
+			}
+			m[keyString(k)] = v
+		}
+		return m, nil
+	case cborTag:
+		return d.cborValue(depth + 1)
+	}
+
+	// Simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return halfToFloat(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+}
+
+// Lengths bigger than the data can't be right, so they're made negative for decoder.bytes to reject.
+func cborLen(arg uint64) int {
+	if arg > math.MaxInt32 {
+		return -1
+	}
+	return int(arg)
+}
+
+// Convert an IEEE 754 half precision float.
+func halfToFloat(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(mant+1024, exp-25)
+}
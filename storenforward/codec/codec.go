@@ -0,0 +1,170 @@
+/*
+Package codec holds the wire formats that messages can be sent in, keyed by their content type, so that the
+publisher, the storenforward and the subscriber all agree on how to turn a content type into a value and back.
+
+JSON, MessagePack and CBOR are self describing, so anything they encode can be decoded into an interface{} and
+re-encoded in another format. Protobuf isn't, so the only thing it knows how to encode is a types.Message, or a value
+that implements ProtoMarshaler and ProtoUnmarshaler.
+*/
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	JSON     = "application/json"
+	MSGPACK  = "application/msgpack"
+	CBOR     = "application/cbor"
+	PROTOBUF = "application/x-protobuf"
+)
+
+// A Codec turns values into bytes of a particular content type, and back again.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The codecs that can decode anything they've encoded into an interface{} implement this, and return true.
+type selfDescribing interface {
+	SelfDescribing() bool
+}
+
+var (
+	ErrUnknownType   = errors.New("codec: unknown content type")
+	ErrNotAcceptable = errors.New("codec: none of the accepted content types are available")
+
+	mut      = &sync.RWMutex{}
+	registry = make(map[string]Codec) // The codecs by content type, and any aliases
+)
+
+func init() {
+	Register(jsonCodec{})
+	Register(msgpackCodec{}, "application/x-msgpack")
+	Register(cborCodec{})
+	Register(protoCodec{}, "application/protobuf")
+}
+
+// Add a codec to the registry under its content type and any aliases, replacing whatever was there.
+func Register(c Codec, aliases ...string) {
+
+	mut.Lock()
+	defer mut.Unlock()
+
+	registry[MediaType(c.ContentType())] = c
+	for _, alias := range aliases {
+		registry[MediaType(alias)] = c
+	}
+}
+
+// Get the codec for a content type. Parameters, such as charset, are ignored.
+func Get(contentType string) (Codec, error) {
+
+	mut.RLock()
+	defer mut.RUnlock()
+
+	if c, ok := registry[MediaType(contentType)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%v: %q", ErrUnknownType, contentType)
+}
+
+// Strip the parameters from a content type and put it in lower case, so that it can be compared.
+func MediaType(contentType string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// Whether two content types are the same, ignoring their parameters.
+func Same(a, b string) bool {
+	return MediaType(a) == MediaType(b)
+}
+
+// Pick a content type from an HTTP style Accept list, e.g. "application/cbor, application/json;q=0.5". The one with
+// the highest quality that there's a codec for wins, with ties going to the first listed. The empty string is
+// returned if the list is empty or anything will do (*/*), meaning the messages can be sent as they were published.
+func Negotiate(accept string) (string, error) {
+
+	if strings.TrimSpace(accept) == "" {
+		return "", nil
+	}
+
+	type choice struct {
+		mediaType string
+		q         float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{mt, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+
+	for _, c := range choices {
+		if c.mediaType == "*/*" {
+			return "", nil
+		}
+		if _, err := Get(c.mediaType); err == nil {
+			return c.mediaType, nil
+		}
+	}
+	return "", ErrNotAcceptable
+}
+
+// Convert data from one content type to another. Self describing formats are converted via an interface{}; if either
+// side isn't self describing then the data has to be a types.Message.
+func Transcode(data []byte, from, to string) ([]byte, error) {
+
+	if Same(from, to) {
+		return data, nil
+	}
+
+	src, err := Get(from)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := Get(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if isSelfDescribing(src) && isSelfDescribing(dst) {
+		var v interface{}
+		if err := src.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return dst.Marshal(v)
+	}
+
+	var msg types.Message
+	if err := src.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return dst.Marshal(&msg)
+}
+
+func isSelfDescribing(c Codec) bool {
+	sd, ok := c.(selfDescribing)
+	return ok && sd.SelfDescribing()
+}
@@ -0,0 +1,196 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"gsamples/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var sample = types.Message{
+	Topic:   "Bernie",
+	Id:      -42,
+	Content: "How do I send a JSON string in a POST request in Go",
+	Time:    time.Date(2018, 3, 14, 15, 9, 26, 535897932, time.UTC),
+}
+
+func TestKnownEncodings(t *testing.T) {
+
+	tests := []struct {
+		contentType string
+		value       interface{}
+		hex         string
+	}{
+		{MSGPACK, map[string]interface{}{"a": int64(1)}, "81a16101"},
+		{MSGPACK, []interface{}{int64(-1), int64(300), "hi", nil, true}, "95ffcd012ca26869c0c3"},
+		{CBOR, []interface{}{int64(1), int64(-1), "a"}, "83012061 61"},
+		{CBOR, map[string]interface{}{"a": []byte{1, 2}}, "a1616142 0102"},
+	}
+
+	for _, test := range tests {
+		c, err := Get(test.contentType)
+		if err != nil {
+			t.Fatalf("No codec for %s: %v", test.contentType, err)
+		}
+
+		data, err := c.Marshal(test.value)
+		if err != nil {
+			t.Fatalf("%s marshal error: %v", test.contentType, err)
+		}
+		want, _ := hex.DecodeString(string(bytes.Replace([]byte(test.hex), []byte(" "), nil, -1)))
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s encoding of %v is %x, expected %x", test.contentType, test.value, data, want)
+		}
+
+		var back interface{}
+		if err := c.Unmarshal(data, &back); err != nil {
+			t.Fatalf("%s unmarshal error: %v", test.contentType, err)
+		}
+		if !reflect.DeepEqual(back, test.value) {
+			t.Errorf("%s round trip gave %#v, expected %#v", test.contentType, back, test.value)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+
+	for _, ct := range []string{JSON, MSGPACK, CBOR, PROTOBUF} {
+		c, err := Get(ct)
+		if err != nil {
+			t.Fatalf("No codec for %s: %v", ct, err)
+		}
+
+		data, err := c.Marshal(&sample)
+		if err != nil {
+			t.Fatalf("%s marshal error: %v", ct, err)
+		}
+
+		var msg types.Message
+		if err := c.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("%s unmarshal error: %v", ct, err)
+		}
+		if msg.Topic != sample.Topic || msg.Id != sample.Id || msg.Content != sample.Content || !msg.Time.Equal(sample.Time) {
+			t.Errorf("%s round trip gave %+v, expected %+v", ct, msg, sample)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+
+	js, _ := Get(JSON)
+	orig, _ := js.Marshal(&sample)
+
+	// Through each of the others and back to JSON again
+	for _, ct := range []string{MSGPACK, CBOR, PROTOBUF} {
+		data, err := Transcode(orig, JSON, ct)
+		if err != nil {
+			t.Fatalf("Transcode to %s error: %v", ct, err)
+		}
+		back, err := Transcode(data, ct+"; charset=binary", "application/json; charset=utf-8")
+		if err != nil {
+			t.Fatalf("Transcode from %s error: %v", ct, err)
+		}
+
+		var msg types.Message
+		if err := js.Unmarshal(back, &msg); err != nil {
+			t.Fatalf("Unmarshal after %s error: %v", ct, err)
+		}
+		if msg.Id != sample.Id || !msg.Time.Equal(sample.Time) {
+			t.Errorf("Transcoding through %s gave %+v", ct, msg)
+		}
+	}
+
+	if _, err := Transcode(orig, JSON, "text/plain"); err == nil {
+		t.Error("Expected an error transcoding to an unknown type")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", "", true},
+		{"*/*", "", true},
+		{"application/cbor", CBOR, true},
+		{"text/html, application/json;q=0.5, application/msgpack;q=0.8", MSGPACK, true},
+		{"application/x-msgpack", "application/x-msgpack", true},
+		{"text/html", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := Negotiate(test.accept)
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("Negotiate(%q) = %q, %v", test.accept, got, err)
+		}
+	}
+}
+
+func TestBadData(t *testing.T) {
+
+	for _, ct := range []string{MSGPACK, CBOR, PROTOBUF} {
+		c, _ := Get(ct)
+		for _, data := range [][]byte{{0xdd, 0xff, 0xff, 0xff, 0xff}, {0x9f, 0xbf}, {0x0a, 0x10, 0x01}} {
+			var msg types.Message
+			if err := c.Unmarshal(data, &msg); err == nil {
+				t.Errorf("%s accepted bad data %x", ct, data)
+			}
+		}
+	}
+}
+
+func TestEncodings(t *testing.T) {
+
+	data := bytes.Repeat([]byte(`{"Id": 1, "Content": "How do I send a JSON string in a POST request in Go"}`), 50)
+	for _, name := range []string{GZIP, DEFLATE, ZSTD, IDENTITY, ""} {
+		packed, err := Compress(data, name)
+		if err != nil {
+			t.Fatalf("Compress with %q: %v", name, err)
+		}
+		if !IsIdentity(name) && len(packed) >= len(data) {
+			t.Errorf("%s didn't compress: %d bytes from %d", name, len(packed), len(data))
+		}
+		got, err := Decompress(packed, name)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%q round trip gave %d bytes, %v", name, len(got), err)
+		}
+	}
+
+	// Deflate is also read when it's really zlib
+	zlibbed, _ := hex.DecodeString("789ccb48cdc9c90700062c0215")
+	if got, err := Decompress(zlibbed, DEFLATE); err != nil || string(got) != "hello" {
+		t.Errorf("zlib deflate gave %q, %v", got, err)
+	}
+
+	if _, err := Decompress(data, "br"); err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+	if _, err := Decompress(data, GZIP); err == nil {
+		t.Error("Expected an error for data that isn't gzipped")
+	}
+	if _, err := Decompress(data, ZSTD); err == nil {
+		t.Error("Expected an error for data that isn't zstd")
+	}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", GZIP},
+		{"br, deflate;q=0.5, gzip;q=0.8", GZIP},
+		{"zstd, gzip", ZSTD},
+		{"identity, gzip", ""},
+		{"*", GZIP},
+		{"gzip;q=0", ""},
+	}
+	for _, test := range tests {
+		if got := NegotiateEncoding(test.accept); got != test.want {
+			t.Errorf("NegotiateEncoding(%q) = %q, expected %q", test.accept, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package codec
+
+import "errors"
+
+const MAX_DEPTH = 100 // How deeply arrays and maps can be nested in binary formats, to stop a bad message blowing the stack
+
+var (
+	errShort   = errors.New("codec: unexpected end of data")
+	errTooDeep = errors.New("codec: data nested too deeply")
+)
+
+// Reads the big endian binary formats - MessagePack and CBOR - a piece at a time.
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) remaining() int {
+	return len(d.data) - d.pos
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errShort
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+// Read an unsigned big endian integer of the given number of bytes.
+func (d *decoder) uint(size int) (uint64, error) {
+	if d.remaining() < size {
+		return 0, errShort
+	}
+	var u uint64
+	for _, b := range d.data[d.pos : d.pos+size] {
+		u = u<<8 | uint64(b)
+	}
+	d.pos += size
+	return u, nil
+}
+
+// Read n bytes, copying them so that the result doesn't hang on to the message.
+func (d *decoder) bytes(n int) ([]byte, error) {
+	if n < 0 || d.remaining() < n {
+		return nil, errShort
+	}
+	b := make([]byte, n)
+	copy(b, d.data[d.pos:])
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) str(n int) (string, error) {
+	if n < 0 || d.remaining() < n {
+		return "", errShort
+	}
+	s := string(d.data[d.pos : d.pos+n])
+	d.pos += n
+	return s, nil
+}
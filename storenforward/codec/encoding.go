@@ -0,0 +1,238 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Content encodings, i.e. compression, keyed by their HTTP Content-Encoding name. gzip, deflate and zstd come built in.
+Others can be added with RegisterEncoding.
+*/
+
+const (
+	GZIP     = "gzip"
+	DEFLATE  = "deflate"
+	ZSTD     = "zstd"
+	IDENTITY = "identity" // No encoding
+
+	MAX_DECOMPRESSED = 64 << 20 // The most a message can decompress to, so that a small message can't use up all the memory
+)
+
+// An Encoding compresses and decompresses data.
+type Encoding interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	ErrUnknownEncoding = errors.New("codec: unknown content encoding")
+	ErrTooBig          = errors.New("codec: decompressed data is too big")
+
+	encodings = make(map[string]Encoding) // Guarded by mut
+)
+
+func init() {
+	RegisterEncoding(gzipEncoding{})
+	RegisterEncoding(deflateEncoding{})
+	RegisterEncoding(zstdEncoding{})
+}
+
+// Add an encoding to the registry, replacing any with the same name.
+func RegisterEncoding(e Encoding) {
+	mut.Lock()
+	defer mut.Unlock()
+	encodings[strings.ToLower(e.Name())] = e
+}
+
+// Get an encoding by name.
+func GetEncoding(name string) (Encoding, error) {
+
+	mut.RLock()
+	defer mut.RUnlock()
+
+	if e, ok := encodings[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return e, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, name)
+}
+
+// Whether a Content-Encoding means the data isn't encoded.
+func IsIdentity(name string) bool {
+	name = strings.TrimSpace(name)
+	return name == "" || strings.EqualFold(name, IDENTITY)
+}
+
+// Compress data with the named encoding. The identity encoding leaves it as it is.
+func Compress(data []byte, name string) ([]byte, error) {
+	if IsIdentity(name) {
+		return data, nil
+	}
+	e, err := GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.Compress(data)
+}
+
+// Decompress data that was compressed with the named encoding. The identity encoding leaves it as it is.
+func Decompress(data []byte, name string) ([]byte, error) {
+	if IsIdentity(name) {
+		return data, nil
+	}
+	e, err := GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.Decompress(data)
+}
+
+// Pick an encoding from an HTTP style Accept-Encoding list, e.g. "gzip;q=0.8, deflate". The highest quality one that's
+// registered wins, with ties going to the first listed, and * meaning gzip. The empty string means no encoding.
+func NegotiateEncoding(accept string) string {
+
+	type choice struct {
+		name string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{name, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+
+	for _, c := range choices {
+		switch c.name {
+		case IDENTITY:
+			return ""
+		case "*":
+			return GZIP
+		}
+		if _, err := GetEncoding(c.name); err == nil {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// Read everything, but no more than MAX_DECOMPRESSED.
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MAX_DECOMPRESSED+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_DECOMPRESSED {
+		return nil, ErrTooBig
+	}
+	return data, nil
+}
+
+type gzipEncoding struct{}
+
+func (gzipEncoding) Name() string { return GZIP }
+
+func (gzipEncoding) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipEncoding) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r)
+}
+
+// HTTP's deflate is really zlib, but plenty of software sends raw deflate. This sends raw deflate, as most do, and
+// reads either.
+type deflateEncoding struct{}
+
+func (deflateEncoding) Name() string { return DEFLATE }
+
+func (deflateEncoding) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateEncoding) Decompress(data []byte) ([]byte, error) {
+	// A zlib stream starts with a header whose first two bytes, as a big endian number, are a multiple of 31
+	if len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0 {
+		if r, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			plain, err := readLimited(r)
+			r.Close()
+			if err == nil {
+				return plain, nil
+			}
+		}
+	}
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readLimited(r)
+}
+
+// zstd, which compresses JSON better than gzip, and faster. The one encoder is shared, as EncodeAll can be called on it
+// from any number of goroutines; the readers aren't, as they're only cheap to make with one goroutine each.
+type zstdEncoding struct{}
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func (zstdEncoding) Name() string { return ZSTD }
+
+func (zstdEncoding) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (zstdEncoding) Decompress(data []byte) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MAX_DECOMPRESSED))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r)
+}
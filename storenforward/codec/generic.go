@@ -0,0 +1,74 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+/*
+MessagePack and CBOR are encoded from, and decoded to, generic values: nil, bool, int64, uint64, float64, string,
+[]byte, []interface{} and map[string]interface{}. Anything else, such as a struct, is converted to and from the
+generic form by way of JSON, which means that the usual json field tags apply.
+*/
+
+// Turn a value that isn't already generic into its generic form.
+func toGeneric(v interface{}) (interface{}, error) {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var g interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Put a generic value into whatever v points to.
+func fromGeneric(g interface{}, v interface{}) error {
+
+	if p, ok := v.(*interface{}); ok {
+		*p = g
+		return nil
+	}
+
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Map keys that aren't strings are turned into strings, as JSON would need them to be anyway.
+func keyString(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+// Decoded integers are int64 unless they're too big, so that the same value always decodes to the same type.
+func unsigned(u uint64) interface{} {
+	if u <= math.MaxInt64 {
+		return int64(u)
+	}
+	return u
+}
+
+// Turn a json.Number into an int64, uint64 or float64, whichever fits.
+func fromNumber(n json.Number) (interface{}, error) {
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	var u uint64
+	if _, err := fmt.Sscan(string(n), &u); err == nil {
+		return u, nil
+	}
+	return n.Float64()
+}
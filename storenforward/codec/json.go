@@ -0,0 +1,23 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// The standard library's JSON, except that numbers decoded into an interface{} keep their precision as json.Number,
+// so that an integer is still an integer if it's re-encoded in another format.
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string  { return JSON }
+func (jsonCodec) SelfDescribing() bool { return true }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
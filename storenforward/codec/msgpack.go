@@ -0,0 +1,277 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MessagePack, see https://github.com/msgpack/msgpack/blob/master/spec.md. Extension types aren't supported.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string  { return MSGPACK }
+func (msgpackCodec) SelfDescribing() bool { return true }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := mpEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	d := &decoder{data: data}
+	g, err := d.mpValue(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return errors.New("msgpack: unexpected data after value")
+	}
+	return fromGeneric(g, v)
+}
+
+func mpEncode(buf *bytes.Buffer, v interface{}) error {
+
+	switch x := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if x {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		mpInt(buf, int64(x))
+	case int8:
+		mpInt(buf, int64(x))
+	case int16:
+		mpInt(buf, int64(x))
+	case int32:
+		mpInt(buf, int64(x))
+	case int64:
+		mpInt(buf, x)
+	case uint:
+		mpUint(buf, uint64(x))
+	case uint8:
+		mpUint(buf, uint64(x))
+	case uint16:
+		mpUint(buf, uint64(x))
+	case uint32:
+		mpUint(buf, uint64(x))
+	case uint64:
+		mpUint(buf, x)
+	case float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(x))
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(x))
+	case json.Number:
+		n, err := fromNumber(x)
+		if err != nil {
+			return err
+		}
+		return mpEncode(buf, n)
+	case string:
+		mpHeader(buf, len(x), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(x)
+	case []byte:
+		mpHeader(buf, len(x), 0, 0, 0xc4, 0xc5, 0xc6)
+		buf.Write(x)
+	case []interface{}:
+		mpHeader(buf, len(x), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range x {
+			if err := mpEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		mpHeader(buf, len(x), 0x80, 16, 0, 0xde, 0xdf)
+		for k, e := range x {
+			mpEncode(buf, k)
+			if err := mpEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	default:
+		g, err := toGeneric(v)
+		if err != nil {
+			return err
+		}
+		return mpEncode(buf, g)
+	}
+	return nil
+}
+
+func mpInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		mpUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func mpUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u < 128:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(u)})
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+// Write the type and length for a string, binary, array or map. The fix form is used when n < fixMax; a zero code
+// means that size isn't available for the type.
+func mpHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, c8, c16, c32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		buf.Write([]byte{c8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(c16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(c32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func (d *decoder) mpValue(depth int) (interface{}, error) {
+
+	if depth > MAX_DEPTH {
+		return nil, errTooDeep
+	}
+	b, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return d.str(int(b & 0x1f))
+	case b&0xf0 == 0x90:
+		return d.mpArray(int(b&0x0f), depth)
+	case b&0xf0 == 0x80:
+		return d.mpMap(int(b&0x0f), depth)
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return unsigned(u), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, nil // Sign extend
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.mpArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mpMap(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", b)
+}
+
+func (d *decoder) mpArray(n int, depth int) (interface{}, error) {
+	if n > d.remaining() {
+		return nil, errShort
+	}
+	arr := make([]interface{}, n)
+	for i := range arr {
+		v, err := d.mpValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func (d *decoder) mpMap(n int, depth int) (interface{}, error) {
+	if n > d.remaining() {
+		return nil, errShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.mpValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.mpValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[keyString(k)] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,182 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"time"
+)
+
+/*
+Protobuf. As there's no schema in the data, values have to know how to encode themselves by implementing
+ProtoMarshaler and ProtoUnmarshaler; the generated code from protoc-gen-go's older API does. types.Message is built in,
+with this schema:
+
+	message Message {
+	  string topic = 1;
+	  int64 id = 2;
+	  string content = 3;
+	  google.protobuf.Timestamp time = 4;
+	}
+*/
+
+type ProtoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type ProtoUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+	wire32     = 5
+)
+
+var errNotProto = errors.New("protobuf: can only encode a types.Message or a ProtoMarshaler")
+
+type protoCodec struct{}
+
+func (protoCodec) ContentType() string  { return PROTOBUF }
+func (protoCodec) SelfDescribing() bool { return false }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case ProtoMarshaler:
+		return m.Marshal()
+	case *types.Message:
+		return marshalMessage(m), nil
+	case types.Message:
+		return marshalMessage(&m), nil
+	}
+	return nil, errNotProto
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case ProtoUnmarshaler:
+		return m.Unmarshal(data)
+	case *types.Message:
+		return unmarshalMessage(data, m)
+	}
+	return errNotProto
+}
+
+func marshalMessage(m *types.Message) []byte {
+
+	var b []byte
+	b = appendString(b, 1, m.Topic)
+	if m.Id != 0 {
+		b = appendTag(b, 2, wireVarint)
+		b = binary.AppendUvarint(b, uint64(int64(m.Id)))
+	}
+	b = appendString(b, 3, m.Content)
+	if !m.Time.IsZero() {
+		// A google.protobuf.Timestamp: seconds = 1, nanos = 2
+		var ts []byte
+		ts = appendTag(ts, 1, wireVarint)
+		ts = binary.AppendUvarint(ts, uint64(m.Time.Unix()))
+		if nanos := m.Time.Nanosecond(); nanos != 0 {
+			ts = appendTag(ts, 2, wireVarint)
+			ts = binary.AppendUvarint(ts, uint64(nanos))
+		}
+		b = appendTag(b, 4, wireBytes)
+		b = binary.AppendUvarint(b, uint64(len(ts)))
+		b = append(b, ts...)
+	}
+	return b
+}
+
+func unmarshalMessage(data []byte, m *types.Message) error {
+
+	*m = types.Message{}
+	return protoFields(data, func(num int, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			m.Topic = string(b)
+		case num == 2 && wire == wireVarint:
+			m.Id = int(int64(v))
+		case num == 3 && wire == wireBytes:
+			m.Content = string(b)
+		case num == 4 && wire == wireBytes:
+			var secs, nanos int64
+			err := protoFields(b, func(num int, wire int, v uint64, _ []byte) error {
+				if wire == wireVarint && num == 1 {
+					secs = int64(v)
+				} else if wire == wireVarint && num == 2 {
+					nanos = int64(int32(v))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.Time = time.Unix(secs, nanos).UTC()
+		}
+		return nil // Anything else is a field we don't know about
+	})
+}
+
+func appendTag(b []byte, num int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+func appendString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, num, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Call fn for each field in a message, with the value for varints and fixed width fields, or the bytes for length
+// delimited ones.
+func protoFields(data []byte, fn func(num int, wire int, v uint64, b []byte) error) error {
+
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("protobuf: bad tag")
+		}
+		data = data[n:]
+		num, wire := int(tag>>3), int(tag&7)
+
+		var v uint64
+		var b []byte
+		switch wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("protobuf: bad varint")
+			}
+			data = data[n:]
+		case wire64:
+			if len(data) < 8 {
+				return errShort
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wire32:
+			if len(data) < 4 {
+				return errShort
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errShort
+			}
+			b, data = data[n:n+int(l)], data[n+int(l):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", wire)
+		}
+
+		if err := fn(num, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/storenforward/codec"
+	"gsamples/types"
+	"net/http"
+)
+
+/*
+Compression. A message can be published compressed, by sending it with a Content-Encoding header - gzip, deflate and
+zstd are understood. It's stored as it was sent, so a topic of large messages takes up much less memory. Messages that
+weren't compressed, but are bigger than COMPRESS_OVER bytes, are gzipped before they're stored, as long as that
+actually makes them smaller. The -compress-over flag changes the size, and 0 turns this off.
+
+Messages are only decompressed when the storenforward needs to look inside them, e.g. to check them against a schema,
+and that's never stored. The Content-Encoding a message is stored with goes along with it in its envelope.
+
+A subscriber says which encodings it can take with the Accept-Encoding header on its subscribe request, e.g.
+"Accept-Encoding: zstd, gzip;q=0.8". A subscriber that doesn't send one, or only asks for identity, gets every message
+decompressed. One that does gets compressed messages in the encoding it asked for - recompressing them if need be - and
+small messages uncompressed. Go's HTTP client sends "Accept-Encoding: gzip" of its own accord when a request hasn't
+got one, so a Go subscriber whose handler can't read gzip has to send "Accept-Encoding: identity", as client.Subscriber
+does.
+*/
+
+const (
+	COMPRESS_OVER          = 1024                // Messages bigger than this many bytes are compressed for storage
+	STORE_ENCODING         = codec.GZIP          // How they're compressed
+	ACCEPT_ENCODING_HEADER = "X-Accept-Encoding" // The encoding agreed at subscribe time, if the subscriber asked for one
+	UNSUPPORTED_MEDIA_TYPE = 415                 // The message is compressed in a way we don't understand
+)
+
+// The message body as it was before it was compressed. Anything that needs to look inside a message uses this.
+func plainBody(env *types.Envelope) ([]byte, error) {
+	return codec.Decompress(env.Body, env.Encoding)
+}
+
+// Compress a message for storage, if it's worth it. This has to happen before the message is stored, as a stored
+// envelope mustn't change.
+func (b *broker) compressForStore(env *types.Envelope) {
+
+	if b.compressOver <= 0 || !codec.IsIdentity(env.Encoding) || len(env.Body) <= b.compressOver {
+		return
+	}
+
+	body, err := codec.Compress(env.Body, STORE_ENCODING)
+	if err != nil {
+		fmt.Printf("Cannot compress message for %s: %+v\n", env.Topic, err)
+		return
+	}
+	if len(body) >= len(env.Body) {
+		return
+	}
+	env.Body = body
+	env.Encoding = STORE_ENCODING
+}
+
+// Work out which encoding a new subscriber wants, if any, from its subscribe request.
+func negotiateEncoding(h http.Header) string {
+	return codec.NegotiateEncoding(h.Get("Accept-Encoding"))
+}
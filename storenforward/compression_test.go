@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gsamples/storenforward/codec"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// A big message is stored compressed, and each subscriber gets it in the encoding its Accept-Encoding header asks for,
+// or decompressed.
+func TestDeliveryEncoding(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	body := fmt.Sprintf(`{"Id":1,"Content":%q}`, bytes.Repeat([]byte("compress me "), 200))
+
+	agreed := map[string]string{"zstd, gzip;q=0.5": codec.ZSTD, "identity": ""}
+	recs := make(map[string]*testReceiver)
+	for accept, want := range agreed {
+		rec := newTestReceiver(t)
+		params := url.Values{"id": {fmt.Sprint(time.Now().UnixNano())}, "topic": {"Orders"}, "replyto": {rec.srv.URL}}
+		req, _ := http.NewRequest("GET", n.url+SUB_PATTERN+"?"+params.Encode(), nil)
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Subscribe failed: %v %v", resp, err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get(ACCEPT_ENCODING_HEADER) != want {
+			t.Errorf("Asking for %q agreed %q", accept, resp.Header.Get(ACCEPT_ENCODING_HEADER))
+		}
+		recs[accept] = rec
+	}
+
+	publish(t, n, "Orders", body)
+	if env := n.b.getRingBuf("Orders").entry(1); env == nil || env.Encoding != STORE_ENCODING {
+		t.Errorf("Stored %+v", env)
+	}
+
+	for accept, rec := range recs {
+		eventually(t, "the message", func() bool { return len(rec.seqs()) == 1 })
+		rec.mut.Lock()
+		env := rec.envs[0][0]
+		rec.mut.Unlock()
+		plain, err := codec.Decompress(env.Body, env.Encoding)
+		if env.Encoding != agreed[accept] || err != nil || string(plain) != body {
+			t.Errorf("Asking for %q got %d bytes in %q: %v", accept, len(env.Body), env.Encoding, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"gsamples/types"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Idempotent publishing. A publisher that retries after a timeout can't tell whether its first attempt was stored, so it
+can give each message an idempotency key, either with the Idempotency-Key header or, with the dedup=id parameter, by
+letting us use the Id of the types.Message it's sending. If a message turns up with a key that's already been
+published to the topic, then it's ignored and the reply carries the original's sequence number and DUPLICATE_HEADER.
+
+Keys are remembered per topic for a window, which is limited both by time and by the number of keys, whichever
+runs out first. Both can be set on the command line.
+*/
+
+const (
+	DUPLICATE_HEADER = "X-Duplicate" // Set on the reply when a message had already been published
+	DEDUP_WINDOW     = 5 * time.Minute
+	DEDUP_MAX        = 10000
+)
+
+// A key and the sequence number of the message that used it.
+type dedupEntry struct {
+	key string
+	seq uint64
+	at  time.Time // When the message was stored
+}
+
+// The keys recently published to a topic. This isn't safe for concurrent use; it's guarded by the topic's ring lock.
+type dedupWindow struct {
+	maxAge time.Duration
+	max    int
+	keys   map[string]*list.Element // The entries by key
+	order  *list.List               // The entries, oldest first
+}
+
+func newDedupWindow(maxAge time.Duration, max int) *dedupWindow {
+	return &dedupWindow{
+		maxAge: maxAge,
+		max:    max,
+		keys:   make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// Look for a key in the window, returning the sequence number of the message that used it.
+func (d *dedupWindow) check(key string) (uint64, bool) {
+
+	if key == "" {
+		return 0, false
+	}
+
+	d.expire(time.Now())
+	if e, ok := d.keys[key]; ok {
+		return e.Value.(dedupEntry).seq, true
+	}
+	return 0, false
+}
+
+// Remember a key, forgetting the oldest one if the window is full.
+func (d *dedupWindow) add(key string, seq uint64) {
+
+	if key == "" || d.max <= 0 {
+		return
+	}
+
+	d.keys[key] = d.order.PushBack(dedupEntry{key: key, seq: seq, at: time.Now()})
+	for d.order.Len() > d.max {
+		d.remove(d.order.Front())
+	}
+}
+
+// Forget the keys that have been around for longer than the window.
+func (d *dedupWindow) expire(now time.Time) {
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(dedupEntry).at) > d.maxAge; e = d.order.Front() {
+		d.remove(e)
+	}
+}
+
+// Forget a key, because the message that used it has been thrown away.
+func (d *dedupWindow) forget(key string) {
+	if e, ok := d.keys[key]; ok {
+		d.remove(e)
+	}
+}
+
+func (d *dedupWindow) remove(e *list.Element) {
+	delete(d.keys, e.Value.(dedupEntry).key)
+	d.order.Remove(e)
+}
+
+// Get the idempotency key for a published message, if there is one.
+func idempotencyKey(r *http.Request, body []byte) (string, error) {
+
+	if key := r.Header.Get(types.KEY_HEADER); key != "" {
+		return key, nil
+	}
+
+	if r.URL.Query().Get("dedup") == "id" {
+		var msg types.Message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return "", errors.New("dedup=id needs a JSON message with an Id - " + err.Error())
+		}
+		return "id:" + strconv.Itoa(msg.Id), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A key's remembered, with its message's sequence number, until it's been in the window too long.
+func TestDedupExpiry(t *testing.T) {
+
+	d := newDedupWindow(time.Minute, DEDUP_MAX)
+	d.add("a", 1)
+	d.add("", 2)
+	d.add("b", 3)
+
+	if seq, ok := d.check("a"); !ok || seq != 1 {
+		t.Errorf("a is %d, %t", seq, ok)
+	}
+	if _, ok := d.check(""); ok {
+		t.Errorf("An empty key was remembered")
+	}
+
+	d.expire(time.Now().Add(30 * time.Second))
+	if _, ok := d.check("b"); !ok {
+		t.Errorf("b expired early")
+	}
+	d.expire(time.Now().Add(2 * time.Minute))
+	if _, ok := d.check("a"); ok {
+		t.Errorf("a didn't expire")
+	}
+	if len(d.keys) != 0 || d.order.Len() != 0 {
+		t.Errorf("%d keys left", len(d.keys))
+	}
+}
+
+// The window only holds so many keys, the oldest being forgotten first, and a key can be forgotten early.
+func TestDedupMaxKeys(t *testing.T) {
+
+	d := newDedupWindow(time.Hour, 3)
+	for i := 1; i <= 5; i++ {
+		d.add(fmt.Sprint("k", i), uint64(i))
+	}
+	for i := 1; i <= 5; i++ {
+		if _, ok := d.check(fmt.Sprint("k", i)); ok != (i > 2) {
+			t.Errorf("k%d remembered: %t", i, ok)
+		}
+	}
+
+	d.forget("k4")
+	d.forget("k1")
+	if _, ok := d.check("k4"); ok || len(d.keys) != 2 || d.order.Len() != 2 {
+		t.Errorf("k4 wasn't forgotten, keys are %v", d.keys)
+	}
+
+	off := newDedupWindow(time.Hour, 0)
+	off.add("k", 1)
+	if _, ok := off.check("k"); ok {
+		t.Errorf("A window of 0 remembered a key")
+	}
+}
+
+// The key comes from the header, or the message's Id with dedup=id.
+func TestIdempotencyKey(t *testing.T) {
+
+	r := httptest.NewRequest("POST", IN_PATTERN+"?topic=Orders&dedup=id", strings.NewReader(""))
+	r.Header.Set(types.KEY_HEADER, "abc")
+	if key, err := idempotencyKey(r, []byte(`{"Id":7}`)); key != "abc" || err != nil {
+		t.Errorf("With a header got %q, %v", key, err)
+	}
+
+	r.Header = http.Header{}
+	if key, err := idempotencyKey(r, []byte(`{"Id":7}`)); key != "id:7" || err != nil {
+		t.Errorf("With dedup=id got %q, %v", key, err)
+	}
+	if _, err := idempotencyKey(r, []byte(`not json`)); err == nil {
+		t.Errorf("dedup=id took a body that isn't JSON")
+	}
+
+	r = httptest.NewRequest("POST", IN_PATTERN+"?topic=Orders", strings.NewReader(""))
+	if key, err := idempotencyKey(r, []byte(`{"Id":7}`)); key != "" || err != nil {
+		t.Errorf("Without either got %q, %v", key, err)
+	}
+}
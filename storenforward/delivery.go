@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gsamples/storenforward/codec"
+	"gsamples/types"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Delivery to subscribers. Each subscriber has its own queue - a buffered channel - and its own forward() goroutine which
+reads from the queue and POSTs to the subscriber's reply URL. Publishing only ever puts messages on the queues, so a
+slow subscriber can't hold up a publisher or the other subscribers.
+
+The queue size and what to do when the queue is full can be set at subscribe time with the queue and overflow
+parameters. The overflow policies are:
+
+	drop-oldest - throw away the oldest message in the queue to make room (the default)
+	drop-newest - throw away the message being published
+	disconnect  - remove the subscriber; it'll have to subscribe again
+	block       - make the publisher wait for room, for up to blockfor milliseconds, then drop the message
+
+Messages are put on a topic's queues by its forwardPending(), after they've been stored and the store unlocked, so a
+block subscriber holds up the topic's other subscribers, and the publishers waiting for them, but never the store
+itself. A publisher waits for MAX_BLOCK milliseconds at most, however many subscribers block it.
+
+A subscriber can ask for its messages in batches at subscribe time, with the batch (max messages per POST) and linger
+(max milliseconds to wait for a batch to fill) parameters. A batch is sent as a JSON array of the messages' envelopes,
+in order, with the BATCH_TYPE content type and a BATCH_HEADER saying how many there are. Without the batch parameter
+the subscriber gets one message per POST, with the body exactly as it was published and the rest of the envelope in
+the headers.
+
+A subscriber can also say which content type it wants with the accept parameter, or an Accept header, on subscribe.
+If that's not the type a message was published in, then the message is transcoded before it's sent. Compressed
+messages are decompressed, or recompressed, to suit the subscriber - see compression.go.
+
+All deliveries share one http.Client so that connections to a subscriber are kept alive and reused.
+*/
+
+const (
+	BATCH_HEADER     = "X-Batch-Size" // How many messages there are in a POST, and the batch size agreed at subscribe time
+	LINGER_HEADER    = "X-Linger"     // The linger, in milliseconds, agreed at subscribe time
+	BATCH_TYPE       = "application/vnd.storenforward.batch+json"
+	MAX_DELIVERY     = 500  // The largest batch we'll send to a subscriber
+	DEFAULT_LINGER   = 50   // Milliseconds to wait for a batch to fill, if the subscriber doesn't say
+	MAX_LINGER       = 5000 // The longest a subscriber can ask us to hold on to a message
+	DELIVERY_TIMEOUT = 30 * time.Second
+	QUEUE_HEADER     = "X-Queue-Size" // The queue size agreed at subscribe time
+	OVERFLOW_HEADER  = "X-Overflow"   // The overflow policy agreed at subscribe time
+	ACCEPT_HEADER    = "X-Accept"     // The content type agreed at subscribe time, if the subscriber asked for one
+	DEFAULT_QUEUE    = 1000           // Messages queued per subscriber, if it doesn't say
+	MAX_QUEUE        = 100000         // The most messages we'll queue for one subscriber
+	DEFAULT_BLOCK    = 1000           // Milliseconds a publisher waits for room in a queue, if the subscriber doesn't say
+	MAX_BLOCK        = 10000          // The longest we'll ever let a publisher wait
+
+	OVERFLOW_DROP_OLDEST = "drop-oldest"
+	OVERFLOW_DROP_NEWEST = "drop-newest"
+	OVERFLOW_DISCONNECT  = "disconnect"
+	OVERFLOW_BLOCK       = "block"
+)
+
+// The one client used for all deliveries. The transport is tuned to keep plenty of idle connections per subscriber,
+// as we're usually sending lots of small requests to a handful of hosts.
+var deliveryClient = &http.Client{
+	Timeout: DELIVERY_TIMEOUT,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// Work out the batch size and linger for a new subscriber from its subscribe parameters, keeping them within our limits.
+func negotiateBatch(params url.Values) (int, time.Duration, error) {
+
+	batchSize := 1
+	if b := params.Get("batch"); b != "" {
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("batch must be a positive number, got %q", b)
+		}
+		batchSize = n
+	}
+	if batchSize > MAX_DELIVERY {
+		batchSize = MAX_DELIVERY
+	}
+
+	linger := DEFAULT_LINGER
+	if l := params.Get("linger"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("linger must be a number of milliseconds, got %q", l)
+		}
+		linger = n
+	}
+	if linger > MAX_LINGER {
+		linger = MAX_LINGER
+	}
+
+	return batchSize, time.Duration(linger) * time.Millisecond, nil
+}
+
+// Work out the queue size and overflow policy for a new subscriber from its subscribe parameters.
+func negotiateQueue(params url.Values) (int, string, time.Duration, error) {
+
+	queueSize := DEFAULT_QUEUE
+	if q := params.Get("queue"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 {
+			return 0, "", 0, fmt.Errorf("queue must be a positive number, got %q", q)
+		}
+		queueSize = n
+	}
+	if queueSize > MAX_QUEUE {
+		queueSize = MAX_QUEUE
+	}
+
+	overflow := params.Get("overflow")
+	switch overflow {
+	case "":
+		overflow = OVERFLOW_DROP_OLDEST
+	case OVERFLOW_DROP_OLDEST, OVERFLOW_DROP_NEWEST, OVERFLOW_DISCONNECT, OVERFLOW_BLOCK:
+	default:
+		return 0, "", 0, fmt.Errorf("unknown overflow policy %q", overflow)
+	}
+
+	blockFor := DEFAULT_BLOCK
+	if b := params.Get("blockfor"); b != "" {
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 0 {
+			return 0, "", 0, fmt.Errorf("blockfor must be a number of milliseconds, got %q", b)
+		}
+		blockFor = n
+	}
+	if blockFor > MAX_BLOCK {
+		blockFor = MAX_BLOCK
+	}
+
+	return queueSize, overflow, time.Duration(blockFor) * time.Millisecond, nil
+}
+
+// Put a message on the subscriber's queue, following its overflow policy if the queue is full. Returns false if the
+// subscriber should be disconnected. Messages that were sent when the subscriber was given the existing data, and
+// expired messages, are ignored.
+//
+// This is only called by the topic's forwardPending, so there's never more than one goroutine adding to a queue, and
+// never with the topic's ring locked, so waiting here for OVERFLOW_BLOCK doesn't hold up the store.
+func (s *subscriber) enqueue(env *types.Envelope) bool {
+
+	if env.Sequence <= s.replayed || env.Expired(time.Now()) {
+		return true
+	}
+
+	span, env := s.startEnqueue(env)
+	defer span.Finish()
+
+	rm := replyMsg{
+		replyTo: &s.reply,
+		env:     env,
+	}
+
+	select {
+	case s.ch <- rm:
+		return true
+	case <-s.done:
+		return true // Already gone, nothing to do
+	default:
+	}
+
+	// The queue is full
+	switch s.overflow {
+	case OVERFLOW_DROP_NEWEST:
+		span.SetAttribute("dropped", "true")
+		s.drop(rm)
+
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			select {
+			case s.ch <- rm:
+				return true
+			default:
+			}
+			select {
+			case old := <-s.ch:
+				s.drop(old)
+			default:
+			}
+		}
+
+	case OVERFLOW_DISCONNECT:
+		span.SetAttribute("disconnected", "true")
+		fmt.Printf("Subscriber %s can't keep up with topic %s - disconnecting\n", s.id, s.topic)
+		return false
+
+	case OVERFLOW_BLOCK:
+		timer := time.NewTimer(s.blockFor)
+		defer timer.Stop()
+		select {
+		case s.ch <- rm:
+		case <-s.done:
+		case <-timer.C:
+			span.SetAttribute("dropped", "true")
+			s.drop(rm)
+		}
+	}
+	return true
+}
+
+func (s *subscriber) drop(rm replyMsg) {
+	n := atomic.AddUint64(&s.dropped, 1)
+	fmt.Printf("Subscriber %s queue full, dropped message %d from topic %s (%d dropped so far)\n", s.id, rm.env.Sequence, s.topic, n)
+}
+
+// Stop the subscriber's forward() goroutine.
+func (s *subscriber) close() {
+	s.closer.Do(func() {
+		close(s.done)
+	})
+}
+
+// Read the messages from the channel and send on via HTTP, batching them up if the subscriber asked for it.
+// This carries on until the subscriber is removed.
+func (s *subscriber) forward() {
+
+	fmt.Println("listening for messages...")
+	for {
+
+		var msg replyMsg
+		select {
+		case msg = <-s.ch:
+		case <-s.done:
+			return
+		}
+		if msg.env.Expired(time.Now()) {
+			fmt.Printf("Message %d expired before it could be sent to %s\n", msg.env.Sequence, s.id)
+			continue
+		}
+
+		batch := []*types.Envelope{msg.env}
+		if s.batchSize > 1 {
+			batch = s.fillBatch(batch)
+		}
+		s.post(batch)
+	}
+}
+
+// Keep taking messages until the batch is full or it's been lingering long enough.
+func (s *subscriber) fillBatch(batch []*types.Envelope) []*types.Envelope {
+
+	timer := time.NewTimer(s.linger)
+	defer timer.Stop()
+
+	for len(batch) < s.batchSize {
+		select {
+		case msg := <-s.ch:
+			if !msg.env.Expired(time.Now()) {
+				batch = append(batch, msg.env)
+			}
+		case <-timer.C:
+			return batch
+		case <-s.done:
+			return batch
+		}
+	}
+	return batch
+}
+
+// Send one POST to the subscriber. Subscribers that didn't ask for batches get the message body as it was published,
+// with its metadata in the headers. A batch is a JSON array of the envelopes.
+func (s *subscriber) post(batch []*types.Envelope) {
+
+	for i, env := range batch {
+		batch[i] = s.convert(env)
+	}
+	spans := s.startDeliver(batch)
+
+	if s.batchSize == 1 {
+		h := http.Header{}
+		batch[0].WriteHeaders(h)
+		finishDeliver(spans, s.send(batch[0].Body, h))
+		return
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		fmt.Printf("Cannot marshal batch: %+v\n", err)
+		finishDeliver(spans, err)
+		return
+	}
+
+	h := http.Header{}
+	h.Set("Content-Type", BATCH_TYPE)
+	h.Set(BATCH_HEADER, strconv.Itoa(len(batch)))
+	finishDeliver(spans, s.send(body, h))
+}
+
+// Put a message in the format and encoding the subscriber asked for, if it isn't already. The stored envelope is left
+// alone. If it can't be converted, then it's sent decompressed in its own format, failing that as it is, and it's up
+// to the subscriber.
+func (s *subscriber) convert(env *types.Envelope) *types.Envelope {
+
+	transcode := s.accept != "" && !codec.Same(env.ContentType, s.accept)
+	if !transcode && (codec.IsIdentity(env.Encoding) || strings.EqualFold(env.Encoding, s.encoding)) {
+		return env
+	}
+
+	body, err := plainBody(env)
+	if err != nil {
+		fmt.Printf("Cannot decompress message %d from %s: %+v\n", env.Sequence, env.Encoding, err)
+		return env
+	}
+	converted := *env
+	converted.Body = body
+	converted.Encoding = ""
+
+	if transcode {
+		body, err := codec.Transcode(converted.Body, env.ContentType, s.accept)
+		if err != nil {
+			fmt.Printf("Cannot convert message %d from %s to %s: %+v\n", env.Sequence, env.ContentType, s.accept, err)
+		} else {
+			converted.Body = body
+			converted.ContentType = s.accept
+		}
+	}
+
+	// Only messages that were compressed get compressed again; the rest weren't worth it
+	if s.encoding != "" && !codec.IsIdentity(env.Encoding) {
+		if body, err := codec.Compress(converted.Body, s.encoding); err == nil {
+			converted.Body = body
+			converted.Encoding = s.encoding
+		}
+	}
+	return &converted
+}
+
+// POST to the subscriber, returning why it failed if it did, including if the subscriber didn't answer 2xx.
+func (s *subscriber) send(body []byte, h http.Header) error {
+
+	// This uses a Request as it gives you more control than a http.Post()
+	req, err := http.NewRequest("POST", s.reply.String(), bytes.NewBuffer(body))
+	if err != nil {
+		fmt.Printf("Error creating request for subscriber: %+v\n", err)
+		return err
+	}
+	req.Header = h
+
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		fmt.Printf("Error in Posting to subscriber: %+v\n", err)
+		return err
+	}
+
+	// Reading it all lets the connection be reused. Only a failure is worth showing.
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		fmt.Printf("Subscriber %s answered %s: %s\n", s.id, resp.Status, respBody)
+		return fmt.Errorf("subscriber answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gsamples/types"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A subscriber's endpoint, which keeps what it's sent.
+type testReceiver struct {
+	mut     sync.Mutex
+	posts   []http.Header       // The headers of each POST
+	envs    [][]*types.Envelope // and the messages in it
+	release chan struct{}       // If set, each POST waits until it's closed before answering
+	srv     *httptest.Server
+}
+
+func newTestReceiver(t *testing.T) *testReceiver {
+	rec := &testReceiver{}
+	rec.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envs []*types.Envelope
+		if r.Header.Get("Content-Type") == BATCH_TYPE {
+			json.NewDecoder(r.Body).Decode(&envs)
+		} else {
+			body := make([]byte, r.ContentLength)
+			r.Body.Read(body)
+			envs = append(envs, types.ReadEnvelope(r.Header, body))
+		}
+		rec.mut.Lock()
+		rec.posts = append(rec.posts, r.Header)
+		rec.envs = append(rec.envs, envs)
+		rec.mut.Unlock()
+		if rec.release != nil {
+			<-rec.release
+		}
+	}))
+	t.Cleanup(rec.srv.Close)
+	return rec
+}
+
+// The sequence numbers received, in the order they came.
+func (rec *testReceiver) seqs() []uint64 {
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	var seqs []uint64
+	for _, envs := range rec.envs {
+		for _, env := range envs {
+			seqs = append(seqs, env.Sequence)
+		}
+	}
+	return seqs
+}
+
+// Subscribe the receiver to a topic, with whatever else is in params, and return the headers saying what was agreed.
+func subscribeReceiver(t *testing.T, n *testNode, rec *testReceiver, topic string, params url.Values) http.Header {
+	params.Set("id", fmt.Sprint(time.Now().UnixNano()))
+	params.Set("topic", topic)
+	params.Set("replyto", rec.srv.URL)
+	resp, err := http.Get(n.url + SUB_PATTERN + "?" + params.Encode())
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Subscribe failed: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	return resp.Header
+}
+
+// Messages are sent in batches of no more than the subscriber asked for, in order, and the batch size it asks for is
+// kept within our limits.
+func TestDeliveryBatches(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	rec := newTestReceiver(t)
+	h := subscribeReceiver(t, n, rec, "Orders", url.Values{"batch": {"3"}, "linger": {"200"}})
+	if h.Get(BATCH_HEADER) != "3" || h.Get(LINGER_HEADER) != "200" {
+		t.Errorf("Agreed %v", h)
+	}
+
+	var envs []*types.Envelope
+	for i := 1; i <= 7; i++ {
+		envs = append(envs, &types.Envelope{ContentType: types.DEFAULT_TYPE, Body: []byte(fmt.Sprintf(`{"Id":%d}`, i))})
+	}
+	n.b.addAllToStore(envs, "Orders")
+
+	eventually(t, "all the messages", func() bool { return len(rec.seqs()) == 7 })
+	for i, seq := range rec.seqs() {
+		if seq != uint64(i+1) {
+			t.Fatalf("Got %v", rec.seqs())
+		}
+	}
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	for i, post := range rec.posts {
+		if post.Get("Content-Type") != BATCH_TYPE || len(rec.envs[i]) > 3 || post.Get(BATCH_HEADER) != fmt.Sprint(len(rec.envs[i])) {
+			t.Errorf("POST %d has %d messages, with %v", i, len(rec.envs[i]), post)
+		}
+	}
+	if len(rec.posts) > 3 {
+		t.Errorf("%d POSTs for 7 messages in batches of 3", len(rec.posts))
+	}
+
+	if size, linger, _ := negotiateBatch(url.Values{"batch": {"100000"}, "linger": {"100000"}}); size != MAX_DELIVERY || linger != MAX_LINGER*time.Millisecond {
+		t.Errorf("Asking for too much got %d, %s", size, linger)
+	}
+	if _, _, err := negotiateBatch(url.Values{"batch": {"0"}}); err == nil {
+		t.Errorf("A batch of 0 was agreed")
+	}
+}
+
+// Without a batch, each message is sent on its own, as it was published, with its envelope in the headers.
+func TestDeliverySingle(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	rec := newTestReceiver(t)
+	subscribeReceiver(t, n, rec, "Orders", url.Values{})
+
+	n.b.addToStore(&types.Envelope{Topic: "Orders", ContentType: "text/plain", CorrelationId: "c1", Body: []byte("hello")})
+	eventually(t, "the message", func() bool { return len(rec.seqs()) == 1 })
+
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	env := rec.envs[0][0]
+	if env.Sequence != 1 || env.Topic != "Orders" || env.ContentType != "text/plain" || env.CorrelationId != "c1" || string(env.Body) != "hello" {
+		t.Errorf("Got %+v", env)
+	}
+}
+
+// Publish a message with the given id straight to the store.
+func publishId(n *testNode, topic string, id int) {
+	n.b.addToStore(&types.Envelope{Topic: topic, ContentType: types.DEFAULT_TYPE, Body: []byte(fmt.Sprintf(`{"Id":%d}`, id))})
+}
+
+// The only subscriber to a topic.
+func onlySubscriber(n *testNode, topic string) *subscriber {
+	n.b.subMut.RLock()
+	defer n.b.subMut.RUnlock()
+	for _, s := range n.b.submap[topic] {
+		return s
+	}
+	return nil
+}
+
+// Fill up a subscriber with a queue of 1 that's stuck on its first message: the first is being sent, the second is
+// queued, and the rest overflow.
+func overflow(t *testing.T, overflow string) (*testNode, *testReceiver) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	rec := newTestReceiver(t)
+	rec.release = make(chan struct{})
+	t.Cleanup(func() {
+		select {
+		case <-rec.release:
+		default:
+			close(rec.release)
+		}
+	})
+	h := subscribeReceiver(t, n, rec, "Orders", url.Values{"queue": {"1"}, "overflow": {overflow}, "blockfor": {"300"}})
+	if h.Get(QUEUE_HEADER) != "1" || h.Get(OVERFLOW_HEADER) != overflow {
+		t.Fatalf("Agreed %v", h)
+	}
+
+	publishId(n, "Orders", 1)
+	eventually(t, "the first message", func() bool { return len(rec.seqs()) == 1 })
+	for i := 2; i <= 4; i++ {
+		publishId(n, "Orders", i)
+	}
+	return n, rec
+}
+
+// What's dropped, or whether the subscriber is, depends on the overflow policy it asked for.
+func TestOverflow(t *testing.T) {
+
+	for _, c := range []struct {
+		overflow string
+		want     string
+		dropped  uint64
+	}{
+		{OVERFLOW_DROP_NEWEST, "[1 2]", 2},
+		{OVERFLOW_DROP_OLDEST, "[1 4]", 2},
+		{OVERFLOW_BLOCK, "[1 2]", 2},
+	} {
+		n, rec := overflow(t, c.overflow)
+		s := onlySubscriber(n, "Orders")
+		close(rec.release)
+		eventually(t, c.overflow+" delivering", func() bool { return len(rec.seqs()) == 2 })
+		time.Sleep(100 * time.Millisecond)
+		if got := fmt.Sprint(rec.seqs()); got != c.want || atomic.LoadUint64(&s.dropped) != c.dropped {
+			t.Errorf("With %s got %s and dropped %d, not %s and %d", c.overflow, got, atomic.LoadUint64(&s.dropped), c.want, c.dropped)
+		}
+	}
+
+	n, _ := overflow(t, OVERFLOW_DISCONNECT)
+	eventually(t, "the subscriber to be disconnected", func() bool { return onlySubscriber(n, "Orders") == nil })
+}
+
+// A subscriber that's asked for OVERFLOW_BLOCK holds up the topic's publishers, for a while, but not its store.
+func TestOverflowBlock(t *testing.T) {
+
+	n, rec := overflow(t, OVERFLOW_BLOCK)
+	s := onlySubscriber(n, "Orders")
+
+	published := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		publishId(n, "Orders", 5)
+		published <- time.Since(start)
+	}()
+
+	// While the publisher's waiting, its message is in the store, which isn't held up
+	time.Sleep(50 * time.Millisecond)
+	rb := n.b.getRingBuf("Orders")
+	locked := make(chan uint64)
+	go func() {
+		rb.mut.Lock()
+		locked <- rb.seq
+		rb.mut.Unlock()
+	}()
+	select {
+	case seq := <-locked:
+		if seq != 5 {
+			t.Errorf("Stored up to %d", seq)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("The store is locked while a publisher waits for a subscriber")
+	}
+
+	close(rec.release)
+	select {
+	case took := <-published:
+		if took > MAX_BLOCK*time.Millisecond {
+			t.Errorf("The publisher waited %s", took)
+		}
+	case <-time.After(MAX_BLOCK * time.Millisecond):
+		t.Fatalf("The publisher is still waiting")
+	}
+	eventually(t, "the rest", func() bool { return len(rec.seqs()) == 3 })
+	if got := fmt.Sprint(rec.seqs()); got != "[1 2 5]" || atomic.LoadUint64(&s.dropped) != 2 {
+		t.Errorf("Got %s and dropped %d", got, atomic.LoadUint64(&s.dropped))
+	}
+}
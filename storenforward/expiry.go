@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/types"
+	"net/http"
+	"time"
+)
+
+/*
+Message expiry. A publisher can give a message a time to live with the ttl parameter or the TTL_HEADER, either as a
+Go duration or in milliseconds. The time to live starts when the message is stored, which for a delayed message is
+when it's due. Once it's expired a message is never forwarded: it's not sent to new subscribers from the store, it's
+skipped if it's still waiting in a subscriber's queue, and the sweeper clears it out of the ring.
+*/
+
+const (
+	TTL_HEADER     = "X-TTL"
+	SWEEP_INTERVAL = 10 * time.Second // How often the sweeper looks for expired messages
+)
+
+// Work out when a message published at the given time expires. The zero time means never.
+func messageExpiry(r *http.Request, from time.Time) (time.Time, error) {
+
+	ttl := r.URL.Query().Get("ttl")
+	if ttl == "" {
+		ttl = r.Header.Get(TTL_HEADER)
+	}
+	return expiryFrom(ttl, from)
+}
+
+// Turn a time to live into an expiry time.
+func expiryFrom(ttl string, from time.Time) (time.Time, error) {
+
+	if ttl == "" {
+		return time.Time{}, nil
+	}
+
+	d, err := parseDuration(ttl)
+	if err != nil || d <= 0 {
+		return time.Time{}, fmt.Errorf("ttl must be a positive duration or milliseconds, got %q", ttl)
+	}
+	return from.Add(d), nil
+}
+
+// Clear expired messages out of the store every so often, until the broker's stopped.
+func (b *broker) sweep() {
+
+	ticker := time.NewTicker(SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+		if n := b.sweepExpired(time.Now()); n > 0 {
+			fmt.Printf("Swept %d expired messages\n", n)
+		}
+		if n := b.txns.expire(time.Now()); n > 0 {
+			fmt.Printf("Aborted %d transactions that were open too long\n", n)
+		}
+	}
+}
+
+// Empty the ring slots holding expired messages, returning how many there were.
+func (b *broker) sweepExpired(now time.Time) int {
+
+	count := 0
+	for _, rb := range b.ringBufs() {
+		rb.mut.Lock()
+		p := rb.buf
+		for i := 0; i < BUFF_SIZE; i++ {
+			if env, ok := p.Value.(*types.Envelope); ok && env.Expired(now) {
+				p.Value = nil
+				count++
+			}
+			p = p.Next()
+		}
+		rb.mut.Unlock()
+	}
+	return count
+}
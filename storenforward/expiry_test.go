@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/types"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The time to live comes from the ttl parameter, or else the header, and starts when the message is stored.
+func TestMessageExpiry(t *testing.T) {
+
+	from := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := httptest.NewRequest("POST", IN_PATTERN+"?topic=Orders&ttl=1m", nil)
+	r.Header.Set(TTL_HEADER, "5000")
+	if at, err := messageExpiry(r, from); err != nil || !at.Equal(from.Add(time.Minute)) {
+		t.Errorf("With both got %s, %v", at, err)
+	}
+	r = httptest.NewRequest("POST", IN_PATTERN+"?topic=Orders", nil)
+	r.Header.Set(TTL_HEADER, "5000")
+	if at, err := messageExpiry(r, from); err != nil || !at.Equal(from.Add(5*time.Second)) {
+		t.Errorf("With the header got %s, %v", at, err)
+	}
+
+	if at, err := expiryFrom("", from); err != nil || !at.IsZero() {
+		t.Errorf("Without a ttl got %s, %v", at, err)
+	}
+	for _, ttl := range []string{"0", "-1s", "forever"} {
+		if _, err := expiryFrom(ttl, from); err == nil {
+			t.Errorf("A ttl of %q was taken", ttl)
+		}
+	}
+}
+
+// Sweeping clears every expired message out of a ring that's wrapped round, leaving the rest where they were, and
+// expired messages aren't sent to a new subscriber.
+func TestSweepExpired(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+
+	// Every third message expires at the sweep, the others later or never
+	now := time.Now()
+	count := BUFF_SIZE + BUFF_SIZE/2
+	for i := 1; i <= count; i++ {
+		env := &types.Envelope{Topic: "Orders", ContentType: types.DEFAULT_TYPE, Body: []byte(fmt.Sprintf(`{"Id":%d}`, i))}
+		switch i % 3 {
+		case 0:
+			env.Expires = now
+		case 1:
+			env.Expires = now.Add(time.Hour)
+		}
+		n.b.addToStore(env)
+	}
+
+	rb := n.b.getRingBuf("Orders")
+	var want []uint64
+	expired := 0
+	for seq := rb.oldest(); seq <= uint64(count); seq++ {
+		if seq%3 == 0 {
+			expired++
+		} else {
+			want = append(want, seq)
+		}
+	}
+
+	if swept := n.b.sweepExpired(now); swept != expired {
+		t.Errorf("Swept %d, not %d", swept, expired)
+	}
+	if swept := n.b.sweepExpired(now); swept != 0 {
+		t.Errorf("Swept %d again", swept)
+	}
+	rb.mut.Lock()
+	for seq := rb.oldest(); seq <= rb.seq; seq++ {
+		env := rb.entry(seq)
+		if (env == nil) != (seq%3 == 0) || (env != nil && env.Sequence != seq) {
+			t.Errorf("Message %d is %+v after sweeping", seq, env)
+		}
+	}
+	rb.mut.Unlock()
+
+	// A new subscriber gets the rest, but not a message that's expired without being swept yet
+	n.b.addToStore(&types.Envelope{Topic: "Orders", ContentType: types.DEFAULT_TYPE, Body: []byte(`{"Id":0}`), Expires: time.Now().Add(50 * time.Millisecond)})
+	time.Sleep(100 * time.Millisecond)
+	rec := newTestReceiver(t)
+	subscribeReceiver(t, n, rec, "Orders", url.Values{"batch": {"100"}})
+	eventually(t, "what's in the store", func() bool { return len(rec.seqs()) == len(want) })
+	if got := fmt.Sprint(rec.seqs()); got != fmt.Sprint(want) {
+		t.Errorf("Subscriber got %s, not %v", got, want)
+	}
+}
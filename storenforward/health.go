@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Health checks, for an orchestrator or a load balancer to probe.
+
+	GET HEALTH_PATTERN - liveness: 200 unless the storenforward is stuck and wants restarting
+	GET READY_PATTERN  - readiness: 200 when it can take messages, 503 when it should be sent nothing for now
+
+Both answer with a healthReport in JSON, whatever the status, saying what was checked:
+
+	storage - every topic's store can be locked within HEALTH_TIMEOUT. A store that can't has something wedged
+	          holding its lock, and publishing to it would hang, which a restart is the only cure for. The lock is
+	          only held while storing: a publisher waiting on an OVERFLOW_BLOCK subscriber waits outside it, so a
+	          slow subscriber shows up under load, not here.
+	load    - the goroutines, against -max-goroutines, and how full the subscribers' queues are. A queue that's
+	          QUEUE_SATURATED full is reported, but only makes us unready if it's an OVERFLOW_BLOCK one, as that's
+	          the only kind that holds up the publishers.
+	cluster - when clustering's on, which of the other nodes answer their HEALTH_PATTERN. We're only ready when
+	          most of the nodes, us included, do, as without them nothing can be committed. The topics we lead, and
+	          those without a leader, are reported too.
+
+Liveness only depends on storage, as restarting won't help with the rest. Readiness depends on all of them, and is
+off from the moment the storenforward starts to drain: on SIGTERM, or SIGINT, it stays up for -drain, still taking
+messages, so that whatever's routing to it notices it's not ready and stops, then shuts down.
+*/
+
+const (
+	HEALTH_PATTERN  = "/healthz"
+	READY_PATTERN   = "/readyz"
+	HEALTH_TIMEOUT  = time.Second           // How long to wait for a store's lock, or for another node to answer
+	HEALTH_POLL     = 10 * time.Millisecond // How often to try a store's lock again while waiting for it
+	MAX_GOROUTINES  = 10000                 // The goroutines above which we're too busy to be ready, by default
+	QUEUE_SATURATED = 0.9                   // The fraction of a subscriber's queue that's full enough to report
+	DRAIN_TIME      = 5 * time.Second
+	HEALTH_OK       = "ok"
+	HEALTH_FAILING  = "failing"
+)
+
+type healthReport struct {
+	Status   string // HEALTH_OK or HEALTH_FAILING, as the status code says
+	Draining bool   // Shutting down, so not ready whatever else says
+	Storage  storageHealth
+	Load     *loadHealth    `json:",omitempty"` // Only for readiness
+	Cluster  *clusterHealth `json:",omitempty"` // Only for readiness, in a cluster
+}
+
+type storageHealth struct {
+	Ok      bool
+	Topics  int      // How many topics there are stores for
+	Stored  uint64   // The messages held in them, at most BUFF_SIZE a topic
+	Pending int      // Messages scheduled for later, and not stored yet
+	Stuck   []string `json:",omitempty"` // The topics whose stores couldn't be locked in time
+	Error   string   `json:",omitempty"`
+
+	leaders map[string]string // Each topic's leader, as we know it, in a cluster
+}
+
+type loadHealth struct {
+	Ok            bool
+	Goroutines    int
+	MaxGoroutines int
+	Subscribers   int
+	Queued        int      // Messages waiting to be sent to the subscribers, all told
+	Saturated     []string `json:",omitempty"` // The subscribers whose queues are QUEUE_SATURATED full, as topic/id
+	Blocking      []string `json:",omitempty"` // Those of them that hold up the publishers
+}
+
+type clusterHealth struct {
+	Ok        bool
+	Self      string
+	Nodes     map[string]string // Each node's URL, and HEALTH_OK or why it didn't answer
+	Reachable int               // The nodes that answered, us included
+	Majority  int               // How many need to
+	Leading   []string          `json:",omitempty"` // The topics we're the leader of
+	NoLeader  []string          `json:",omitempty"` // The topics we don't know a leader for
+}
+
+// Liveness.
+func (b *broker) processHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Unsupported request method", 404)
+		return
+	}
+	report := &healthReport{Draining: b.isDraining(), Storage: b.checkStorage()}
+	writeHealth(w, report, report.Storage.Ok)
+}
+
+// Readiness.
+func (b *broker) processReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Unsupported request method", 404)
+		return
+	}
+
+	report := &healthReport{Draining: b.isDraining(), Storage: b.checkStorage(), Load: b.checkLoad()}
+	ready := !report.Draining && report.Storage.Ok && report.Load.Ok
+	if b.cluster != nil {
+		report.Cluster = b.cluster.checkMembership(report.Storage.leaders)
+		ready = ready && report.Cluster.Ok
+	}
+	writeHealth(w, report, ready)
+}
+
+func writeHealth(w http.ResponseWriter, report *healthReport, ok bool) {
+	status := http.StatusOK
+	report.Status = HEALTH_OK
+	if !ok {
+		status = UNAVAILABLE
+		report.Status = HEALTH_FAILING
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Start draining: from now on we're not ready.
+func (b *broker) drain() {
+	atomic.StoreInt32(&b.draining, 1)
+}
+
+func (b *broker) isDraining() bool {
+	return atomic.LoadInt32(&b.draining) != 0
+}
+
+// Make sure every topic's store can be locked, and count what's in them. The stores are tried in turn, again every
+// HEALTH_POLL until HEALTH_TIMEOUT is up, without waiting on any of their locks, so the check takes HEALTH_TIMEOUT at
+// most and leaves nothing behind.
+func (b *broker) checkStorage() storageHealth {
+
+	h := storageHealth{Ok: true, Pending: b.delayed.len(), leaders: make(map[string]string)}
+	select {
+	case <-b.done:
+		h.Ok = false
+		h.Error = "stopped"
+		return h
+	default:
+	}
+
+	rbs := b.ringBufs()
+	h.Topics = len(rbs)
+	deadline := time.Now().Add(HEALTH_TIMEOUT)
+	for {
+		for topic, rb := range rbs {
+			if !rb.mut.TryLock() {
+				continue
+			}
+			if rb.seq > 0 {
+				h.Stored += rb.seq - rb.oldest() + 1
+			}
+			if rb.raft != nil {
+				h.leaders[topic] = rb.raft.leader
+			} else {
+				h.leaders[topic] = ""
+			}
+			rb.mut.Unlock()
+			delete(rbs, topic)
+		}
+		if len(rbs) == 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(HEALTH_POLL)
+	}
+
+	for topic := range rbs {
+		h.Stuck = append(h.Stuck, topic)
+	}
+	if len(h.Stuck) > 0 {
+		sort.Strings(h.Stuck)
+		h.Ok = false
+		h.Error = fmt.Sprintf("%d topics' stores couldn't be locked within %s", len(h.Stuck), HEALTH_TIMEOUT)
+		fmt.Printf("Storage unhealthy: %s: %v\n", h.Error, h.Stuck)
+	}
+	return h
+}
+
+// See how busy we are: the goroutines, and how full the subscribers' queues are.
+func (b *broker) checkLoad() *loadHealth {
+
+	h := &loadHealth{Goroutines: runtime.NumGoroutine(), MaxGoroutines: b.maxGoroutines}
+
+	b.subMut.RLock()
+	for _, subs := range b.submap {
+		for _, s := range subs {
+			h.Subscribers++
+			queued := len(s.ch)
+			h.Queued += queued
+			if float64(queued) >= QUEUE_SATURATED*float64(cap(s.ch)) {
+				name := s.topic + "/" + s.id
+				h.Saturated = append(h.Saturated, name)
+				if s.overflow == OVERFLOW_BLOCK {
+					h.Blocking = append(h.Blocking, name)
+				}
+			}
+		}
+	}
+	b.subMut.RUnlock()
+
+	sort.Strings(h.Saturated)
+	sort.Strings(h.Blocking)
+	h.Ok = (b.maxGoroutines <= 0 || h.Goroutines <= b.maxGoroutines) && len(h.Blocking) == 0
+	return h
+}
+
+// Ask the other nodes whether they're alive, and see which topics we lead and which haven't got a leader, from the
+// leaders that checkStorage found. A topic whose store was stuck isn't in either.
+func (c *cluster) checkMembership(leaders map[string]string) *clusterHealth {
+
+	h := &clusterHealth{Self: c.self, Nodes: map[string]string{c.self: HEALTH_OK}, Reachable: 1, Majority: c.majority()}
+
+	var mut sync.Mutex
+	var wg sync.WaitGroup
+	probe := &http.Client{Transport: c.client.Transport, Timeout: HEALTH_TIMEOUT}
+	for _, peer := range c.peers() {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			status := HEALTH_OK
+			resp, err := probe.Get(peer + HEALTH_PATTERN)
+			if err != nil {
+				status = err.Error()
+			} else {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					status = resp.Status
+				}
+			}
+
+			mut.Lock()
+			defer mut.Unlock()
+			h.Nodes[peer] = status
+			if status == HEALTH_OK {
+				h.Reachable++
+			}
+		}(peer)
+	}
+	wg.Wait()
+	h.Ok = h.Reachable >= h.Majority
+
+	for topic, leader := range leaders {
+		if leader == c.self {
+			h.Leading = append(h.Leading, topic)
+		} else if leader == "" {
+			h.NoLeader = append(h.NoLeader, topic)
+		}
+	}
+	sort.Strings(h.Leading)
+	sort.Strings(h.NoLeader)
+	return h
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Probe a health endpoint, and read its report.
+func probe(t *testing.T, url string) (int, *healthReport) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Cannot probe %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	report := &healthReport{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		t.Fatalf("Cannot read report from %s: %v", url, err)
+	}
+	return resp.StatusCode, report
+}
+
+// A storenforward is alive until its storage is stuck, and ready until then, or it's too busy, or it's draining.
+func TestHealth(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	publish(t, n, "Orders", `{"Id":1}`)
+	publish(t, n, "Orders", `{"Id":2}`)
+
+	if status, report := probe(t, n.url+READY_PATTERN); status != http.StatusOK || report.Status != HEALTH_OK || report.Storage.Topics != 1 || report.Storage.Stored != 2 || report.Load == nil || report.Cluster != nil {
+		t.Errorf("Ready got %d %+v", status, report)
+	}
+
+	n.b.maxGoroutines = 1
+	if status, report := probe(t, n.url+READY_PATTERN); status != UNAVAILABLE || report.Load.Ok || !report.Storage.Ok {
+		t.Errorf("Too busy got %d %+v", status, report)
+	}
+	n.b.maxGoroutines = 0
+
+	n.b.drain()
+	if status, report := probe(t, n.url+READY_PATTERN); status != UNAVAILABLE || !report.Draining || report.Status != HEALTH_FAILING {
+		t.Errorf("Draining got %d %+v", status, report)
+	}
+	if status, report := probe(t, n.url+HEALTH_PATTERN); status != http.StatusOK || report.Load != nil {
+		t.Errorf("Alive while draining got %d %+v", status, report)
+	}
+
+	// A store that's wedged
+	rb := n.b.getRingBuf("Orders")
+	rb.mut.Lock()
+	status, report := probe(t, n.url+HEALTH_PATTERN)
+	rb.mut.Unlock()
+	if status != UNAVAILABLE || report.Storage.Ok || len(report.Storage.Stuck) != 1 || report.Storage.Stuck[0] != "Orders" {
+		t.Errorf("Stuck got %d %+v", status, report)
+	}
+}
+
+// A node is ready while most of the cluster is up.
+func TestHealthCluster(t *testing.T) {
+
+	nodes := startCluster(t, 3)
+	publish(t, nodes[0], "Orders", `{"Id":1}`)
+
+	status, report := probe(t, nodes[0].url+READY_PATTERN)
+	if status != http.StatusOK || report.Cluster == nil || report.Cluster.Reachable != 3 || report.Cluster.Majority != 2 || len(report.Cluster.NoLeader) != 0 {
+		t.Fatalf("Ready got %d %+v", status, report.Cluster)
+	}
+	leading := 0
+	for _, n := range nodes {
+		_, report := probe(t, n.url+READY_PATTERN)
+		leading += len(report.Cluster.Leading)
+	}
+	if leading != 1 {
+		t.Errorf("%d nodes lead Orders", leading)
+	}
+
+	nodes[2].kill()
+	if status, report := probe(t, nodes[0].url+READY_PATTERN); status != http.StatusOK || report.Cluster.Reachable != 2 || report.Cluster.Nodes[nodes[2].url] == HEALTH_OK {
+		t.Errorf("With one node down got %d %+v", status, report.Cluster)
+	}
+	nodes[1].kill()
+	if status, report := probe(t, nodes[0].url+READY_PATTERN); status != UNAVAILABLE || report.Cluster.Ok || !report.Storage.Ok {
+		t.Errorf("With most nodes down got %d %+v", status, report.Cluster)
+	}
+	if status, _ := probe(t, nodes[0].url+HEALTH_PATTERN); status != http.StatusOK {
+		t.Errorf("Not alive with most nodes down: %d", status)
+	}
+}
+
+// A publisher held up by an OVERFLOW_BLOCK subscriber makes us unready, but not dead, as it doesn't hold the store.
+func TestHealthBlocked(t *testing.T) {
+
+	n, rec := overflow(t, OVERFLOW_BLOCK)
+	published := make(chan struct{})
+	go func() {
+		publishId(n, "Orders", 5)
+		close(published)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if status, report := probe(t, n.url+HEALTH_PATTERN); status != http.StatusOK || !report.Storage.Ok {
+		t.Errorf("Alive got %d %+v", status, report)
+	}
+	if status, report := probe(t, n.url+READY_PATTERN); status != UNAVAILABLE || report.Load.Ok || len(report.Load.Blocking) != 1 {
+		t.Errorf("Ready got %d %+v", status, report)
+	}
+	close(rec.release)
+	<-published
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gsamples/storenforward/client"
+	"gsamples/types"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+The integration tests run a storenforward, publishers and subscribers in the one process, all talking HTTP on
+ephemeral ports, and check what the subscribers end up with. A subscriber is a client.Consumer served by a test
+server that can be told to misbehave - to answer slowly, or drop the connection - or be crashed and restarted, keeping
+its offsets as a real one would keep them on disk.
+
+What the storenforward promises is:
+
+	- each subscriber gets the messages on a topic in sequence order, and never the same one twice while subscribed
+	- a delivery that fails is not tried again by the storenforward, so its messages are lost to the subscription,
+	  but the last BUFF_SIZE messages can be replayed by subscribing again, from where the subscriber got to with from=
+	- a slow subscriber only holds itself up, and what it can't keep up with is dropped by its overflow policy
+*/
+
+// What a harness subscriber's test server does wrong.
+type faults struct {
+	mut       sync.Mutex
+	delay     time.Duration // Before handling each delivery
+	dropEvery int           // Drop the connection, without answering, on every nth delivery
+	n         int
+	dropped   int
+	lost      []uint64 // The sequence numbers in the deliveries dropped
+}
+
+func (f *faults) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		f.mut.Lock()
+		f.n++
+		delay, drop := f.delay, f.dropEvery > 0 && f.n%f.dropEvery == 0
+		if drop {
+			f.dropped++
+		}
+		f.mut.Unlock()
+
+		if drop {
+			envs, _ := client.ReadDelivery(r)
+			f.mut.Lock()
+			for _, env := range envs {
+				f.lost = append(f.lost, env.Sequence)
+			}
+			f.mut.Unlock()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		time.Sleep(delay)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// A subscriber in the harness.
+type harnessSub struct {
+	t        *testing.T
+	broker   string
+	id       string
+	topic    string
+	settings func(c *client.Consumer) // Anything else to set up on its consumer
+	faults   *faults
+	once     *client.ExactlyOnce // Kept across restarts, like offsets on disk
+
+	mut       sync.Mutex
+	delivered []uint64         // Every message's sequence number, as it came in
+	handled   []uint64         // The ones that were new
+	ids       map[string][]int // The message ids handled, by producer
+	consumer  *client.Consumer
+	srv       *httptest.Server
+}
+
+func newHarnessSub(t *testing.T, broker, topic string, settings func(c *client.Consumer)) *harnessSub {
+	s := &harnessSub{
+		t:        t,
+		broker:   broker,
+		id:       client.NewId(),
+		topic:    topic,
+		settings: settings,
+		faults:   &faults{},
+		once:     client.NewExactlyOnce(client.NewMemoryOffsetStore(), nil),
+		ids:      make(map[string][]int),
+	}
+	s.start()
+	t.Cleanup(s.stop)
+	return s
+}
+
+// Start serving and subscribe, from the message after the last one handled.
+func (s *harnessSub) start() {
+
+	c := client.NewConsumer(s.broker)
+	c.Id = s.id
+	c.Listen = ""
+	c.From = s.once.From
+	c.Epoch = s.once.Epoch
+	if s.settings != nil {
+		s.settings(c)
+	}
+	c.Use(client.Recover, s.record, s.once.Middleware)
+	c.Handle(s.topic, client.Decoding(func() interface{} { return new(types.Message) })(client.HandlerFunc(s.handle)))
+
+	mux := http.NewServeMux()
+	mux.Handle(client.CONSUMER_PATTERN, s.faults.wrap(c))
+	srv := httptest.NewServer(mux)
+	c.ReplyTo = srv.URL + client.CONSUMER_PATTERN
+
+	s.mut.Lock()
+	s.consumer, s.srv = c, srv
+	s.mut.Unlock()
+	if err := c.Start(context.Background()); err != nil {
+		s.t.Fatalf("Subscriber %s cannot start: %v", s.id, err)
+	}
+}
+
+// Go away without unsubscribing, as a crash would.
+func (s *harnessSub) crash() {
+	s.mut.Lock()
+	srv := s.srv
+	s.srv = nil
+	s.mut.Unlock()
+	srv.CloseClientConnections()
+	srv.Close()
+}
+
+// Unsubscribe and stop, if it's still running.
+func (s *harnessSub) stop() {
+	s.mut.Lock()
+	c, srv := s.consumer, s.srv
+	s.srv = nil
+	s.mut.Unlock()
+	if srv != nil {
+		c.Stop(context.Background())
+		srv.Close()
+	}
+}
+
+func (s *harnessSub) record(next client.Handler) client.Handler {
+	return client.HandlerFunc(func(ctx context.Context, env *types.Envelope) error {
+		s.mut.Lock()
+		s.delivered = append(s.delivered, env.Sequence)
+		s.mut.Unlock()
+		return next.Handle(ctx, env)
+	})
+}
+
+func (s *harnessSub) handle(ctx context.Context, env *types.Envelope) error {
+	msg := client.Decoded(ctx).(*types.Message)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.handled = append(s.handled, env.Sequence)
+	s.ids[env.ProducerId] = append(s.ids[env.ProducerId], msg.Id)
+	return nil
+}
+
+func (s *harnessSub) got() (delivered, handled []uint64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]uint64(nil), s.delivered...), append([]uint64(nil), s.handled...)
+}
+
+// Wait for the subscriber to have handled the given number of messages, and that there aren't any more.
+func (s *harnessSub) wait(n int) []uint64 {
+	eventually(s.t, fmt.Sprintf("subscriber %s to handle %d messages", s.id, n), func() bool {
+		_, handled := s.got()
+		return len(handled) >= n
+	})
+	time.Sleep(50 * time.Millisecond)
+	_, handled := s.got()
+	if len(handled) != n {
+		s.t.Errorf("Subscriber %s handled %d messages, not %d", s.id, len(handled), n)
+	}
+	return handled
+}
+
+// Publish count messages, with ids from 1, one after the other.
+func publishMany(t *testing.T, p *client.Publisher, topic string, count int) {
+	for i := 1; i <= count; i++ {
+		if _, err := p.Publish(context.Background(), topic, &types.Message{Id: i, Content: "content", Time: time.Now()}); err != nil {
+			t.Errorf("%s cannot publish %d: %v", p.ProducerId, i, err)
+			return
+		}
+	}
+}
+
+func newHarnessPublisher(url, id string) *client.Publisher {
+	p := client.NewPublisher(url)
+	p.ProducerId = id
+	p.Broker.Backoff = 10 * time.Millisecond
+	return p
+}
+
+// The sequence numbers are from..to, in order, with nothing missing or repeated.
+func checkRun(t *testing.T, who string, seqs []uint64, from, to uint64) {
+	if len(seqs) != int(to-from+1) {
+		t.Errorf("%s got %d messages, not %d..%d: %v", who, len(seqs), from, to, seqs)
+		return
+	}
+	for i, seq := range seqs {
+		if seq != from+uint64(i) {
+			t.Errorf("%s got %v, not %d..%d", who, seqs, from, to)
+			return
+		}
+	}
+}
+
+// The sequence numbers only ever go up.
+func checkIncreasing(t *testing.T, who string, seqs []uint64) {
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] <= seqs[i-1] {
+			t.Errorf("%s got %d after %d: %v", who, seqs[i], seqs[i-1], seqs)
+			return
+		}
+	}
+}
+
+// Several publishers at once, and subscribers that take their messages in different ways, all get everything in
+// order.
+func TestIntegrationOrdering(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+
+	subs := []*harnessSub{
+		newHarnessSub(t, n.url, "Orders", nil),
+		newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) { c.Batch, c.Linger = 10, 20*time.Millisecond }),
+		newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) { c.Batch, c.Workers = 5, 4 }),
+	}
+
+	const PUBLISHERS, EACH = 3, 30
+	var wg sync.WaitGroup
+	for i := 0; i < PUBLISHERS; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			publishMany(t, newHarnessPublisher(n.url, fmt.Sprintf("publisher-%d", i)), "Orders", EACH)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, s := range subs {
+		handled := s.wait(PUBLISHERS * EACH)
+		checkRun(t, fmt.Sprintf("Subscriber %d", i), handled, 1, PUBLISHERS*EACH)
+
+		// Each publisher's messages are in the order it sent them
+		s.mut.Lock()
+		for producer, ids := range s.ids {
+			for j, id := range ids {
+				if id != j+1 {
+					t.Errorf("Subscriber %d got %s's messages as %v", i, producer, ids)
+					break
+				}
+			}
+		}
+		s.mut.Unlock()
+	}
+}
+
+// A subscriber that crashes and comes back gets what it missed from the store, and nothing twice, while another
+// subscriber carries on regardless.
+func TestIntegrationSubscriberDown(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	p := newHarnessPublisher(n.url, "publisher")
+
+	healthy := newHarnessSub(t, n.url, "Orders", nil)
+	flaky := newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) { c.Batch = 5 })
+
+	publishMany(t, p, "Orders", 10)
+	flaky.wait(10)
+	flaky.crash()
+	publishMany(t, p, "Orders", 10) // Sent to nobody, as far as flaky goes
+	healthy.wait(20)
+
+	flaky.start() // From 11
+	flaky.wait(20)
+	publishMany(t, p, "Orders", 5)
+
+	checkRun(t, "The healthy subscriber", healthy.wait(25), 1, 25)
+	checkRun(t, "The subscriber that crashed", flaky.wait(25), 1, 25)
+	delivered, _ := flaky.got()
+	checkIncreasing(t, "The subscriber that crashed", delivered)
+}
+
+// A slow subscriber doesn't hold the others up, and what it can't keep up with is dropped, oldest first.
+func TestIntegrationSlowSubscriber(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	p := newHarnessPublisher(n.url, "publisher")
+
+	fast := newHarnessSub(t, n.url, "Orders", nil)
+	slow := newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) { c.Queue, c.Overflow = 5, OVERFLOW_DROP_OLDEST })
+	slow.faults.mut.Lock()
+	slow.faults.delay = 50 * time.Millisecond
+	slow.faults.mut.Unlock()
+
+	const COUNT = 30
+	start := time.Now()
+	publishMany(t, p, "Orders", COUNT)
+	checkRun(t, "The fast subscriber", fast.wait(COUNT), 1, COUNT)
+	if took := time.Since(start); took > COUNT*50*time.Millisecond/2 {
+		t.Errorf("The fast subscriber took %s, as long as the slow one would", took)
+	}
+
+	// Every message is either handled or dropped, and the newest is always kept
+	dropped := func() uint64 {
+		n.b.subMut.RLock()
+		defer n.b.subMut.RUnlock()
+		return atomic.LoadUint64(&n.b.submap["Orders"][slow.id].dropped)
+	}
+	eventually(t, "the slow subscriber to catch up", func() bool {
+		_, handled := slow.got()
+		return len(handled) > 0 && handled[len(handled)-1] == COUNT
+	})
+	_, handled := slow.got()
+	checkIncreasing(t, "The slow subscriber", handled)
+	if d := dropped(); d == 0 || int(d)+len(handled) != COUNT {
+		t.Errorf("The slow subscriber handled %d and had %d dropped, of %d", len(handled), d, COUNT)
+	}
+}
+
+// A delivery is sent once: if the subscriber drops the connection, the messages in it are lost to that subscription,
+// and the rest keep coming in order. So each message is either handled once or lost, never both, and subscribing
+// again from the first one lost gets it and everything after. The lossy subscriber takes batches, because the HTTP
+// client can itself resend a single message, which has an idempotency key, on a connection that's dropped.
+func TestIntegrationDroppedConnections(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	p := newHarnessPublisher(n.url, "publisher")
+
+	healthy := newHarnessSub(t, n.url, "Orders", nil)
+	lossy := newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) { c.Batch = 2 })
+	lossy.faults.mut.Lock()
+	lossy.faults.dropEvery = 3
+	lossy.faults.mut.Unlock()
+
+	const COUNT = 20
+	publishMany(t, p, "Orders", COUNT)
+	checkRun(t, "The healthy subscriber", healthy.wait(COUNT), 1, COUNT)
+
+	lostSoFar := func() []uint64 {
+		lossy.faults.mut.Lock()
+		defer lossy.faults.mut.Unlock()
+		return append([]uint64(nil), lossy.faults.lost...)
+	}
+	eventually(t, "the lossy subscriber to get or lose every message", func() bool {
+		delivered, _ := lossy.got()
+		return len(delivered)+len(lostSoFar()) >= COUNT
+	})
+	time.Sleep(100 * time.Millisecond)
+	delivered, handled := lossy.got()
+	lost := lostSoFar()
+	if len(lost) == 0 {
+		t.Fatalf("No connections were dropped")
+	}
+
+	// Between them, what was handled and what was lost is every message, once
+	checkIncreasing(t, "The lossy subscriber", delivered)
+	if fmt.Sprint(handled) != fmt.Sprint(delivered) {
+		t.Errorf("The lossy subscriber handled %v of %v", handled, delivered)
+	}
+	seen := make(map[uint64]int)
+	for _, seq := range append(append([]uint64(nil), handled...), lost...) {
+		seen[seq]++
+	}
+	for seq := uint64(1); seq <= COUNT; seq++ {
+		if seen[seq] != 1 {
+			t.Errorf("Message %d was handled or lost %d times: handled %v, lost %v", seq, seen[seq], handled, lost)
+		}
+	}
+	if len(seen) != COUNT {
+		t.Errorf("Handled %v and lost %v, of %d", handled, lost, COUNT)
+	}
+
+	// Subscribing again from the first one lost gets it and everything after
+	replay := newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) {
+		c.From = func(topic string) (uint64, error) { return lost[0], nil }
+	})
+	checkRun(t, "The replaying subscriber", replay.wait(COUNT-int(lost[0])+1), lost[0], COUNT)
+}
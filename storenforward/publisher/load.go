@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gsamples/storenforward/bench"
+	"gsamples/storenforward/client"
+	"gsamples/types"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Load mode. With -load the publisher sends as many messages as it's told to, as fast as it's told to, and says how the
+storenforward coped: how many it managed a second, and how long each publish took. For example:
+
+	publisher -load -topics Orders,Prices -rate poisson:2000 -size uniform:100-4000 -concurrency 32 -duration 1m
+
+The messages are types.Messages whose Content is the given size, and whose Time is when they were sent, so that the
+subscriber's -latency mode can work out how long they took to get to it. They go round the topics in turn.
+
+The rate is kept to whether or not the storenforward keeps up, as real publishers wouldn't wait either. If all the
+workers are busy when a message is due, it's skipped and counted, which means the storenforward, or the publisher,
+is saturated. Nothing queues up in front of the workers, so a message is sent when it's due or not at all, and the
+latencies aren't hiding time spent waiting for a worker. Publishes aren't tried again, so the latencies are what they
+are.
+*/
+
+const (
+	LOAD_QUEUE  = 0               // Messages due but not yet picked up by a worker; none, so a busy pool skips them
+	LOAD_REPORT = 5 * time.Second // How often to say how it's going
+)
+
+var (
+	load        = flag.Bool("load", false, "generate load and report throughput and latency, rather than one message a second")
+	topics      = flag.String("topics", TOPIC, "the topics to publish to in load mode, comma separated")
+	rateSpec    = flag.String("rate", "constant:100", "messages a second in load mode: constant:N, poisson:N or step:N,N,...@duration")
+	sizeSpec    = flag.String("size", "fixed:256", "the size of the messages' content in load mode: fixed:N, uniform:min-max or normal:mean,stddev")
+	concurrency = flag.Int("concurrency", 8, "how many publishes can be in flight at once in load mode")
+	duration    = flag.Duration("duration", 30*time.Second, "how long to run for in load mode")
+)
+
+// A message that's due.
+type loadJob struct {
+	id    int
+	topic string
+	size  int
+}
+
+// How it's going.
+type loadStats struct {
+	sent    uint64 // Stored by the storenforward
+	failed  uint64 // Not stored
+	skipped uint64 // Not sent, as all the workers were busy
+	bytes   uint64 // Content sent
+	latency *bench.Latencies
+}
+
+func (s *loadStats) String() string {
+	return fmt.Sprintf("sent %d, failed %d, skipped %d, publish latency %s",
+		atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.failed), atomic.LoadUint64(&s.skipped), s.latency.Summary())
+}
+
+func runLoad(p *client.Publisher) error {
+
+	rate, err := bench.ParseRate(*rateSpec)
+	if err != nil {
+		return err
+	}
+	size, err := bench.ParseSize(*sizeSpec)
+	if err != nil {
+		return err
+	}
+	topicList := strings.Split(*topics, ",")
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, got %d", *concurrency)
+	}
+
+	p.Broker.Retries = 0 // A retry would hide how long the publish really took
+	stats := &loadStats{latency: bench.NewLatencies()}
+	jobs := make(chan loadJob, LOAD_QUEUE)
+	start := time.Now()
+	end := start.Add(*duration)
+
+	fmt.Printf("Load: %s messages a second of size %s to %v, %d at a time, for %s\n", *rateSpec, *sizeSpec, topicList, *concurrency, *duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if time.Now().After(end) {
+					atomic.AddUint64(&stats.skipped, 1)
+					continue
+				}
+				publishLoad(p, job, stats)
+			}
+		}()
+	}
+
+	// Say how it's going every so often
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(LOAD_REPORT)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Printf("After %s: %s\n", time.Since(start).Round(time.Second), stats)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Hand out the messages as they're due
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	next := start
+	for id := 0; next.Before(end); id++ {
+		if wait := time.Until(next); wait > time.Millisecond {
+			time.Sleep(wait)
+		}
+		job := loadJob{id: id, topic: topicList[id%len(topicList)], size: size.Next(rnd)}
+		select {
+		case jobs <- job:
+		default:
+			atomic.AddUint64(&stats.skipped, 1)
+		}
+		next = next.Add(rate.Gap(next.Sub(start), rnd))
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+
+	elapsed := time.Since(start)
+	fmt.Printf("Done in %s: %s\n", elapsed.Round(time.Millisecond), stats)
+	fmt.Printf("Throughput: %.1f messages/s, %.1f KB/s\n",
+		float64(stats.sent)/elapsed.Seconds(), float64(stats.bytes)/1024/elapsed.Seconds())
+	return nil
+}
+
+// Send one message, and time it.
+func publishLoad(p *client.Publisher, job loadJob, stats *loadStats) {
+
+	msg := types.Message{Id: job.id, Content: strings.Repeat("x", job.size), Time: time.Now()}
+	env, err := p.Envelope(&msg)
+	if err != nil {
+		fmt.Printf("Cannot marshal message %d: %+v\n", job.id, err)
+		atomic.AddUint64(&stats.failed, 1)
+		return
+	}
+
+	sent := time.Now()
+	_, err = p.PublishEnvelope(context.Background(), job.topic, env)
+	stats.latency.Record(time.Since(sent))
+	if err != nil {
+		atomic.AddUint64(&stats.failed, 1)
+		return
+	}
+	atomic.AddUint64(&stats.sent, 1)
+	atomic.AddUint64(&stats.bytes, uint64(job.size))
+}
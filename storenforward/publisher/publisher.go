@@ -1,22 +1,31 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
+	"gsamples/storenforward/client"
+	"gsamples/storenforward/codec"
+	"gsamples/storenforward/trace"
 	"gsamples/types"
-	"io/ioutil"
-	"net/http"
+	"os"
 	"time"
 )
 
 var (
-	counter = 0 // The message number
+	counter     = 0 // The message number
+	contentType = flag.String("type", codec.JSON, "the content type to publish in, e.g. application/cbor")
+	encoding    = flag.String("encoding", "", "compress messages with this Content-Encoding, e.g. gzip")
+	request     = flag.Duration("request", 0, "send each message as a request, and wait this long for the reply")
+	outboxDir   = flag.String("outbox", "", "keep messages that can't be sent yet in this directory, and send them later; by default they're lost")
+	tracing     = flag.Bool("trace", false, "start a trace for each message, and write our spans of it to stdout")
 )
 
 const (
-	CONTENT = "How do I send a JSON string in a POST request in Go"
-	URL     = "http://localhost:7868/message?topic=Bernie"
+	CONTENT  = "How do I send a JSON string in a POST request in Go"
+	BROKER   = "http://localhost:7868"
+	TOPIC    = "Bernie"
+	PRODUCER = "simple-publisher"
 )
 
 func main() {
@@ -26,7 +35,41 @@ func main() {
 	// send it
 	// wait
 
-	fmt.Println("Simple publisher, URL:>", URL)
+	flag.Parse()
+	enc, err := codec.Get(*contentType)
+	if err != nil {
+		fmt.Printf("Cannot publish as %s: %+v\n", *contentType, err)
+		return
+	}
+
+	fmt.Println("Simple publisher, broker:>", BROKER)
+
+	// The publisher gives each message an idempotency key, so the storenforward can ignore a resend
+	p := client.NewPublisher(BROKER)
+	p.Codec = enc
+	p.Encoding = *encoding
+	p.ProducerId = PRODUCER
+	if *tracing {
+		p.Tracer = trace.NewTracer(PRODUCER, trace.NewStdoutExporter(os.Stdout))
+	}
+	ctx := context.Background()
+
+	if *load {
+		if err := runLoad(p); err != nil {
+			fmt.Printf("Cannot generate load: %+v\n", err)
+		}
+		return
+	}
+
+	var outbox *client.Outbox
+	if *outboxDir != "" {
+		outbox, err = client.NewOutbox(p, *outboxDir, client.OUTBOX_MAX, client.OUTBOX_MAX_BYTES)
+		if err != nil {
+			fmt.Printf("Cannot open outbox %s: %+v\n", *outboxDir, err)
+			return
+		}
+		go outbox.Run(ctx)
+	}
 
 	for {
 
@@ -37,26 +80,31 @@ func main() {
 			Time:    time.Now(),
 		}
 
-		mbytes, err := json.Marshal(msg)
-
+		env, err := p.Envelope(&msg)
 		if err != nil {
-			fmt.Printf("JSON marshall error: %+v\n", err)
+			fmt.Printf("Cannot marshal message %d: %+v\n", counter, err)
+			return
 		}
 
-		// This uses a Request as it gives you more control than a http.Post()
-		req, err := http.NewRequest("POST", URL, bytes.NewBuffer(mbytes))
-		req.Header.Set("Content-Type", "application/json")
-
-		client := &http.Client{} // For example you can setuo client values such as time out if necessary
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Printf("Error in Posting to server: %+v\n", err)
+		if *request > 0 {
+			reply, err := p.Request(ctx, TOPIC, env, *request)
+			if err != nil {
+				fmt.Printf("Request %d failed: %+v\n", counter, err)
+			} else {
+				fmt.Printf("Reply to request %d: %s\n", counter, reply.Body)
+			}
+		} else if outbox != nil {
+			if err := outbox.Publish(ctx, TOPIC, env); err != nil {
+				fmt.Printf("Cannot publish message %d: %+v\n", counter, err)
+			}
+			fmt.Printf("Outbox: %+v\n", outbox.Stats())
 		} else {
-
-			// Now display the response:
-			body, _ := ioutil.ReadAll(resp.Body)
-			fmt.Printf("Response status %s, Headers: %v, Body: %s\n", resp.Status, resp.Header, body)
-			resp.Body.Close()
+			receipt, err := p.PublishEnvelope(ctx, TOPIC, env)
+			if err != nil {
+				fmt.Printf("Error in Posting to server: %+v\n", err)
+			} else {
+				fmt.Printf("Published message %d as %d, duplicate: %t\n", counter, receipt.Seq, receipt.Duplicate)
+			}
 		}
 
 		// this could be a random delay
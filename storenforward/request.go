@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"gsamples/storenforward/codec"
+	"gsamples/types"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Request/reply. A requester POSTs a message to REQUEST_PATTERN with the topic to publish it on, and the request is
+held open until a reply comes back, or the timeout - the timeout parameter or TIMEOUT_HEADER, as a Go duration or in
+milliseconds - runs out, which gets a 504.
+
+The request is published on its topic like any other message, but with a temporary reply topic of its own in the
+X-Reply-To header, and a correlation id in X-Correlation-Id, made up if the requester didn't send one. Whoever
+handles it publishes the reply to the reply topic, with the same correlation id, through IN_PATTERN as usual. Replies
+aren't stored: the first one that matches is passed straight back to the requester, and the reply topic goes away
+once the request's answered or given up on, so anything sent to it afterwards gets a 410. A request that hasn't got a
+ttl expires when it times out, as there's no point handling it after that.
+
+Reply topics start with REPLY_PREFIX, and can't be subscribed to or published to in a batch. In a cluster the reply
+topic names the node that's waiting for it, and replies are passed on to that node rather than to a leader.
+
+The client package has Request, which does all this, and Reply for the other end.
+*/
+
+const (
+	REQUEST_PATTERN = "/request"
+	TIMEOUT_HEADER  = "X-Timeout"
+	REPLY_PREFIX    = "_reply."
+	REQUEST_TIMEOUT = 30 * time.Second // How long to wait for a reply, if the requester doesn't say
+	MAX_TIMEOUT     = 5 * time.Minute  // The longest a requester can wait
+	GATEWAY_TIMEOUT = 504              // Nothing replied in time
+	GONE            = 410              // No one's waiting for a reply on the topic any more
+)
+
+// A request that's waiting for its reply.
+type pendingReply struct {
+	correlationId string
+	reply         chan *types.Envelope // Gets the reply. Buffered, so the replier never waits for the requester.
+}
+
+// The requests waiting for replies, by reply topic.
+type replyWaiters struct {
+	mut     *sync.Mutex
+	pending map[string]*pendingReply
+}
+
+func newReplyWaiters() *replyWaiters {
+	return &replyWaiters{mut: &sync.Mutex{}, pending: make(map[string]*pendingReply)}
+}
+
+// Whether a topic is one of the temporary reply topics.
+func isReplyTopic(topic string) bool {
+	return strings.HasPrefix(topic, REPLY_PREFIX)
+}
+
+// Which node is waiting for replies on a reply topic. It's empty if the topic doesn't say, or names a node we don't
+// know about.
+func (c *cluster) replyOwner(topic string) string {
+	parts := strings.SplitN(strings.TrimPrefix(topic, REPLY_PREFIX), ".", 2)
+	for _, n := range c.nodes {
+		if nodeTag(n) == parts[0] {
+			return n
+		}
+	}
+	return ""
+}
+
+// A short name for a node that can go in a topic.
+func nodeTag(node string) string {
+	h := fnv.New32a()
+	h.Write([]byte(node))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// Make up a reply topic, and start waiting for the reply.
+func (b *broker) expectReply(correlationId string) (string, *pendingReply) {
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	topic := fmt.Sprintf("%s%x", REPLY_PREFIX, id)
+	if b.cluster != nil {
+		topic = fmt.Sprintf("%s%s.%x", REPLY_PREFIX, nodeTag(b.cluster.self), id)
+	}
+
+	p := &pendingReply{correlationId: correlationId, reply: make(chan *types.Envelope, 1)}
+	b.replies.mut.Lock()
+	b.replies.pending[topic] = p
+	b.replies.mut.Unlock()
+	return topic, p
+}
+
+// Stop waiting for a reply.
+func (b *broker) forgetReply(topic string) {
+	b.replies.mut.Lock()
+	delete(b.replies.pending, topic)
+	b.replies.mut.Unlock()
+}
+
+// Publish a request and wait for the reply.
+func (b *broker) processRequest(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		fmt.Println("recieved a non-POST request")
+		err := errors.New("Unsupported request method")
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Printf("Error reading body: %+v\n", err)
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" || isReplyTopic(topic) {
+		fmt.Println("Missing Topic")
+		http.Error(w, "Missing Topic", BAD_REQUEST)
+		return
+	}
+
+	timeout := REQUEST_TIMEOUT
+	t := r.URL.Query().Get("timeout")
+	if t == "" {
+		t = r.Header.Get(TIMEOUT_HEADER)
+	}
+	if t != "" {
+		if timeout, err = parseDuration(t); err != nil || timeout <= 0 || timeout > MAX_TIMEOUT {
+			http.Error(w, fmt.Sprintf("Invalid timeout - must be a duration or milliseconds up to %s, got %q", MAX_TIMEOUT, t), BAD_REQUEST)
+			return
+		}
+	}
+
+	env := types.ReadEnvelope(r.Header, body)
+	env.Topic = topic
+	env.Sequence = 0
+	env.Received = time.Now()
+
+	plain, err := plainBody(env)
+	if err != nil {
+		fmt.Printf("Cannot decompress request: %+v\n", err)
+		status := BAD_REQUEST
+		if errors.Is(err, codec.ErrUnknownEncoding) {
+			status = UNSUPPORTED_MEDIA_TYPE
+		}
+		http.Error(w, "Cannot decompress request - "+err.Error(), status)
+		return
+	}
+
+	env.Key, err = idempotencyKey(r, plain)
+	if err != nil {
+		fmt.Printf("Cannot work out idempotency key: %+v\n", err)
+		http.Error(w, "Invalid idempotency key - "+err.Error(), BAD_REQUEST)
+		return
+	}
+
+	env.Expires, err = messageExpiry(r, env.Received)
+	if err != nil {
+		fmt.Printf("Cannot work out expiry: %+v\n", err)
+		http.Error(w, "Invalid ttl - "+err.Error(), BAD_REQUEST)
+		return
+	}
+	if env.Expires.IsZero() {
+		env.Expires = env.Received.Add(timeout)
+	}
+
+	if env.CorrelationId == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		env.CorrelationId = fmt.Sprintf("%x", id)
+	}
+	replyTopic, pending := b.expectReply(env.CorrelationId)
+	defer b.forgetReply(replyTopic)
+	env.ReplyTo = replyTopic
+
+	if err := b.validateMessage(env); err != nil {
+		fmt.Printf("Rejected request for %s: %+v\n", topic, err)
+		http.Error(w, "Invalid message - "+err.Error(), BAD_REQUEST)
+		return
+	}
+	b.compressForStore(env)
+
+	seq, dup, err := b.addToStore(env)
+	if err != nil {
+		fmt.Printf("Cannot store request for %s: %+v\n", topic, err)
+		http.Error(w, "Cannot store request - "+err.Error(), UNAVAILABLE)
+		return
+	}
+	if dup {
+		// The reply to the original went to whoever sent it
+		http.Error(w, fmt.Sprintf("Request was already sent as message %d", seq), http.StatusConflict)
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-pending.reply:
+		reply.WriteHeaders(w.Header())
+		w.Write(reply.Body)
+	case <-timer.C:
+		fmt.Printf("No reply to request %d on %s within %s\n", seq, topic, timeout)
+		http.Error(w, fmt.Sprintf("No reply within %s", timeout), GATEWAY_TIMEOUT)
+	case <-r.Context().Done():
+		fmt.Printf("Requester for %d on %s has gone away\n", seq, topic)
+	case <-b.done:
+		http.Error(w, errStopped.Error(), UNAVAILABLE)
+	}
+}
+
+// Pass a reply published to a reply topic straight on to the request that's waiting for it.
+func (b *broker) deliverReply(w http.ResponseWriter, env *types.Envelope) {
+
+	b.replies.mut.Lock()
+	p, ok := b.replies.pending[env.Topic]
+	matches := ok && p.correlationId == env.CorrelationId
+	if matches {
+		delete(b.replies.pending, env.Topic)
+	}
+	b.replies.mut.Unlock()
+
+	switch {
+	case !ok:
+		http.Error(w, "No one is waiting for a reply on "+env.Topic+"; the request may have timed out", GONE)
+	case !matches:
+		http.Error(w, fmt.Sprintf("Correlation id %q doesn't match the request's", env.CorrelationId), BAD_REQUEST)
+	default:
+		p.reply <- env
+		w.Write([]byte("OK"))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"gsamples/storenforward/client"
+	"gsamples/types"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Subscribe a responder to a topic, which answers each request through the given node, and returns the requests
+// it's had.
+func respond(t *testing.T, sub, via *testNode, topic string) func() []*types.Envelope {
+
+	var mut sync.Mutex
+	var got []*types.Envelope
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := types.ReadEnvelope(r.Header, body)
+		mut.Lock()
+		got = append(got, req)
+		mut.Unlock()
+
+		if err := client.Reply(via.url, req, &types.Envelope{Body: append([]byte("re: "), body...)}); err != nil {
+			t.Errorf("Reply failed: %v", err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	params := url.Values{"id": {"1"}, "topic": {topic}, "replyto": {srv.URL}}
+	eventually(t, "the responder to subscribe", func() bool {
+		resp, err := http.Get(sub.url + SUB_PATTERN + "?" + params.Encode())
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+
+	return func() []*types.Envelope {
+		mut.Lock()
+		defer mut.Unlock()
+		return append([]*types.Envelope(nil), got...)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	requests := respond(t, n, n, "Prices")
+
+	reply, err := client.Request(n.url, "Prices", &types.Envelope{CorrelationId: "abc", Body: []byte("X1")}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(reply.Body) != "re: X1" || reply.CorrelationId != "abc" {
+		t.Errorf("Got reply %q with correlation id %q", reply.Body, reply.CorrelationId)
+	}
+
+	// The reply topic has gone, so a second reply isn't wanted
+	req := requests()[0]
+	if !isReplyTopic(req.ReplyTo) {
+		t.Fatalf("Request was sent with reply to %q", req.ReplyTo)
+	}
+	if err := client.Reply(n.url, req, &types.Envelope{Body: []byte("again")}); err != client.ErrNoOne {
+		t.Errorf("Second reply got %v", err)
+	}
+	n.b.replies.mut.Lock()
+	waiting := len(n.b.replies.pending)
+	n.b.replies.mut.Unlock()
+	if waiting != 0 {
+		t.Errorf("%d requests still waiting", waiting)
+	}
+
+	// The correlation id's made up if there isn't one
+	reply, err = client.Request(n.url, "Prices", &types.Envelope{Body: []byte("X2")}, 5*time.Second)
+	if err != nil || reply.CorrelationId == "" {
+		t.Errorf("Request without a correlation id got %v, %v", reply, err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+
+	start := time.Now()
+	if _, err := client.Request(n.url, "Nobody", &types.Envelope{Body: []byte("hello?")}, 100*time.Millisecond); err != client.ErrTimeout {
+		t.Fatalf("Request no one answers got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Timing out took %s", d)
+	}
+
+	// The request has expired with it
+	rb := n.b.getRingBuf("Nobody")
+	rb.mut.Lock()
+	env := rb.entry(1)
+	rb.mut.Unlock()
+	if env == nil || env.Expires.IsZero() {
+		t.Errorf("Request was stored as %+v", env)
+	}
+}
+
+func TestClusterRequestReply(t *testing.T) {
+
+	nodes := startCluster(t, 3)
+
+	// The request, the subscription and the reply all go through different nodes
+	respond(t, nodes[1], nodes[2], "Quotes")
+	reply, err := client.Request(nodes[0].url, "Quotes", &types.Envelope{Body: []byte("Q1")}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(reply.Body) != "re: Q1" {
+		t.Errorf("Got reply %q", reply.Body)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"gsamples/types"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Delayed and scheduled messages. A publisher can ask for a message to be held back with either:
+
+	deliverAt - the time to store and forward it, as RFC 3339 or Unix milliseconds
+	delay     - how long to wait, as a Go duration (e.g. 90s) or a number of milliseconds
+
+The message isn't stored until then, so it gets its sequence number, and is checked against the idempotency window,
+when it's due. Until then it's only held in memory.
+
+The held messages are kept in a heap ordered by when they're due, with one goroutine and one timer waiting for the
+earliest. Messages due at the same time go out in the order they were published.
+*/
+
+const (
+	DELIVER_AT_HEADER = "X-Deliver-At"     // Set on the reply to say when a held message will be stored and forwarded
+	MAX_DELAY         = 7 * 24 * time.Hour // The furthest ahead a message can be scheduled
+)
+
+// A message that's waiting.
+type scheduledMsg struct {
+	at    time.Time
+	order uint64 // Breaks ties between messages due at the same time
+	env   *types.Envelope
+}
+
+// Implements heap.Interface, earliest first.
+type schedHeap []*scheduledMsg
+
+func (h schedHeap) Len() int { return len(h) }
+func (h schedHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].order < h[j].order
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h schedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *schedHeap) Push(x interface{}) { *h = append(*h, x.(*scheduledMsg)) }
+func (h *schedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+type scheduler struct {
+	mut   *sync.Mutex
+	msgs  schedHeap
+	count uint64                    // Messages scheduled so far, used to keep the order
+	wake  chan struct{}             // Nudges run() when there's a new earliest message
+	store func(env *types.Envelope) // Stores and forwards a message that's due
+}
+
+func newScheduler(store func(env *types.Envelope)) *scheduler {
+	return &scheduler{
+		mut:   &sync.Mutex{},
+		wake:  make(chan struct{}, 1),
+		store: store,
+	}
+}
+
+// Hold a message until it's due.
+func (s *scheduler) schedule(at time.Time, env *types.Envelope) {
+
+	s.mut.Lock()
+	s.count++
+	sm := &scheduledMsg{at: at, order: s.count, env: env}
+	heap.Push(&s.msgs, sm)
+	earliest := s.msgs[0] == sm
+	s.mut.Unlock()
+
+	if earliest {
+		select {
+		case s.wake <- struct{}{}:
+		default: // Already nudged
+		}
+	}
+}
+
+// The number of messages waiting.
+func (s *scheduler) len() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return len(s.msgs)
+}
+
+// Wait for messages to become due, then store and forward them. This carries on until done is closed.
+func (s *scheduler) run(done <-chan struct{}) {
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due := s.takeDue(time.Now())
+		for _, sm := range due {
+			s.store(sm.env)
+		}
+
+		// Sleep until the next one's due, or something earlier is scheduled
+		wait := time.Hour
+		s.mut.Lock()
+		if len(s.msgs) > 0 {
+			wait = time.Until(s.msgs[0].at)
+		}
+		s.mut.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Store a scheduled message that's due.
+func (b *broker) storeDue(env *types.Envelope) {
+	seq, dup, err := b.addToStore(env)
+	if err != nil {
+		fmt.Printf("Cannot store scheduled message for topic %s: %+v\n", env.Topic, err)
+		return
+	}
+	fmt.Printf("Delivered scheduled message to topic %s, sequence: %d, duplicate: %t\n", env.Topic, seq, dup)
+}
+
+// Remove and return the messages that are due, in order.
+func (s *scheduler) takeDue(now time.Time) []*scheduledMsg {
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var due []*scheduledMsg
+	for len(s.msgs) > 0 && !s.msgs[0].at.After(now) {
+		due = append(due, heap.Pop(&s.msgs).(*scheduledMsg))
+	}
+	return due
+}
+
+// Work out when a published message should be stored from the deliverAt or delay parameters. The zero time means now.
+func deliveryTime(params url.Values, now time.Time) (time.Time, error) {
+
+	var at time.Time
+	if d := params.Get("deliverAt"); d != "" {
+		if ms, err := strconv.ParseInt(d, 10, 64); err == nil {
+			at = time.Unix(0, ms*int64(time.Millisecond))
+		} else if at, err = time.Parse(time.RFC3339Nano, d); err != nil {
+			return at, fmt.Errorf("deliverAt must be RFC 3339 or Unix milliseconds, got %q", d)
+		}
+	} else if d := params.Get("delay"); d != "" {
+		delay, err := parseDuration(d)
+		if err != nil {
+			return at, fmt.Errorf("delay must be a duration or milliseconds, got %q", d)
+		}
+		at = now.Add(delay)
+	} else {
+		return at, nil
+	}
+
+	if at.Sub(now) > MAX_DELAY {
+		return at, fmt.Errorf("can't schedule more than %s ahead", MAX_DELAY)
+	}
+	if !at.After(now) {
+		return time.Time{}, nil // It's already due
+	}
+	return at, nil
+}
+
+// Read a duration given either the Go way, e.g. 1m30s, or as a number of milliseconds.
+func parseDuration(d string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(d, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(d)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"gsamples/types"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Messages come due earliest first, and those due at the same time in the order they were scheduled.
+func TestSchedulerOrder(t *testing.T) {
+
+	s := newScheduler(nil)
+	now := time.Now()
+	for _, m := range []struct {
+		at    time.Duration
+		topic string
+	}{
+		{3 * time.Second, "c"},
+		{time.Second, "a1"},
+		{time.Hour, "later"},
+		{time.Second, "a2"},
+		{2 * time.Second, "b"},
+		{time.Second, "a3"},
+	} {
+		s.schedule(now.Add(m.at), &types.Envelope{Topic: m.topic})
+	}
+
+	if due := s.takeDue(now); len(due) != 0 {
+		t.Errorf("%d due before any were", len(due))
+	}
+	var got []string
+	for _, sm := range s.takeDue(now.Add(3 * time.Second)) {
+		got = append(got, sm.env.Topic)
+	}
+	if len(got) != 5 || got[0] != "a1" || got[1] != "a2" || got[2] != "a3" || got[3] != "b" || got[4] != "c" {
+		t.Errorf("Due in order %v", got)
+	}
+	if s.len() != 1 {
+		t.Errorf("%d left", s.len())
+	}
+}
+
+// run() stores a message when it's due, including one scheduled earlier than what it's waiting for.
+func TestSchedulerRun(t *testing.T) {
+
+	var mut sync.Mutex
+	var stored []string
+	s := newScheduler(func(env *types.Envelope) {
+		mut.Lock()
+		stored = append(stored, env.Topic)
+		mut.Unlock()
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go s.run(done)
+
+	now := time.Now()
+	s.schedule(now.Add(time.Hour), &types.Envelope{Topic: "later"})
+	s.schedule(now.Add(100*time.Millisecond), &types.Envelope{Topic: "soon"})
+	eventually(t, "the message that's due", func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		return len(stored) == 1 && stored[0] == "soon"
+	})
+	if s.len() != 1 {
+		t.Errorf("%d waiting", s.len())
+	}
+}
+
+// deliverAt and delay are read in their various forms, within MAX_DELAY.
+func TestDeliveryTime(t *testing.T) {
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, c := range []struct {
+		query string
+		want  time.Time
+		fails bool
+	}{
+		{"", time.Time{}, false},
+		{"delay=90s", now.Add(90 * time.Second), false},
+		{"delay=1500", now.Add(1500 * time.Millisecond), false},
+		{"deliverAt=2020-01-02T04:00:00Z", time.Date(2020, 1, 2, 4, 0, 0, 0, time.UTC), false},
+		{"deliverAt=1577934305000", now.Add(time.Minute), false},
+		{"deliverAt=1577934245000", time.Time{}, false},
+		{"deliverAt=2019-01-01T00:00:00Z", time.Time{}, false},
+		{"delay=-5s", time.Time{}, false},
+		{"delay=soon", time.Time{}, true},
+		{"deliverAt=tomorrow", time.Time{}, true},
+		{"delay=200h", time.Time{}, true},
+	} {
+		params, _ := url.ParseQuery(c.query)
+		at, err := deliveryTime(params, now)
+		if (err != nil) != c.fails || (err == nil && !at.Equal(c.want)) {
+			t.Errorf("%q got %s, %v", c.query, at, err)
+		}
+	}
+}
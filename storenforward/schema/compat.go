@@ -0,0 +1,159 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Compatibility between schema versions. Working out exactly which values two schemas accept isn't practical, so the
+check is structural and errs on the side of caution, with one exception: adding a new optional property is allowed,
+as that's how schemas usually grow.
+
+	backward - consumers using the new schema can read messages written with the old one
+	forward  - consumers still using the old schema can read messages written with the new one
+	full     - both
+	none     - anything goes
+*/
+
+const (
+	BACKWARD = "backward"
+	FORWARD  = "forward"
+	FULL     = "full"
+	NONE     = "none"
+)
+
+// An IncompatibleError lists the reasons a new schema version isn't compatible with the last one.
+type IncompatibleError struct {
+	Mode    string
+	Reasons []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return "not " + e.Mode + " compatible: " + strings.Join(e.Reasons, "; ")
+}
+
+// Check that a new schema is compatible with the old one. The error is an *IncompatibleError if it's not.
+func CheckCompatibility(old, new *Schema, mode string) error {
+
+	var reasons []string
+	switch mode {
+	case NONE:
+	case BACKWARD:
+		accepts(new, old, "", &reasons)
+	case FORWARD:
+		accepts(old, new, "", &reasons)
+	case FULL:
+		accepts(new, old, "", &reasons)
+		accepts(old, new, "", &reasons)
+	default:
+		return fmt.Errorf("schema: unknown compatibility mode %q", mode)
+	}
+
+	if len(reasons) > 0 {
+		return &IncompatibleError{Mode: mode, Reasons: reasons}
+	}
+	return nil
+}
+
+// Add a reason to the list for each way in which the reader schema might reject something that the writer schema
+// allows.
+func accepts(reader, writer *Schema, path string, reasons *[]string) {
+
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		*reasons = append(*reasons, p+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(reader.Types) > 0 {
+		if len(writer.Types) == 0 {
+			fail("type restricted to %s", strings.Join(reader.Types, " or "))
+		} else {
+			for _, t := range writer.Types {
+				if !reader.allowsType(t, nil) {
+					fail("type %s no longer allowed", t)
+				}
+			}
+		}
+	}
+
+	if len(reader.Enum) > 0 {
+		if len(writer.Enum) == 0 {
+			fail("values restricted to an enum")
+		} else {
+			for _, v := range writer.Enum {
+				if !inEnum(reader.Enum, v) {
+					fail("enum value %v no longer allowed", v)
+				}
+			}
+		}
+	}
+
+	// The reader's limits can't be any tighter than the writer's
+	tighter := func(name string, r, w *float64, lower bool) {
+		if r == nil {
+			return
+		}
+		if w == nil || (lower && *r > *w) || (!lower && *r < *w) {
+			fail("%s tightened", name)
+		}
+	}
+	tighter("minimum", reader.Minimum, writer.Minimum, true)
+	tighter("maximum", reader.Maximum, writer.Maximum, false)
+	tighter("minLength", intPtr(reader.MinLength), intPtr(writer.MinLength), true)
+	tighter("maxLength", intPtr(reader.MaxLength), intPtr(writer.MaxLength), false)
+	tighter("minItems", intPtr(reader.MinItems), intPtr(writer.MinItems), true)
+	tighter("maxItems", intPtr(reader.MaxItems), intPtr(writer.MaxItems), false)
+
+	if reader.Pattern != nil && (writer.Pattern == nil || reader.Pattern.String() != writer.Pattern.String()) {
+		fail("pattern changed")
+	}
+
+	if reader.Items != nil && writer.Items != nil {
+		accepts(reader.Items, writer.Items, path+"/items", reasons)
+	} else if reader.Items != nil {
+		fail("array items restricted")
+	}
+
+	// A property the reader requires must have been required by the writer
+	writerRequired := make(map[string]bool, len(writer.Required))
+	for _, name := range writer.Required {
+		writerRequired[name] = true
+	}
+	for _, name := range reader.Required {
+		if !writerRequired[name] {
+			fail("%q is now required", name)
+		}
+	}
+
+	names := make([]string, 0, len(writer.Properties))
+	for name := range writer.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := path + "/" + escape(name)
+		if rp, ok := reader.Properties[name]; ok {
+			accepts(rp, writer.Properties[name], p, reasons)
+		} else if reader.NoAdditional {
+			*reasons = append(*reasons, p+": no longer allowed")
+		} else if reader.AdditionalProperties != nil {
+			accepts(reader.AdditionalProperties, writer.Properties[name], p, reasons)
+		}
+	}
+	if reader.NoAdditional && !writer.NoAdditional {
+		fail("additional properties no longer allowed")
+	}
+}
+
+func intPtr(i *int) *float64 {
+	if i == nil {
+		return nil
+	}
+	f := float64(*i)
+	return &f
+}
@@ -0,0 +1,126 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A Version is one registered version of a topic's schema.
+type Version struct {
+	Topic   string          `json:"topic"`
+	Version int             `json:"version"` // Starts at 1
+	Raw     json.RawMessage `json:"schema"`  // The schema as it was registered
+	Schema  *Schema         `json:"-"`
+}
+
+// The versions of the schema for one topic, and the compatibility that new versions have to meet.
+type subject struct {
+	mode     string
+	versions []*Version
+}
+
+// A Registry holds the schemas for each topic. It's safe for concurrent use.
+type Registry struct {
+	mut      *sync.RWMutex
+	subjects map[string]*subject
+}
+
+var ErrNotFound = errors.New("schema: not found")
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mut:      &sync.RWMutex{},
+		subjects: make(map[string]*subject),
+	}
+}
+
+// Register a new version of a topic's schema. If mode is given it becomes the topic's compatibility mode, otherwise
+// the topic keeps the mode it had, which starts as BACKWARD. The new version has to be compatible with the latest one.
+// Registering the same schema as the latest version again just returns that version.
+func (r *Registry) Register(topic string, raw []byte, mode string) (*Version, error) {
+
+	s, err := Compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		// Checked here so that a bad mode is reported even for the first version
+		if err := CheckCompatibility(s, s, mode); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	sub, ok := r.subjects[topic]
+	if !ok {
+		sub = &subject{mode: BACKWARD}
+		r.subjects[topic] = sub
+	}
+	if mode == "" {
+		mode = sub.mode
+	}
+
+	if n := len(sub.versions); n > 0 {
+		latest := sub.versions[n-1]
+		if compactEqual(latest.Raw, raw) {
+			sub.mode = mode
+			return latest, nil
+		}
+		if err := CheckCompatibility(latest.Schema, s, mode); err != nil {
+			return nil, fmt.Errorf("schema for %s is %w", topic, err)
+		}
+	}
+
+	sub.mode = mode
+	v := &Version{
+		Topic:   topic,
+		Version: len(sub.versions) + 1,
+		Raw:     append(json.RawMessage(nil), raw...),
+		Schema:  s,
+	}
+	sub.versions = append(sub.versions, v)
+	return v, nil
+}
+
+// Get a version of a topic's schema; version 0 is the latest. The error is ErrNotFound if there isn't one.
+func (r *Registry) Get(topic string, version int) (*Version, error) {
+
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	sub, ok := r.subjects[topic]
+	if !ok || version < 0 || version > len(sub.versions) {
+		return nil, ErrNotFound
+	}
+	if version == 0 {
+		version = len(sub.versions)
+	}
+	return sub.versions[version-1], nil
+}
+
+// Check a decoded message against the latest version of its topic's schema. Topics without a schema accept anything.
+func (r *Registry) Validate(topic string, v interface{}) error {
+
+	latest, err := r.Get(topic, 0)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err := latest.Schema.Validate(v); err != nil {
+		return fmt.Errorf("doesn't match version %d of the schema for %s: %v", latest.Version, topic, err)
+	}
+	return nil
+}
+
+func compactEqual(a, b []byte) bool {
+	var ca, cb interface{}
+	if json.Unmarshal(a, &ca) != nil || json.Unmarshal(b, &cb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(ca)
+	jb, _ := json.Marshal(cb)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,335 @@
+/*
+Package schema validates messages against JSON Schemas, and keeps a registry of versioned schemas per topic.
+
+Only the parts of JSON Schema that describe the shape of a message are supported: type, properties, required,
+additionalProperties, items, enum, minimum, maximum, minLength, maxLength, pattern, minItems and maxItems. Anything
+else in a schema is ignored. Values are the generic ones that a self describing codec decodes to, so messages can be
+validated whether they were published as JSON, MessagePack or CBOR.
+*/
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A Schema is a compiled JSON Schema.
+type Schema struct {
+	Types                []string           // Any of: null, boolean, integer, number, string, array, object
+	Properties           map[string]*Schema // The schemas for an object's named properties
+	Required             []string           // The properties an object must have
+	AdditionalProperties *Schema            // The schema for any other properties; nil means anything goes
+	NoAdditional         bool               // additionalProperties was false
+	Items                *Schema            // The schema for each item in an array
+	Enum                 []interface{}      // The only values allowed
+	Minimum, Maximum     *float64
+	MinLength, MaxLength *int
+	MinItems, MaxItems   *int
+	Pattern              *regexp.Regexp
+}
+
+// The JSON form of a schema.
+type rawSchema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	Enum                 []interface{}              `json:"enum"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	Pattern              *string                    `json:"pattern"`
+}
+
+var knownTypes = map[string]bool{
+	"null": true, "boolean": true, "integer": true, "number": true, "string": true, "array": true, "object": true,
+}
+
+// Compile a JSON Schema.
+func Compile(data []byte) (*Schema, error) {
+
+	var raw rawSchema
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("schema: %v", err)
+	}
+
+	s := &Schema{
+		Required:  raw.Required,
+		Enum:      raw.Enum,
+		Minimum:   raw.Minimum,
+		Maximum:   raw.Maximum,
+		MinLength: raw.MinLength,
+		MaxLength: raw.MaxLength,
+		MinItems:  raw.MinItems,
+		MaxItems:  raw.MaxItems,
+	}
+
+	if len(raw.Type) > 0 {
+		var one string
+		if err := json.Unmarshal(raw.Type, &one); err == nil {
+			s.Types = []string{one}
+		} else if err := json.Unmarshal(raw.Type, &s.Types); err != nil {
+			return nil, fmt.Errorf("schema: type must be a string or an array of strings")
+		}
+		for _, t := range s.Types {
+			if !knownTypes[t] {
+				return nil, fmt.Errorf("schema: unknown type %q", t)
+			}
+		}
+	}
+
+	if len(raw.Properties) > 0 {
+		s.Properties = make(map[string]*Schema, len(raw.Properties))
+		for name, p := range raw.Properties {
+			ps, err := Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("%v in property %q", err, name)
+			}
+			s.Properties[name] = ps
+		}
+	}
+
+	if len(raw.AdditionalProperties) > 0 {
+		var b bool
+		if err := json.Unmarshal(raw.AdditionalProperties, &b); err == nil {
+			s.NoAdditional = !b
+		} else {
+			ap, err := Compile(raw.AdditionalProperties)
+			if err != nil {
+				return nil, fmt.Errorf("%v in additionalProperties", err)
+			}
+			s.AdditionalProperties = ap
+		}
+	}
+
+	if len(raw.Items) > 0 {
+		items, err := Compile(raw.Items)
+		if err != nil {
+			return nil, fmt.Errorf("%v in items", err)
+		}
+		s.Items = items
+	}
+
+	if raw.Pattern != nil {
+		re, err := regexp.Compile(*raw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("schema: bad pattern: %v", err)
+		}
+		s.Pattern = re
+	}
+	return s, nil
+}
+
+// A ValidationError lists everything that's wrong with a value, by JSON pointer.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Check a value against the schema. The error is a *ValidationError if the value doesn't match.
+func (s *Schema) Validate(v interface{}) error {
+
+	var problems []string
+	s.validate(v, "", &problems)
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (s *Schema) validate(v interface{}, path string, problems *[]string) {
+
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		*problems = append(*problems, p+": "+fmt.Sprintf(format, args...))
+	}
+
+	t := typeOf(v)
+	if len(s.Types) > 0 && !s.allowsType(t, v) {
+		fail("expected %s, got %s", strings.Join(s.Types, " or "), t)
+		return
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		fail("%v is not one of the allowed values", v)
+	}
+
+	switch t {
+	case "integer", "number":
+		n, _ := toFloat(v)
+		if s.Minimum != nil && n < *s.Minimum {
+			fail("%v is less than the minimum of %v", n, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			fail("%v is more than the maximum of %v", n, *s.Maximum)
+		}
+
+	case "string":
+		str := v.(string)
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("longer than %d characters", *s.MaxLength)
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(str) {
+			fail("%q doesn't match the pattern %s", str, s.Pattern)
+		}
+
+	case "array":
+		arr := v.([]interface{})
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			fail("fewer than %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			fail("more than %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				s.Items.validate(item, fmt.Sprintf("%s/%d", path, i), problems)
+			}
+		}
+
+	case "object":
+		obj := v.(map[string]interface{})
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				fail("%q is required", name)
+			}
+		}
+
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names) // So the problems always come out in the same order
+
+		for _, name := range names {
+			p := path + "/" + escape(name)
+			if ps, ok := s.Properties[name]; ok {
+				ps.validate(obj[name], p, problems)
+			} else if s.NoAdditional {
+				*problems = append(*problems, p+": is not allowed")
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(obj[name], p, problems)
+			}
+		}
+	}
+}
+
+func (s *Schema) allowsType(t string, v interface{}) bool {
+	for _, allowed := range s.Types {
+		if allowed == t || (allowed == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// The JSON Schema type of a generic value. Whole numbers are integers, however they were encoded.
+func typeOf(v interface{}) string {
+
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := x.Float64(); err == nil && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "integer"
+	case float32, float64:
+		f, _ := toFloat(x)
+		if f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	case int:
+		return float64(x), true
+	case int8:
+		return float64(x), true
+	case int16:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint:
+		return float64(x), true
+	case uint8:
+		return float64(x), true
+	case uint16:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// Whether a value is in an enum. Numbers are compared by value, whatever their type, and everything else by its JSON.
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if equal(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if aNum || bNum {
+		return aNum && bNum && fa == fb
+	}
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// Escape a property name for a JSON pointer.
+func escape(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,136 @@
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const messageSchema = `{
+	"type": "object",
+	"required": ["Id", "Content"],
+	"properties": {
+		"Id":      {"type": "integer", "minimum": 0},
+		"Content": {"type": "string", "maxLength": 20},
+		"Tags":    {"type": "array", "items": {"enum": ["a", "b"]}}
+	}
+}`
+
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("Bad test JSON %s: %v", s, err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+
+	s, err := Compile([]byte(messageSchema))
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+
+	tests := []struct {
+		msg      string
+		problems []string
+	}{
+		{`{"Id": 1, "Content": "hello"}`, nil},
+		{`{"Id": 1.0, "Content": "hello", "Tags": ["a"], "Extra": true}`, nil},
+		{`{"Id": "1", "Content": "hello"}`, []string{"/Id: expected integer, got string"}},
+		{`{"Id": -1}`, []string{`/: "Content" is required`, "/Id: -1 is less than the minimum of 0"}},
+		{`{"Id": 2, "Content": "this is far too long to fit"}`, []string{"/Content: longer than 20 characters"}},
+		{`{"Id": 3, "Content": "x", "Tags": ["a", "c"]}`, []string{"/Tags/1: c is not one of the allowed values"}},
+		{`[1, 2]`, []string{"/: expected object, got array"}},
+	}
+
+	for _, test := range tests {
+		err := s.Validate(decode(t, test.msg))
+		if test.problems == nil {
+			if err != nil {
+				t.Errorf("%s should be valid, got: %v", test.msg, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s should be invalid, got: %v", test.msg, err)
+			continue
+		}
+		if strings.Join(verr.Problems, "|") != strings.Join(test.problems, "|") {
+			t.Errorf("%s gave problems %q, expected %q", test.msg, verr.Problems, test.problems)
+		}
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		new      string
+		backward bool
+		forward  bool
+	}{
+		{"add optional property", `{"type":"object","required":["Id"],"properties":{"Id":{"type":"integer"},"Extra":{"type":"string"}}}`, true, true},
+		{"add required property", `{"type":"object","required":["Id","Extra"],"properties":{"Id":{"type":"integer"},"Extra":{"type":"string"}}}`, false, true},
+		{"drop required property", `{"type":"object","properties":{"Id":{"type":"integer"}}}`, true, false},
+		{"widen type", `{"type":"object","required":["Id"],"properties":{"Id":{"type":"number"}}}`, true, false},
+		{"narrow with minimum", `{"type":"object","required":["Id"],"properties":{"Id":{"type":"integer","minimum":0}}}`, false, true},
+		{"close the object", `{"type":"object","required":["Id"],"properties":{"Id":{"type":"integer"}},"additionalProperties":false}`, false, true},
+	}
+
+	old, _ := Compile([]byte(`{"type":"object","required":["Id"],"properties":{"Id":{"type":"integer"}}}`))
+	for _, test := range tests {
+		new, err := Compile([]byte(test.new))
+		if err != nil {
+			t.Fatalf("%s: compile error: %v", test.name, err)
+		}
+		if err := CheckCompatibility(old, new, BACKWARD); (err == nil) != test.backward {
+			t.Errorf("%s: backward compatibility check gave %v", test.name, err)
+		}
+		if err := CheckCompatibility(old, new, FORWARD); (err == nil) != test.forward {
+			t.Errorf("%s: forward compatibility check gave %v", test.name, err)
+		}
+		if err := CheckCompatibility(old, new, FULL); (err == nil) != (test.backward && test.forward) {
+			t.Errorf("%s: full compatibility check gave %v", test.name, err)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+
+	r := NewRegistry()
+	if err := r.Validate("Bernie", "anything"); err != nil {
+		t.Fatalf("A topic without a schema should accept anything, got: %v", err)
+	}
+
+	v1, err := r.Register("Bernie", []byte(`{"type":"object","properties":{"Id":{"type":"integer"}}}`), "")
+	if err != nil || v1.Version != 1 {
+		t.Fatalf("Register gave %+v, %v", v1, err)
+	}
+
+	// Making Id required isn't backward compatible, the default
+	if _, err := r.Register("Bernie", []byte(`{"type":"object","required":["Id"]}`), ""); err == nil {
+		t.Fatal("Expected an incompatible schema to be refused")
+	}
+
+	v2, err := r.Register("Bernie", []byte(`{"type":"object","required":["Id"]}`), NONE)
+	if err != nil || v2.Version != 2 {
+		t.Fatalf("Register with no compatibility gave %+v, %v", v2, err)
+	}
+
+	if err := r.Validate("Bernie", decode(t, `{"Content": "x"}`)); err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("Expected a validation error against version 2, got: %v", err)
+	}
+
+	got, err := r.Get("Bernie", 1)
+	if err != nil || got != v1 {
+		t.Errorf("Get version 1 gave %+v, %v", got, err)
+	}
+	if _, err := r.Get("Bernie", 3); err != ErrNotFound {
+		t.Errorf("Get version 3 gave %v", err)
+	}
+}
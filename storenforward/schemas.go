@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/storenforward/codec"
+	"gsamples/storenforward/schema"
+	"gsamples/types"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+/*
+Schemas. A JSON Schema can be registered for a topic by POSTing it to SCHEMA_PATTERN?topic=<topic>, optionally with
+compatibility=backward|forward|full|none. Each registration is a new version, which has to be compatible with the
+previous one. A GET returns the latest schema, or the one given by the version parameter.
+
+Once a topic has a schema, every message published to it is decoded and checked against the latest version, and
+rejected with a 400 if it doesn't match. So that a message can be checked, it has to be published in a self
+describing format: JSON, MessagePack or CBOR.
+
+In a cluster a schema is registered on every node.
+*/
+
+const (
+	SCHEMA_PATTERN        = "/schema"
+	SCHEMA_VERSION_HEADER = "X-Schema-Version"
+)
+
+func (b *broker) processSchema(w http.ResponseWriter, r *http.Request) {
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		fmt.Println("Missing Topic")
+		http.Error(w, "Missing Topic", BAD_REQUEST)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		version := 0
+		if vs := r.URL.Query().Get("version"); vs != "" {
+			var err error
+			if version, err = strconv.Atoi(vs); err != nil {
+				http.Error(w, "Invalid version - "+err.Error(), BAD_REQUEST)
+				return
+			}
+		}
+
+		v, err := b.schemas.Get(topic, version)
+		if err != nil {
+			http.Error(w, "No such schema", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Header().Set(SCHEMA_VERSION_HEADER, strconv.Itoa(v.Version))
+		w.Write(v.Raw)
+
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fmt.Printf("Error reading body: %+v\n", err)
+			http.Error(w, "Cannot read schema", BAD_REQUEST)
+			return
+		}
+
+		v, err := b.schemas.Register(topic, body, r.URL.Query().Get("compatibility"))
+		if err != nil {
+			fmt.Printf("Schema not registered for %s: %+v\n", topic, err)
+			status := BAD_REQUEST
+			var incompatible *schema.IncompatibleError
+			if errors.As(err, &incompatible) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		fmt.Printf("Registered version %d of the schema for %s\n", v.Version, topic)
+		if b.cluster != nil && r.Header.Get(FORWARDED_HEADER) == "" {
+			b.cluster.broadcastSchema(r.URL.Query(), body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(SCHEMA_VERSION_HEADER, strconv.Itoa(v.Version))
+		json.NewEncoder(w).Encode(v)
+
+	default:
+		fmt.Println("recieved a non-GET or POST request")
+		http.Error(w, "Unsupported request method", 404)
+	}
+}
+
+// Check a message against its topic's schema, if there is one.
+func (b *broker) validateMessage(env *types.Envelope) error {
+
+	if _, err := b.schemas.Get(env.Topic, 0); err == schema.ErrNotFound {
+		return nil
+	}
+
+	dec, err := codec.Get(env.ContentType)
+	if err != nil {
+		return fmt.Errorf("can't check %s messages against a schema", env.ContentType)
+	}
+	body, err := plainBody(env)
+	if err != nil {
+		return fmt.Errorf("can't decompress message to check it against the schema: %v", err)
+	}
+	var v interface{}
+	if err := dec.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("can't decode message to check it against the schema: %v", err)
+	}
+	return b.schemas.Validate(env.Topic, v)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"io"
+	"net/http"
+	"time"
+)
+
+/*
+Snapshots. A topic's stored messages can be exported, with their sequence numbers and the rest of their metadata, and
+imported into another storenforward, or another topic, e.g. to seed a test environment with production data or to
+move a topic from one storenforward to another.
+
+	GET  SNAPSHOT_PATTERN?topic=<topic>                - exports what's stored on the topic
+	POST SNAPSHOT_PATTERN?topic=<topic>&mode=<mode>    - imports a snapshot into the topic
+
+A snapshot is JSON lines, of SNAPSHOT_TYPE: a snapshotHeader saying what it is, then each message's envelope, oldest
+first, with its body base64'd as JSON does for bytes. Bodies are as they were stored, which may be compressed, as
+their Encoding says. Expired messages aren't exported, or imported.
+
+The mode says what happens to the sequence numbers on import:
+
+	preserve - they're kept, so subscribers that keep offsets can carry on where they were (the default). Messages
+	           with a sequence number the topic's already got to are skipped, so importing the same snapshot twice
+	           does nothing the second time.
+	append   - the messages are stored as new ones, after whatever the topic has already. Their idempotency keys
+	           are kept, so the ones still in the idempotency window aren't stored twice either.
+
+Imported messages are passed on to the topic's subscribers as though they'd just been published. They aren't checked
+against the topic's schema, as they were when they were first published. In a cluster only append is supported, as
+the nodes have to agree on the sequence numbers.
+*/
+
+const (
+	SNAPSHOT_PATTERN = "/snapshot"
+	SNAPSHOT_TYPE    = "application/vnd.storenforward.snapshot+jsonl"
+	SNAPSHOT_FORMAT  = "storenforward-snapshot"
+	SNAPSHOT_VERSION = 1
+	SNAPSHOT_LINE    = 64 << 20 // The longest line we'll read from a snapshot, i.e. the biggest message
+	MODE_PRESERVE    = "preserve"
+	MODE_APPEND      = "append"
+)
+
+var errPreserveCluster = errors.New("sequence numbers can't be preserved in a cluster; use mode=append")
+
+// The first line of a snapshot.
+type snapshotHeader struct {
+	Format   string
+	Version  int
+	Topic    string    // The topic it was exported from
+	Broker   string    // and the storenforward
+	Exported time.Time // When
+	Count    int       // How many messages follow
+	First    uint64    // The first one's sequence number
+	Last     uint64    // and the last one's
+}
+
+// What an import did.
+type importResult struct {
+	Topic    string
+	Imported int
+	Skipped  int    // Already there, expired, or duplicates
+	First    uint64 // The sequence numbers the imported messages were stored as
+	Last     uint64
+}
+
+func (b *broker) processSnapshot(w http.ResponseWriter, r *http.Request) {
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "Missing Topic", BAD_REQUEST)
+		return
+	}
+	if isReplyTopic(topic) {
+		http.Error(w, "Reply topics aren't stored", BAD_REQUEST)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		b.exportTopic(w, topic)
+	case "POST":
+		b.importTopic(w, r, topic)
+	default:
+		http.Error(w, "Unsupported request method", 404)
+	}
+}
+
+// Write out what's stored on a topic and has been passed on to its subscribers.
+func (b *broker) exportTopic(w http.ResponseWriter, topic string) {
+
+	rb := b.getRingBuf(topic)
+	rb.mut.Lock()
+	var envs []*types.Envelope
+	now := time.Now()
+	for seq := rb.oldest(); seq <= rb.commit; seq++ {
+		if env := rb.entry(seq); env != nil && !env.Expired(now) {
+			envs = append(envs, env)
+		}
+	}
+	rb.mut.Unlock()
+
+	h := snapshotHeader{Format: SNAPSHOT_FORMAT, Version: SNAPSHOT_VERSION, Topic: topic, Broker: b.name, Exported: now, Count: len(envs)}
+	if len(envs) > 0 {
+		h.First, h.Last = envs[0].Sequence, envs[len(envs)-1].Sequence
+	}
+
+	w.Header().Set("Content-Type", SNAPSHOT_TYPE)
+	enc := json.NewEncoder(w) // Which puts each one on its own line
+	enc.Encode(h)
+	for _, env := range envs {
+		enc.Encode(env) // The envelopes can't change once they're stored, so they're safe to use unlocked
+	}
+	fmt.Printf("Exported %d messages from %s\n", len(envs), topic)
+}
+
+// Read a snapshot into a topic.
+func (b *broker) importTopic(w http.ResponseWriter, r *http.Request, topic string) {
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = MODE_PRESERVE
+	}
+	if mode != MODE_PRESERVE && mode != MODE_APPEND {
+		http.Error(w, "Unknown mode "+mode+"; it's preserve or append", BAD_REQUEST)
+		return
+	}
+	if mode == MODE_PRESERVE && b.cluster != nil {
+		http.Error(w, errPreserveCluster.Error(), NOT_SUPPORTED)
+		return
+	}
+
+	envs, err := readSnapshot(r.Body)
+	if err != nil {
+		fmt.Printf("Cannot read snapshot for %s: %+v\n", topic, err)
+		http.Error(w, "Invalid snapshot - "+err.Error(), BAD_REQUEST)
+		return
+	}
+
+	res := importResult{Topic: topic}
+	now := time.Now()
+	var live []*types.Envelope
+	for _, env := range envs {
+		if env.Expired(now) {
+			res.Skipped++
+			continue
+		}
+		env.Topic = topic
+		live = append(live, env)
+	}
+
+	if mode == MODE_PRESERVE {
+		b.importPreserving(live, topic, &res)
+	} else if len(live) > 0 {
+		seqs, dups, err := b.addAllToStore(live, topic)
+		if err != nil {
+			fmt.Printf("Cannot import into %s: %+v\n", topic, err)
+			http.Error(w, "Cannot store messages - "+err.Error(), UNAVAILABLE)
+			return
+		}
+		for i, seq := range seqs {
+			if dups[i] {
+				res.Skipped++
+				continue
+			}
+			if res.Imported == 0 {
+				res.First = seq
+			}
+			res.Imported++
+			res.Last = seq
+		}
+	}
+
+	fmt.Printf("Imported %d messages into %s, skipped %d\n", res.Imported, topic, res.Skipped)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Store the messages with the sequence numbers they've got, skipping those the topic's already got to.
+func (b *broker) importPreserving(envs []*types.Envelope, topic string, res *importResult) {
+
+	rb := b.getRingBuf(topic)
+	rb.mut.Lock()
+	for _, env := range envs {
+		if env.Sequence <= rb.seq {
+			res.Skipped++
+			continue
+		}
+		rb.skipTo(env.Sequence - 1)
+		rb.append(env)
+		if res.Imported == 0 {
+			res.First = env.Sequence
+		}
+		res.Imported++
+		res.Last = env.Sequence
+	}
+	forwarded := b.commitTo(rb, rb.seq)
+	rb.mut.Unlock()
+
+	waitForwarded(forwarded)
+}
+
+// Move the ring on to the given sequence number, leaving the slots for the messages in between empty. The caller
+// must hold the ring lock.
+func (rb *ringBuf) skipTo(seq uint64) {
+	if seq > rb.seq+BUFF_SIZE {
+		rb.seq = seq - BUFF_SIZE // The whole ring's emptied either way
+	}
+	for rb.seq < seq {
+		rb.seq++
+		rb.buf.Value = nil
+		rb.buf = rb.buf.Next()
+	}
+}
+
+// Read the envelopes in a snapshot, checking it is one, and that they're in order.
+func readSnapshot(r io.Reader) ([]*types.Envelope, error) {
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), SNAPSHOT_LINE)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("it's empty")
+	}
+	var h snapshotHeader
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil || h.Format != SNAPSHOT_FORMAT {
+		return nil, errors.New("it doesn't start with a snapshot header")
+	}
+	if h.Version > SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("version %d is newer than we know about", h.Version)
+	}
+
+	var envs []*types.Envelope
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		env := &types.Envelope{}
+		if err := json.Unmarshal(scanner.Bytes(), env); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if env.Sequence == 0 || (len(envs) > 0 && env.Sequence <= envs[len(envs)-1].Sequence) {
+			return nil, fmt.Errorf("line %d: sequence number %d is out of order", line, env.Sequence)
+		}
+		envs = append(envs, env)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(envs) != h.Count {
+		return nil, fmt.Errorf("the header says %d messages, but there are %d", h.Count, len(envs))
+	}
+	return envs, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gsamples/storenforward/client"
+	"io/ioutil"
+	"os"
+)
+
+/*
+Exports a topic from a storenforward to a file, or imports such a file into a storenforward:
+
+	snapshot export -broker http://prod:7868 -topic Orders -o orders.snapshot
+	snapshot import -broker http://test:7868 [-topic Orders] [-mode preserve|append] orders.snapshot
+
+An import goes into the topic it was exported from unless -topic says otherwise. With -mode preserve, the default,
+the messages keep their sequence numbers, and any the topic already has are skipped; with -mode append they're
+stored after what's already there.
+*/
+
+const BROKER = "http://localhost:7868"
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(os.Args[2:])
+	case "import":
+		err = importFile(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: snapshot export -topic <topic> [-broker <url>] [-o <file>]")
+	fmt.Fprintln(os.Stderr, "       snapshot import [-broker <url>] [-topic <topic>] [-mode preserve|append] <file>")
+	os.Exit(2)
+}
+
+func export(args []string) error {
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	broker := flags.String("broker", BROKER, "the storenforward to export from")
+	topic := flags.String("topic", "", "the topic to export")
+	out := flags.String("o", "", "the file to write the snapshot to; by default standard output")
+	flags.Parse(args)
+	if *topic == "" {
+		usage()
+	}
+
+	snapshot, err := client.NewBroker(*broker).Export(context.Background(), *topic)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(snapshot)
+		return err
+	}
+	if err := ioutil.WriteFile(*out, snapshot, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %s from %s to %s\n", *topic, *broker, *out)
+	return nil
+}
+
+func importFile(args []string) error {
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	broker := flags.String("broker", BROKER, "the storenforward to import into")
+	topic := flags.String("topic", "", "the topic to import into; by default the one the snapshot was exported from")
+	mode := flags.String("mode", client.MODE_PRESERVE, "preserve to keep the sequence numbers, append to store the messages as new ones")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	snapshot, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *topic == "" {
+		if *topic, err = client.SnapshotTopic(snapshot); err != nil {
+			return fmt.Errorf("%s: %v", flags.Arg(0), err)
+		}
+	}
+
+	res, err := client.NewBroker(*broker).Import(context.Background(), *topic, *mode, snapshot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d messages into %s on %s as %d to %d, skipped %d\n", res.Imported, res.Topic, *broker, res.First, res.Last, res.Skipped)
+	return nil
+}
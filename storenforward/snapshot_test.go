@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gsamples/storenforward/client"
+	"gsamples/types"
+	"strings"
+	"testing"
+)
+
+// A topic exported from one storenforward and imported into another keeps its sequence numbers and metadata, and
+// importing it again, or appending it where it's already been, doesn't store anything twice.
+func TestSnapshot(t *testing.T) {
+
+	lnA, _ := listen(t)
+	lnB, _ := listen(t)
+	a := startBroker(t, lnA, "a")
+	b := startBroker(t, lnB, "b")
+	ctx := context.Background()
+
+	p := client.NewPublisher(a.url)
+	p.ProducerId = "snapshot-test"
+	for i := 1; i <= 5; i++ {
+		if _, err := p.Publish(ctx, "Orders", &types.Message{Id: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot, err := client.NewBroker(a.url).Export(ctx, "Orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic, _ := client.SnapshotTopic(snapshot); topic != "Orders" || strings.Count(string(snapshot), "\n") != 6 {
+		t.Fatalf("Snapshot of %q is\n%s", topic, snapshot)
+	}
+
+	into := client.NewBroker(b.url)
+	res, err := into.Import(ctx, "Orders", "", snapshot)
+	if err != nil || res.Imported != 5 || res.First != 1 || res.Last != 5 {
+		t.Fatalf("Import got %+v, %v", res, err)
+	}
+	rb := b.b.getRingBuf("Orders")
+	rb.mut.Lock()
+	env := rb.entry(3)
+	seq, commit := rb.seq, rb.commit
+	rb.mut.Unlock()
+	if seq != 5 || commit != 5 || env == nil || env.ProducerId != "snapshot-test" || env.Key == "" || !strings.Contains(string(env.Body), `"Id":3`) {
+		t.Errorf("After importing, the store is at %d, committed %d, with message 3 %+v", seq, commit, env)
+	}
+
+	// Again, which does nothing, then appended to the same topic, where the keys are already known
+	if res, err := into.Import(ctx, "Orders", client.MODE_PRESERVE, snapshot); err != nil || res.Imported != 0 || res.Skipped != 5 {
+		t.Errorf("Importing again got %+v, %v", res, err)
+	}
+	if res, err := into.Import(ctx, "Orders", client.MODE_APPEND, snapshot); err != nil || res.Imported != 0 || res.Skipped != 5 {
+		t.Errorf("Appending got %+v, %v", res, err)
+	}
+	if seq := publish(t, b, "Orders", `{"Id":6}`); seq != "6" {
+		t.Errorf("Published after importing as %s", seq)
+	}
+
+	// Into another topic, as new messages
+	res, err = into.Import(ctx, "Copy", client.MODE_APPEND, snapshot)
+	if err != nil || res.Imported != 5 || res.First != 1 {
+		t.Errorf("Appending to a new topic got %+v, %v", res, err)
+	}
+	if got := stored(b, "Copy"); len(got) != 5 {
+		t.Errorf("Copy has %v", got)
+	}
+}
+
+// A snapshot that skips sequence numbers leaves gaps in the store, and one that isn't a snapshot is turned down.
+func TestSnapshotGapsAndErrors(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	into := client.NewBroker(n.url)
+	into.Retries = 0
+	ctx := context.Background()
+
+	line := func(seq int) string { return fmt.Sprintf(`{"Sequence":%d,"Body":"e30="}`, seq) }
+	header := func(count int) string {
+		return fmt.Sprintf(`{"Format":"%s","Version":1,"Count":%d}`, SNAPSHOT_FORMAT, count)
+	}
+
+	snapshot := strings.Join([]string{header(3), line(2), line(7), line(100)}, "\n")
+	if res, err := into.Import(ctx, "Orders", "", []byte(snapshot)); err != nil || res.Imported != 3 {
+		t.Fatalf("Import got %+v, %v", res, err)
+	}
+	rb := n.b.getRingBuf("Orders")
+	rb.mut.Lock()
+	if rb.seq != 100 || rb.entry(100) == nil || rb.entry(99) != nil || rb.entry(7) != nil {
+		t.Errorf("The store's at %d", rb.seq)
+	}
+	rb.mut.Unlock()
+
+	for _, bad := range []string{
+		"",
+		line(1),
+		header(2) + "\n" + line(2) + "\n" + line(1),
+		header(2) + "\n" + line(1),
+		header(1) + "\nnot json",
+	} {
+		if _, err := into.Import(ctx, "Orders", "", []byte(bad)); err == nil {
+			t.Errorf("Imported %q", bad)
+		}
+	}
+	if _, err := into.Import(ctx, "Orders", "sideways", []byte(header(0))); err == nil {
+		t.Errorf("Imported with an unknown mode")
+	}
+}
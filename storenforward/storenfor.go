@@ -1,66 +1,281 @@
 package main
 
 import (
-	"bytes"
 	"container/ring"
+	"context"
+	"crypto/rand"
 	"errors"
+	"flag"
 	"fmt"
+	"gsamples/storenforward/codec"
+	"gsamples/storenforward/schema"
+	"gsamples/storenforward/trace"
+	"gsamples/types"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type replyMsg struct {
-	replyTo *url.URL // When to send the request
-	body    *[]byte  // What to send this time
+	replyTo *url.URL        // When to send the request
+	env     *types.Envelope // What to send this time
 }
 
 // This describes where to reply
 type subscriber struct {
-	reply url.URL       // key = id, value = subscriber information. Added for clarity only.
-	ch    chan replyMsg // Where to send the replay. Use of a channel is more complex, but will maintain message order.
+	dropped   uint64        // Messages thrown away because the queue was full. First, so that it's 64 bit aligned for sync/atomic.
+	id        string        // The subscriber's id, unique within the topic, e.g. a UUID
+	topic     string        // The topic subscribed to
+	reply     url.URL       // key = id, value = subscriber information. Added for clarity only.
+	ch        chan replyMsg // The subscriber's queue. Use of a channel is more complex, but will maintain message order.
+	batchSize int           // The most messages to send in one POST, agreed at subscribe time
+	linger    time.Duration // How long to wait for a batch to fill up before sending what we've got
+	overflow  string        // What to do when the queue is full - one of the OVERFLOW_ values
+	blockFor  time.Duration // How long a publisher will wait for room in the queue, for OVERFLOW_BLOCK
+	accept    string        // The content type the subscriber wants its messages in; empty for as published
+	encoding  string        // The Content-Encoding the subscriber wants compressed messages in; empty for decompressed
+	from      uint64        // The first sequence number to send from the store on subscribing; 0 for all of it
+	epoch     string        // The store from is a sequence number in, if the subscriber said
+	replayed  uint64        // The last sequence number sent from the store on subscribing. Anything up to here isn't sent again.
+	tracer    *trace.Tracer // The broker's, for the enqueue and deliver spans; nil when tracing's off
+	done      chan struct{} // Closed when the subscriber is removed, which stops forward()
+	closer    sync.Once     // Makes sure done is only closed once
 }
 
-type subscribers map[int]subscriber // All the subscribers, by id, for a topic
+type subscribers map[string]*subscriber // All the subscribers, by id, for a topic
 
-// defines a ring (circular list) and a mutex to lock access to it
+// defines a ring (circular list) and a mutex to lock access to it. Each slot in the ring holds a *types.Envelope.
 type ringBuf struct {
-	buf *ring.Ring  // The ring buffer
-	mut *sync.Mutex // Something to lock access to the buffer...
+	buf    *ring.Ring        // The ring buffer. This is where the next message goes; the one before it is the latest.
+	mut    *sync.Mutex       // Something to lock access to the buffer...
+	seq    uint64            // The sequence number given to the last message stored on this topic
+	epoch  string            // Which store the sequence numbers are from; a new one is started with each empty ring
+	commit uint64            // The last sequence number passed on to the subscribers
+	staged []*types.Envelope // What's been stored since then, oldest first, whether or not it's still in the ring
+	dedup  *dedupWindow      // The idempotency keys recently published to this topic
+	raft   *topicState       // The topic's cluster state; nil unless we're part of a cluster
+
+	pending    []forwardItem // What's been committed, or subscribed, and not passed on to the subscribers yet
+	flushed    chan struct{} // Closed once what's pending now has been passed on
+	forwarding bool          // A forwardPending() is passing on what's pending
 }
 
-const (
-	IN_PATTERN  = "/message"   // URL used to receive the data
-	SUB_PATTERN = "/subscribe" // URL used to subscribe to the data
-	PORT        = ":7868"
-	BAD_REQUEST = 400 // Simple HTTP status code
-	BUFF_SIZE   = 40  // Allows us to keep this many messages in memory.
-)
+// Something for a topic's subscribers, in the order it happened: a message to pass on to them, or a new subscriber
+// to send what's in the store to and then add to the topic.
+type forwardItem struct {
+	env    *types.Envelope
+	sub    *subscriber
+	replay []*types.Envelope // What's in the store for the new subscriber
+	upTo   uint64            // The commit when it subscribed, which it's been sent everything up to
+}
 
-var (
-	submap = make(map[string]subscribers) // record the subscribers for a topic by id
+// A broker is one store and forward server: its topics, their subscribers and everything else it holds on to. It's
+// usually the only one in the process, but the cluster tests run several.
+type broker struct {
+	submap map[string]subscribers // record the subscribers for a topic by id
+	subMut *sync.RWMutex          // guards submap and the subscribers in it
+
+	strmap map[string]*ringBuf // record the data we're storing
+	strMut *sync.Mutex         // guards strmap itself; each ringBuf has its own lock
+
+	delayed *scheduler       // The messages waiting to be stored
+	schemas *schema.Registry // The schemas for each topic
+	cluster *cluster         // The other nodes; nil when running on our own
+	bridges []*bridgeRoute   // The topics mirrored from other storenforwards
+	replies *replyWaiters    // The requests waiting for replies
+	txns    *transactions    // The open transactions
+	tracer  *trace.Tracer    // Adds the storenforward's spans to messages' traces; nil when tracing's off
+
+	name      string // What we call ourselves, e.g. to other storenforwards
+	advertise string // The URL other storenforwards can reach us on
+
+	dedupWindowTime time.Duration // How long idempotency keys are remembered for
+	dedupWindowMax  int           // and the most that are remembered per topic
+	compressOver    int           // Messages bigger than this are compressed for storage
+	maxGoroutines   int           // Above this many goroutines we're too busy to be ready; 0 for no limit
+	draining        int32         // Set, atomically, once we've started to shut down, when we're not ready
+
+	done    chan struct{} // Closed by stop(), which ends the broker's goroutines
+	stopper sync.Once
+}
 
-	strmap = make(map[string]ringBuf) // record the data we're storing
+const (
+	IN_PATTERN    = "/message"     // URL used to receive the data
+	BATCH_PATTERN = "/batch"       // URL used to receive many messages in one request
+	SUB_PATTERN   = "/subscribe"   // URL used to subscribe to the data
+	UNSUB_PATTERN = "/unsubscribe" // URL used to stop subscribing
+	PORT          = ":7868"
+	BAD_REQUEST   = 400 // Simple HTTP status code
+	UNAVAILABLE   = 503 // The message couldn't be stored right now, e.g. a cluster without a leader for its topic
+	BUFF_SIZE     = 40  // Allows us to keep this many messages in memory.
+	MAX_ID_LENGTH = 128 // The longest a subscriber's id can be
 )
 
 // This is the store and forward. To work it needs a list of clients (host names) In this simple example, the client must
 // honour the incoming client API (URL Pattern).
-// The client subscribes / registers with the storenforward. In this simple example, clients don't unregister.
+// The client subscribes / registers with the storenforward, and unregisters when it's done.
 
 func main() {
 
-	fmt.Printf("Starting - store and forward - listening on port %s for pattern %s\n", PORT, IN_PATTERN)
-	http.HandleFunc(IN_PATTERN, processIncomingMessage)
-	http.HandleFunc(SUB_PATTERN, addSubscriber)
+	b := newBroker()
+	addr := flag.String("addr", PORT, "the address to listen on")
+	self := flag.String("self", "", "this node's URL, e.g. http://10.0.0.1:7868, when it's part of a cluster")
+	peers := flag.String("peers", "", "the URLs of all the nodes in the cluster, comma separated, this one included")
+	var bridges stringList
+	flag.Var(&bridges, "bridge", "mirror topics from another storenforward, e.g. \"http://siteb:7868 Bernie=siteb.*,Orders\"")
+	flag.StringVar(&b.advertise, "advertise", "", "the URL other storenforwards can reach this one on; by default -self, or localhost")
+	flag.StringVar(&b.name, "name", "", "this storenforward's name, which must be unique among those it's bridged with; by default its URL")
+	flag.DurationVar(&b.dedupWindowTime, "dedup-window", DEDUP_WINDOW, "how long idempotency keys are remembered for")
+	flag.IntVar(&b.dedupWindowMax, "dedup-max", DEDUP_MAX, "the most idempotency keys remembered per topic")
+	flag.IntVar(&b.compressOver, "compress-over", COMPRESS_OVER, "compress messages bigger than this many bytes for storage; 0 for never")
+	flag.IntVar(&b.maxGoroutines, "max-goroutines", MAX_GOROUTINES, "the goroutines above which we're too busy to be ready; 0 for no limit")
+	drainFor := flag.Duration("drain", DRAIN_TIME, "how long to keep going, but not ready, when told to stop, before shutting down")
+	traceTo := flag.String("trace", "", "where to export the spans of messages' traces to: stdout, or none if it's empty")
+	flag.Parse()
+
+	var err error
+	if b.tracer, err = newTracer(*traceTo); err != nil {
+		fmt.Printf("Cannot trace: %+v\n", err)
+		os.Exit(1)
+	}
+
+	if *peers != "" {
+		if err := b.joinCluster(*self, strings.Split(*peers, ",")); err != nil {
+			fmt.Printf("Cannot join the cluster: %+v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if b.advertise == "" {
+		b.advertise = *self
+	}
+	if b.advertise == "" {
+		host := *addr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		b.advertise = "http://" + host
+	}
+	if b.name == "" {
+		b.name = b.advertise
+	}
+	for _, spec := range bridges {
+		if err := b.addBridge(spec); err != nil {
+			fmt.Printf("Cannot set up bridge: %+v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("Starting - store and forward - listening on %s for pattern %s\n", *addr, IN_PATTERN)
+	b.start()
+
+	srv := &http.Server{Addr: *addr, Handler: b.handler()}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Printf("Cannot serve: %+v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Drain when we're told to stop: stay up, but not ready, long enough for whatever's routing to us to notice,
+	// then finish what we're in the middle of and stop
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Printf("Draining for %s\n", *drainFor)
+	b.drain()
+	time.Sleep(*drainFor)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DELIVERY_TIMEOUT)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Printf("Cannot shut down cleanly: %+v\n", err)
+	}
+	b.stop()
+	fmt.Println("Stopped")
+}
+
+func newBroker() *broker {
+	b := &broker{
+		submap:          make(map[string]subscribers),
+		subMut:          &sync.RWMutex{},
+		strmap:          make(map[string]*ringBuf),
+		strMut:          &sync.Mutex{},
+		schemas:         schema.NewRegistry(),
+		replies:         newReplyWaiters(),
+		txns:            newTransactions(),
+		dedupWindowTime: DEDUP_WINDOW,
+		dedupWindowMax:  DEDUP_MAX,
+		compressOver:    COMPRESS_OVER,
+		maxGoroutines:   MAX_GOROUTINES,
+		done:            make(chan struct{}),
+	}
+	b.delayed = newScheduler(b.storeDue)
+	return b
+}
+
+// Start the broker's background goroutines.
+func (b *broker) start() {
+	go b.delayed.run(b.done)
+	go b.sweep()
+	if b.cluster != nil {
+		go b.cluster.run()
+	}
+	for n, r := range b.bridges {
+		go b.runBridge(n, r)
+	}
+}
+
+// Stop the background goroutines and the deliveries to the subscribers. Messages that are still waiting to be
+// scheduled are lost.
+func (b *broker) stop() {
+	b.stopper.Do(func() {
+		close(b.done)
+
+		b.subMut.Lock()
+		for _, subs := range b.submap {
+			for _, s := range subs {
+				s.close()
+			}
+		}
+		b.subMut.Unlock()
+	})
+}
 
-	http.ListenAndServe(PORT, nil)
+// The broker's HTTP API.
+func (b *broker) handler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(IN_PATTERN, b.route(b.processIncomingMessage))
+	mux.HandleFunc(BATCH_PATTERN, b.processBatch)
+	mux.HandleFunc(SUB_PATTERN, b.route(b.addSubscriber))
+	mux.HandleFunc(UNSUB_PATTERN, b.route(b.processUnsubscribe))
+	mux.HandleFunc(SCHEMA_PATTERN, b.processSchema)
+	mux.HandleFunc(BRIDGE_PATTERN, b.processBridged)
+	mux.HandleFunc(REQUEST_PATTERN, b.processRequest)
+	mux.HandleFunc(TXN_PATTERN, b.openTxn)
+	mux.HandleFunc(COMMIT_PATTERN, b.endTxn)
+	mux.HandleFunc(ABORT_PATTERN, b.endTxn)
+	mux.HandleFunc(SNAPSHOT_PATTERN, b.route(b.processSnapshot))
+	mux.HandleFunc(HEALTH_PATTERN, b.processHealth)
+	mux.HandleFunc(READY_PATTERN, b.processReady)
+	if b.cluster != nil {
+		b.cluster.register(mux)
+	}
+	return mux
 }
 
 // This function does the store and forward.
-func processIncomingMessage(w http.ResponseWriter, r *http.Request) {
+func (b *broker) processIncomingMessage(w http.ResponseWriter, r *http.Request) {
 
 	// This optimisation ignores anything but POSTs
 	if r.Method != "POST" {
@@ -83,44 +298,324 @@ func processIncomingMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addToStore(body, topic)
-	updateSubscribers(body, topic)
+	// Everything the publisher sent with the message goes in the envelope. The rest we fill in.
+	env := types.ReadEnvelope(r.Header, body)
+	env.Topic = topic
+	env.Sequence = 0
+	env.Received = time.Now()
+
+	// The body is stored as it came, but we may need to look inside it
+	plain, err := plainBody(env)
+	if err != nil {
+		fmt.Printf("Cannot decompress message: %+v\n", err)
+		status := BAD_REQUEST
+		if errors.Is(err, codec.ErrUnknownEncoding) {
+			status = UNSUPPORTED_MEDIA_TYPE
+		}
+		http.Error(w, "Cannot decompress message - "+err.Error(), status)
+		return
+	}
+
+	// A reply isn't stored, it goes straight back to whoever's waiting for it
+	if isReplyTopic(topic) {
+		b.deliverReply(w, env)
+		return
+	}
+
+	env.Key, err = idempotencyKey(r, plain)
+	if err != nil {
+		fmt.Printf("Cannot work out idempotency key: %+v\n", err)
+		http.Error(w, "Invalid idempotency key - "+err.Error(), BAD_REQUEST)
+		return
+	}
+
+	at, err := deliveryTime(r.URL.Query(), time.Now())
+	if err != nil {
+		fmt.Printf("Cannot work out delivery time: %+v\n", err)
+		http.Error(w, "Invalid delivery time - "+err.Error(), BAD_REQUEST)
+		return
+	}
+	from := at
+	if from.IsZero() {
+		from = env.Received
+	}
+	env.Expires, err = messageExpiry(r, from)
+	if err != nil {
+		fmt.Printf("Cannot work out expiry: %+v\n", err)
+		http.Error(w, "Invalid ttl - "+err.Error(), BAD_REQUEST)
+		return
+	}
+
+	if err := b.validateMessage(env); err != nil {
+		fmt.Printf("Rejected message for %s: %+v\n", topic, err)
+		http.Error(w, "Invalid message - "+err.Error(), BAD_REQUEST)
+		return
+	}
+	b.compressForStore(env)
+
+	if id := txnId(r); id != "" {
+		if !at.IsZero() {
+			http.Error(w, "Messages in a transaction can't be scheduled", BAD_REQUEST)
+			return
+		}
+		span := b.startStore(env)
+		span.SetAttribute("transaction", id)
+		b.addToTxn(w, id, env)
+		span.Finish()
+		return
+	}
+
+	span := b.startStore(env)
+	if !at.IsZero() {
+		// Hold on to it for now; it'll be stored and forwarded later
+		span.SetAttribute("deliver_at", at.Format(time.RFC3339Nano))
+		b.delayed.schedule(at, env)
+		span.Finish()
+		w.Header().Set(DELIVER_AT_HEADER, at.Format(time.RFC3339Nano))
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "Scheduled")
+		return
+	}
+
+	seq, dup, err := b.addToStore(env)
+	finishStore(span, seq, dup, err)
+	if err != nil {
+		fmt.Printf("Cannot store message for %s: %+v\n", topic, err)
+		http.Error(w, "Cannot store message - "+err.Error(), UNAVAILABLE)
+		return
+	}
+	w.Header().Set(types.SEQUENCE_HEADER, strconv.FormatUint(seq, 10))
+	if dup {
+		w.Header().Set(DUPLICATE_HEADER, "true")
+	}
 	io.WriteString(w, "OK")
 }
 
-// Add the latest data to the store, lazily initialising the Ring ptr.
-func addToStore(body []byte, topic string) {
+// Add the latest data to the store of the envelope's topic and return the sequence number it was given. If it's a
+// duplicate, then the sequence number is the one given to the original.
+func (b *broker) addToStore(env *types.Envelope) (uint64, bool, error) {
+	seqs, dups, err := b.addAllToStore([]*types.Envelope{env}, env.Topic)
+	if err != nil {
+		return 0, false, err
+	}
+	return seqs[0], dups[0], nil
+}
 
-	fmt.Printf("About to store bytes len: %d,  --- %v\n", len(body), body)
+// Add several messages to a topic's store in one go and pass them on to the subscribers. The ring is locked once for
+// the lot, so nobody - including a new subscriber reading the existing data - sees half of them. The subscribers are
+// updated before the lock is released, which means that they all get the topic in sequence order. This is okay as
+// updating the subscribers never waits for long.
+//
+// The envelopes are given their sequence numbers, which are also returned in the same order as the envelopes, along
+// with whether each one was a duplicate of a message already published. Duplicates aren't stored or forwarded and get
+// the original's sequence number. Once stored, an envelope mustn't be changed.
+//
+// In a cluster the messages are stored by the topic's leader, and only count as stored once most of the nodes have
+// them, so this can fail.
+func (b *broker) addAllToStore(envs []*types.Envelope, topic string) ([]uint64, []bool, error) {
+
+	if b.cluster != nil {
+		return b.cluster.store(envs, topic)
+	}
 
-	rb, ok := strmap[topic]
-	if !ok {
-		rb = ringBuf{
-			buf: ring.New(BUFF_SIZE),
-			mut: &sync.Mutex{},
+	rb := b.getRingBuf(topic)
+	rb.mut.Lock()
+	seqs, dups := rb.appendAll(envs, topic)
+	forwarded := b.commitTo(rb, rb.seq)
+	rb.mut.Unlock()
+
+	waitForwarded(forwarded)
+	return seqs, dups, nil
+}
+
+// Store messages in the ring, skipping duplicates. The caller must hold the ring lock.
+func (rb *ringBuf) appendAll(envs []*types.Envelope, topic string) ([]uint64, []bool) {
+
+	seqs := make([]uint64, len(envs))
+	dups := make([]bool, len(envs))
+
+	for i, env := range envs {
+		if seq, ok := rb.dedup.check(env.Key); ok {
+			fmt.Printf("Ignoring duplicate of message %d with key %q\n", seq, env.Key)
+			seqs[i], dups[i] = seq, true
+			continue
+		}
+
+		env.Topic = topic
+		env.Sequence = rb.seq + 1
+		env.Epoch = ""
+		rb.append(env)
+		seqs[i] = rb.seq
+	}
+	return seqs, dups
+}
+
+// Put a message in the next slot. Its Sequence must already be one more than the last. It's given the ring's Epoch,
+// which for a ring that hasn't got one yet is the message's, e.g. from the leader or a snapshot, or else a new one.
+// The caller must hold the ring lock.
+func (rb *ringBuf) append(env *types.Envelope) {
+	if rb.epoch == "" {
+		rb.epoch = env.Epoch
+		if rb.epoch == "" {
+			rb.epoch = newEpoch()
+		}
+	}
+	env.Epoch = rb.epoch
+	rb.seq = env.Sequence
+	rb.buf.Value = env
+	rb.buf = rb.buf.Next()
+	rb.dedup.add(env.Key, env.Sequence)
+	rb.staged = append(rb.staged, env)
+}
+
+// The oldest sequence number that the ring still has a slot for.
+func (rb *ringBuf) oldest() uint64 {
+	if rb.seq < BUFF_SIZE {
+		return 1
+	}
+	return rb.seq - BUFF_SIZE + 1
+}
+
+// A new store's epoch, which is random so that it's different every time the storenforward starts.
+func newEpoch() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return fmt.Sprintf("%x", raw)
+}
+
+// Get a stored message by its sequence number. It's nil if it's not in the ring any more, or it's been swept away.
+func (rb *ringBuf) entry(seq uint64) *types.Envelope {
+	if seq == 0 || seq > rb.seq || seq < rb.oldest() {
+		return nil
+	}
+	env, _ := rb.buf.Move(-int(rb.seq - seq + 1)).Value.(*types.Envelope)
+	return env
+}
+
+// Pass the stored messages up to the given sequence number on to the subscribers, if they haven't been already, and
+// return a channel that's closed once they have been. They're taken from what's staged, not the ring, as a batch, or
+// a commit in a cluster, can be more than the ring holds. The caller must hold the ring lock.
+func (b *broker) commitTo(rb *ringBuf, upTo uint64) <-chan struct{} {
+	n := 0
+	for ; n < len(rb.staged) && rb.staged[n].Sequence <= upTo; n++ {
+		if rb.staged[n].Sequence > rb.commit {
+			rb.pending = append(rb.pending, forwardItem{env: rb.staged[n]})
 		}
 	}
+	rb.staged = append([]*types.Envelope(nil), rb.staged[n:]...)
+	if upTo > rb.commit {
+		rb.commit = upTo
+	}
+	return b.startForwarding(rb)
+}
+
+// Closed from the start, for when there's nothing to wait for.
+var nothingPending = make(chan struct{})
+
+func init() {
+	close(nothingPending)
+}
+
+// Make sure that what's pending for a topic's subscribers is being passed on, and return a channel that's closed once
+// it has been. The caller must hold the ring lock.
+func (b *broker) startForwarding(rb *ringBuf) <-chan struct{} {
+	if len(rb.pending) == 0 {
+		return nothingPending
+	}
+	if !rb.forwarding {
+		rb.forwarding = true
+		go b.forwardPending(rb)
+	}
+	return rb.flushed
+}
+
+// Pass on what's pending for a topic's subscribers, in order, until there's nothing left. There's only ever one of
+// these running for a topic. It runs without the ring lock, so a subscriber that makes it wait, with OVERFLOW_BLOCK,
+// holds up the topic's deliveries, and the publishers waiting for them, but not the store: publishing, subscribing,
+// sweeping and so on carry on.
+func (b *broker) forwardPending(rb *ringBuf) {
 
 	rb.mut.Lock()
-	rb.buf.Value = body
-	r := rb.buf.Next()
-	rb.buf = r
-	strmap[topic] = rb
+	for len(rb.pending) > 0 {
+		items, flushed := rb.pending, rb.flushed
+		rb.pending, rb.flushed = nil, make(chan struct{})
+		rb.mut.Unlock()
+
+		for _, item := range items {
+			if item.sub != nil {
+				b.addWithExisting(item)
+			} else {
+				b.updateSubscribers(item.env)
+			}
+		}
+		close(flushed)
+		rb.mut.Lock()
+	}
+	rb.forwarding = false
 	rb.mut.Unlock()
 }
 
-// Now send the data to any clients.
-func updateSubscribers(body []byte, topic string) {
-	subscribers := submap[topic]
+// Wait for messages to be passed on to the subscribers, which only takes a while if one of them has asked for
+// OVERFLOW_BLOCK, but for no longer than a publisher's ever made to wait, however many subscribers there are.
+func waitForwarded(forwarded <-chan struct{}) {
+	timer := time.NewTimer(MAX_BLOCK * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-forwarded:
+	case <-timer.C:
+	}
+}
+
+// Get the store for a topic, lazily initialising the Ring ptr.
+func (b *broker) getRingBuf(topic string) *ringBuf {
+
+	b.strMut.Lock()
+	defer b.strMut.Unlock()
+
+	rb, ok := b.strmap[topic]
+	if !ok {
+		rb = &ringBuf{
+			buf:     ring.New(BUFF_SIZE),
+			mut:     &sync.Mutex{},
+			dedup:   newDedupWindow(b.dedupWindowTime, b.dedupWindowMax),
+			flushed: make(chan struct{}),
+		}
+		if b.cluster != nil {
+			rb.raft = newTopicState()
+		}
+		b.strmap[topic] = rb
+	}
+	return rb
+}
+
+// All the topics' stores, by topic.
+func (b *broker) ringBufs() map[string]*ringBuf {
+
+	b.strMut.Lock()
+	defer b.strMut.Unlock()
+
+	rbs := make(map[string]*ringBuf, len(b.strmap))
+	for topic, rb := range b.strmap {
+		rbs[topic] = rb
+	}
+	return rbs
+}
+
+// Now send the data to any clients. Each one has its own queue, so a slow subscriber only holds things up for itself,
+// unless it's asked for OVERFLOW_BLOCK, and even then only for a while. This is only called by forwardPending.
+func (b *broker) updateSubscribers(env *types.Envelope) {
 
-	for id, subs := range subscribers {
+	b.subMut.RLock()
+	subs := make([]*subscriber, 0, len(b.submap[env.Topic]))
+	for _, s := range b.submap[env.Topic] {
+		subs = append(subs, s)
+	}
+	b.subMut.RUnlock()
 
-		msg := replyMsg{
-			replyTo: &subs.reply,
-			body:    &body,
+	for _, s := range subs {
+		if !s.enqueue(env) {
+			b.removeSubscriber(s)
 		}
-		fmt.Printf("forwarding to : %d\n", id)
-		subs.ch <- msg
 	}
 }
 
@@ -130,9 +625,13 @@ To subscribe, the caller must:
 2) a unique id.
 3) the topic to which its subscribing.
 
-The subscriber must know how to unmarshall the message
+The subscriber must know how to unmarshall the message. It's sent what's in the store first, or with from=<seq> only
+the stored messages from that sequence number on, so that a subscriber that keeps track of what it's processed can
+pick up where it left off. Sequence numbers start again from 1 when the store does, e.g. when the storenforward's
+restarted, so a subscriber can say which store from is in with epoch=<the messages' Epoch>. If it's not this one, or
+from is past anything we've stored, then the store must have started again since, and it's sent everything.
 */
-func addSubscriber(w http.ResponseWriter, r *http.Request) {
+func (b *broker) addSubscriber(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "GET" {
 		fmt.Println("recieved a non-GET request")
@@ -141,9 +640,7 @@ func addSubscriber(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ids := r.URL.Query().Get("id")
-
-	id, err := strconv.Atoi(ids)
+	id, err := subscriberId(r.URL.Query())
 	if err != nil {
 		fmt.Printf("Cannot decode id: %+v\n", err)
 		http.Error(w, "Invalid id - "+err.Error(), BAD_REQUEST)
@@ -170,86 +667,210 @@ func addSubscriber(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing Topic", BAD_REQUEST)
 		return
 	}
+	if isReplyTopic(topic) {
+		http.Error(w, "Cannot subscribe to a reply topic", BAD_REQUEST)
+		return
+	}
 
-	subs, ok := submap[topic]
-	if !ok {
-		subs = make(subscribers)
-		submap[topic] = subs
+	batchSize, linger, err := negotiateBatch(r.URL.Query())
+	if err != nil {
+		fmt.Printf("Cannot decode batch parameters: %+v\n", err)
+		http.Error(w, "Invalid batch parameters - "+err.Error(), BAD_REQUEST)
+		return
+	}
+
+	queueSize, overflow, blockFor, err := negotiateQueue(r.URL.Query())
+	if err != nil {
+		fmt.Printf("Cannot decode queue parameters: %+v\n", err)
+		http.Error(w, "Invalid queue parameters - "+err.Error(), BAD_REQUEST)
+		return
 	}
 
-	s := subscriber{
-		reply: *reply,              // Save the reply
-		ch:    make(chan replyMsg), // Create somewhere to send the data message
+	// Which format does it want? An empty string means it'll take them as they were published.
+	accept := r.URL.Query().Get("accept")
+	if accept == "" {
+		accept = r.Header.Get("Accept")
+	}
+	contentType, err := codec.Negotiate(accept)
+	if err != nil {
+		fmt.Printf("Cannot agree a content type for %q: %+v\n", accept, err)
+		http.Error(w, "Cannot supply any of "+accept, http.StatusNotAcceptable)
+		return
 	}
 
-	subs[id] = s
+	encoding := negotiateEncoding(r.Header)
+
+	var from uint64
+	if f := r.URL.Query().Get("from"); f != "" {
+		if from, err = strconv.ParseUint(f, 10, 64); err != nil {
+			fmt.Printf("Cannot decode from: %+v\n", err)
+			http.Error(w, "Invalid from - "+err.Error(), BAD_REQUEST)
+			return
+		}
+	}
+
+	s := &subscriber{
+		id:        id,
+		topic:     topic,
+		reply:     *reply,                         // Save the reply
+		ch:        make(chan replyMsg, queueSize), // Create somewhere to send the data message
+		batchSize: batchSize,
+		linger:    linger,
+		overflow:  overflow,
+		blockFor:  blockFor,
+		accept:    contentType,
+		encoding:  encoding,
+		from:      from,
+		epoch:     r.URL.Query().Get("epoch"),
+		tracer:    b.tracer,
+		done:      make(chan struct{}),
+	}
+
+	// Tell the subscriber what it's getting, which may be less than it asked for
+	w.Header().Set(BATCH_HEADER, strconv.Itoa(batchSize))
+	w.Header().Set(LINGER_HEADER, strconv.FormatInt(int64(linger/time.Millisecond), 10))
+	w.Header().Set(QUEUE_HEADER, strconv.Itoa(queueSize))
+	w.Header().Set(OVERFLOW_HEADER, overflow)
+	if contentType != "" {
+		w.Header().Set(ACCEPT_HEADER, contentType)
+	}
+	if encoding != "" {
+		w.Header().Set(ACCEPT_ENCODING_HEADER, encoding)
+	}
+	if b.name != "" {
+		w.Header().Set(BROKER_HEADER, b.name)
+	}
 
 	// start listening for messages
 	go s.forward()
 
-	// Send back existing data...
-	go updateWithExisting(topic, &s)
+	// Send back existing data, which also adds the subscriber to the topic
+	b.updateWithExisting(topic, s)
 
 	// Okay, so now we're subscribed....
 
 }
 
-// Read the messages from the channel and send on via HTTP.
-func (s *subscriber) forward() {
+// Add a subscriber to its topic, replacing and stopping any earlier subscriber with the same id. This is only called by
+// forwardPending, so it comes between the messages sent to the subscriber from the store and those committed later.
+func (b *broker) registerSubscriber(s *subscriber) {
 
-	fmt.Println("listening for messages...")
-	for {
+	b.subMut.Lock()
+	defer b.subMut.Unlock()
 
-		msg := <-s.ch
-		fmt.Printf("received message. Replying to: %s, data: %s\n", msg.replyTo.String(), string(*msg.body))
+	subs, ok := b.submap[s.topic]
+	if !ok {
+		subs = make(subscribers)
+		b.submap[s.topic] = subs
+	}
+	if old, ok := subs[s.id]; ok {
+		old.close()
+	}
+	subs[s.id] = s
+}
 
-		// This uses a Request as it gives you more control than a http.Post()
-		req, err := http.NewRequest("POST", s.reply.String(), bytes.NewBuffer(*msg.body))
-		req.Header.Set("Content-Type", "application/json")
+// Take a subscriber off its topic and stop it.
+func (b *broker) removeSubscriber(s *subscriber) {
 
-		client := &http.Client{} // For example you can setuo client values such as time out if necessary
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Printf("Error in Posting to subscriber: %+v\n", err)
-		} else {
-			// Now display the response:
-			body, _ := ioutil.ReadAll(resp.Body)
-			fmt.Printf("Response status %s, Headers: %v, Body: %s\n", resp.Status, resp.Header, body)
-			resp.Body.Close()
-		}
+	b.subMut.Lock()
+	if subs, ok := b.submap[s.topic]; ok && subs[s.id] == s {
+		delete(subs, s.id)
+	}
+	b.subMut.Unlock()
+
+	fmt.Printf("Removed subscriber %s from topic %s, dropped %d messages\n", s.id, s.topic, atomic.LoadUint64(&s.dropped))
+	s.close()
+}
+
+/*
+To unsubscribe, the caller POSTs the topic and the id it subscribed with, e.g. as it shuts down, so the storenforward
+stops sending to somewhere that's no longer there. Whatever's still queued for it is thrown away. If there's no such
+subscriber - it's already gone, or was dropped for not keeping up - the answer is 404.
+*/
+func (b *broker) processUnsubscribe(w http.ResponseWriter, r *http.Request) {
 
+	if r.Method != "POST" {
+		fmt.Println("recieved a non-POST request")
+		http.Error(w, "Unsupported request method", 404)
+		return
 	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "Missing Topic", BAD_REQUEST)
+		return
+	}
+	id, err := subscriberId(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid id - "+err.Error(), BAD_REQUEST)
+		return
+	}
+
+	b.subMut.RLock()
+	s := b.submap[topic][id]
+	b.subMut.RUnlock()
+	if s == nil {
+		http.Error(w, "No subscriber "+id+" on "+topic, NOT_FOUND)
+		return
+	}
+	b.removeSubscriber(s)
 }
 
-// takes what we have and sends it to any new subscribers
-func updateWithExisting(topic string, s *subscriber) {
-	// Send what's in the store
-	if rb, ok := strmap[topic]; ok {
-		rb.mut.Lock()
-		defer rb.mut.Unlock()
-		if rb.buf.Len() > 0 {
+// A subscriber's id can be anything that's not too long, e.g. a UUID, or a number as it used to have to be.
+func subscriberId(query url.Values) (string, error) {
 
-			// Iterate through the ring and send its contents
-			rb.buf.Do(func(val interface{}) {
-				if val != nil {
-					sendData(val.([]byte), s)
-				}
-			})
-		} else {
-			fmt.Println("Topic with an empty buffer???")
-		}
-	} else {
-		fmt.Println("No existing data... for topic")
+	id := query.Get("id")
+	if id == "" {
+		return "", errors.New("missing id")
 	}
+	if len(id) > MAX_ID_LENGTH {
+		return "", fmt.Errorf("longer than %d characters", MAX_ID_LENGTH)
+	}
+	return id, nil
 }
 
-// Send the message to the subscriber. The data is copied for thread safety.
-func sendData(body []byte, s *subscriber) {
+// takes what we have and sends it to a new subscriber, then adds it to the topic. Both are done by the topic's
+// forwardPending, in turn with the messages being passed on to the other subscribers, so the subscriber gets
+// everything in order: what's in the store first, followed by anything published afterwards.
+func (b *broker) updateWithExisting(topic string, s *subscriber) {
+
+	rb := b.getRingBuf(topic)
+	rb.mut.Lock()
 
-	rm := replyMsg{
-		body:    &body,
-		replyTo: &s.reply,
+	if (s.epoch != "" && rb.epoch != "" && s.epoch != rb.epoch) || s.from > rb.seq+1 {
+		fmt.Printf("Subscriber %s was subscribed to an earlier store for %s; sending it everything\n", s.id, topic)
+		s.from = 0
 	}
 
-	s.ch <- rm // Put the message in the channel to be picked up bu forward().
+	// Send what's in the store and has been passed on to the subscribers already, from where the subscriber asked,
+	// apart from anything that's expired. Iterating from the current position gives the oldest first.
+	var replay []*types.Envelope
+	now := time.Now()
+	rb.buf.Do(func(val interface{}) {
+		env, _ := val.(*types.Envelope)
+		if env != nil && env.Sequence >= s.from && env.Sequence <= rb.commit && !env.Expired(now) {
+			replay = append(replay, env)
+		}
+	})
+	rb.pending = append(rb.pending, forwardItem{sub: s, replay: replay, upTo: rb.commit})
+	forwarded := b.startForwarding(rb)
+	rb.mut.Unlock()
+
+	waitForwarded(forwarded)
+}
+
+// Send a new subscriber what's in the store for it, then add it to its topic.
+func (b *broker) addWithExisting(item forwardItem) {
+
+	s := item.sub
+	for _, env := range item.replay {
+		if !s.enqueue(env) {
+			// It can't even keep up with what's in the store
+			fmt.Printf("Subscriber %s disconnected while sending existing data\n", s.id)
+			s.close()
+			return
+		}
+	}
+	s.replayed = item.upTo
+	b.registerSubscriber(s)
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/types"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A subscriber that asks for the store from a sequence number only gets it from there.
+func TestSubscribeFrom(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	for _, body := range []string{`{"Id":1}`, `{"Id":2}`, `{"Id":3}`} {
+		publish(t, n, "Orders", body)
+	}
+
+	var mut sync.Mutex
+	var got []string
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mut.Lock()
+		got = append(got, string(body))
+		mut.Unlock()
+	}))
+	defer sub.Close()
+
+	params := url.Values{"id": {"1"}, "topic": {"Orders"}, "replyto": {sub.URL}, "from": {"2"}}
+	resp, err := http.Get(n.url + SUB_PATTERN + "?" + params.Encode())
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Subscribe failed: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	publish(t, n, "Orders", `{"Id":4}`)
+
+	eventually(t, "the subscriber to get its messages", func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		return len(got) >= 3
+	})
+	mut.Lock()
+	defer mut.Unlock()
+	if s := strings.Join(got, "|"); s != `{"Id":2}|{"Id":3}|{"Id":4}` {
+		t.Errorf("Subscriber got %s", s)
+	}
+}
+
+// A subscriber can have any id, and once it's unsubscribed it's sent nothing more.
+func TestUnsubscribe(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+
+	var mut sync.Mutex
+	var got []string
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mut.Lock()
+		got = append(got, string(body))
+		mut.Unlock()
+	}))
+	defer sub.Close()
+
+	params := url.Values{"id": {"8b2f4f4e-3c1a-4d6e-9f0a-2b7c5d9e1f30"}, "topic": {"Orders"}, "replyto": {sub.URL}}
+	resp, err := http.Get(n.url + SUB_PATTERN + "?" + params.Encode())
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Subscribe failed: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	publish(t, n, "Orders", `{"Id":1}`)
+	eventually(t, "the subscriber to get its message", func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		return len(got) == 1
+	})
+
+	unsubscribe := func() int {
+		resp, err := http.Post(n.url+UNSUB_PATTERN+"?"+params.Encode(), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := unsubscribe(); status != http.StatusOK {
+		t.Fatalf("Unsubscribe answered %d", status)
+	}
+	if status := unsubscribe(); status != http.StatusNotFound {
+		t.Errorf("Unsubscribing again answered %d", status)
+	}
+
+	publish(t, n, "Orders", `{"Id":2}`)
+	time.Sleep(100 * time.Millisecond)
+	mut.Lock()
+	defer mut.Unlock()
+	if len(got) != 1 {
+		t.Errorf("Got %v after unsubscribing", got)
+	}
+}
+
+// Every message has the store's epoch, and a subscriber that asks for the store from a sequence number in another
+// epoch, or one that's past what's stored, gets all of it, as the store must have started again.
+func TestSubscribeEpoch(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	for i := 1; i <= 3; i++ {
+		publishId(n, "Orders", i)
+	}
+
+	all := newTestReceiver(t)
+	subscribeReceiver(t, n, all, "Orders", url.Values{})
+	eventually(t, "the store", func() bool { return len(all.seqs()) == 3 })
+	all.mut.Lock()
+	epoch := all.envs[0][0].Epoch
+	for _, envs := range all.envs {
+		if envs[0].Epoch != epoch || epoch == "" {
+			t.Errorf("Message %d has epoch %q, not %q", envs[0].Sequence, envs[0].Epoch, epoch)
+		}
+	}
+	all.mut.Unlock()
+
+	for _, c := range []struct {
+		params url.Values
+		want   string
+	}{
+		{url.Values{"from": {"2"}, "epoch": {epoch}}, "[2 3]"},
+		{url.Values{"from": {"2"}, "epoch": {"another"}}, "[1 2 3]"},
+		{url.Values{"from": {"10"}}, "[1 2 3]"},
+	} {
+		rec := newTestReceiver(t)
+		subscribeReceiver(t, n, rec, "Orders", c.params)
+		eventually(t, "the store", func() bool { return len(rec.seqs()) >= 2 })
+		time.Sleep(50 * time.Millisecond)
+		if got := fmt.Sprint(rec.seqs()); got != c.want {
+			t.Errorf("Subscribing with %v got %s", c.params, got)
+		}
+	}
+}
+
+// Everything stored in one go is passed on to the subscribers, even when it's more than the ring holds, on its own
+// and in a cluster.
+func TestCommitMoreThanRing(t *testing.T) {
+
+	ln, _ := listen(t)
+	single := startBroker(t, ln, "")
+	for _, n := range []*testNode{single, startCluster(t, 3)[0]} {
+		rec := newTestReceiver(t)
+		subscribeReceiver(t, n, rec, "Orders", url.Values{"batch": {"100"}})
+
+		var envs []*types.Envelope
+		for i := 1; i <= BUFF_SIZE*2+20; i++ {
+			envs = append(envs, &types.Envelope{ContentType: types.DEFAULT_TYPE, Body: []byte(fmt.Sprintf(`{"Id":%d}`, i))})
+		}
+		if _, _, err := n.b.addAllToStore(envs, "Orders"); err != nil {
+			t.Fatalf("Cannot store on %s: %v", n.url, err)
+		}
+		eventually(t, "every message", func() bool { return len(rec.seqs()) >= len(envs) })
+		time.Sleep(50 * time.Millisecond)
+		for i, seq := range rec.seqs() {
+			if seq != uint64(i+1) || len(rec.seqs()) != len(envs) {
+				t.Fatalf("%s sent %v", n.url, rec.seqs())
+			}
+		}
+	}
+}
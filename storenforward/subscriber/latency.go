@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gsamples/storenforward/bench"
+	"gsamples/types"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Latency mode. With -latency the subscriber doesn't print each message, but works out how long each one took to get
+here from its Time, which the publisher's -load mode sets to when it was sent, and every so often prints the
+percentiles and how many messages a second are arriving. The publisher and the subscriber need to be on the same
+machine, or at least to have their clocks in step, for the figures to mean anything.
+*/
+
+const LATENCY_REPORT = 5 * time.Second
+
+var (
+	latency   = flag.Bool("latency", false, "report end to end latency, from when each message was sent, rather than printing the messages")
+	latencies = bench.NewLatencies()
+	received  uint64 // Messages received since the last report
+)
+
+func recordLatency(msg types.Message) {
+	latencies.Record(time.Since(msg.Time))
+	atomic.AddUint64(&received, 1)
+}
+
+// Print the end to end latency every so often, forever.
+func reportLatency() {
+	for range time.Tick(LATENCY_REPORT) {
+		n := atomic.SwapUint64(&received, 0)
+		fmt.Printf("Received %.1f messages/s, end to end latency %s\n", float64(n)/LATENCY_REPORT.Seconds(), latencies.Summary())
+	}
+}
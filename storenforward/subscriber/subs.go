@@ -1,132 +1,140 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
+	"gsamples/storenforward/client"
+	"gsamples/storenforward/codec"
+	"gsamples/storenforward/trace"
 	"gsamples/types"
-	"io"
-	"io/ioutil"
-	"math/rand"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	PATTERN = "/forward"
-	PORT    = 7868
-	TOPIC   = "Bernie"
+	BROKER   = "http://localhost:7868"
+	TOPIC    = "Bernie"
+	BATCH    = 10              // Ask for up to this many messages per delivery
+	LINGER   = 100             // and for the storenforward to wait up to this many milliseconds to fill a batch
+	SHUTDOWN = 5 * time.Second // How long to take over unsubscribing and finishing what we're doing when told to stop
 )
 
 var (
-	randomSeq *rand.Rand
-	port      int
-)
-
-// The default number generator is deterministic, so it'll
-// produce the same sequence of numbers each time by default.
-// To produce varying sequences, give it a seed that changes.
-// The random number is to create a unique id
-func init() {
-	// If we run lots of these,they could clash, but thisi s only a sample
-	seed := rand.NewSource(time.Now().UnixNano())
-	randomSeq = rand.New(seed)
-
-	port = PORT + randomSeq.Intn(100)
-
-}
-
-func main() {
-	fmt.Printf("Starting - subscriber - listening on port %d for pattern %s\n", port, PATTERN)
-
-	if !subscribe() {
-		os.Exit(1)
+	id        = flag.String("id", "", "our subscriber id, which should be unique; by default a new UUID. Give the same one on restarting to replace the old subscriptions.")
+	listen    = flag.String("listen", ":0", "the address to listen for messages on; by default any free port")
+	host      = flag.String("host", "", "the host the storenforward can reach us on; by default the one we're listening on, or localhost")
+	topics    = flag.String("topics", TOPIC, "the topics to subscribe to, comma separated")
+	accept    = flag.String("accept", "", "the content type to receive messages in; by default as they were published")
+	encoding  = flag.String("encoding", "", "the Content-Encodings we can take compressed messages in, e.g. gzip")
+	offsets   = flag.String("offsets", "", "a file to keep track of the messages handled in, so they're only handled once across restarts")
+	tracing   = flag.Bool("trace", false, "handle each message in a span of its trace, and write our spans to stdout")
+	workers   = flag.Int("workers", 4, "how many topics' messages can be handled at once; 0 to handle each delivery as it comes in")
+	processor *client.ExactlyOnce
+	metrics   = client.NewMetrics()
+	replier   = client.NewPublisher(BROKER) // For replying to requests
+
+	// What handling the messages changes, which is saved along with the offsets
+	state struct {
+		Handled uint64 // How many messages we've handled, which is added to by every worker
 	}
-
-	http.HandleFunc(PATTERN, processMessage)
-	http.ListenAndServe(":"+strconv.Itoa(port), nil)
-}
+)
 
 /*
-To subscribe, the caller must:
-1) provide a listen port (but only so that I can run this on the same machine)
-2) a unique id.
-3) the return URL pattern
-
-The subscriber must know how to unmarshall the message
+The subscriber is a client.Consumer, which listens on the one port for all the topics and passes each message to
+handleMessage. Anything we've seen before, e.g. sent again from the store when we subscribed, is skipped by the
+ExactlyOnce middleware, and a handler that panics fails the delivery rather than stopping us.
 */
-func subscribe() bool {
-
-	u, err := createURL()
-	if err != nil {
-		return false
+func main() {
+	flag.Parse()
+
+	var store client.OffsetStore = client.NewMemoryOffsetStore()
+	if *offsets != "" {
+		var err error
+		if store, err = client.NewFileOffsetStore(*offsets, &state); err != nil {
+			fmt.Printf("Cannot open %s: %+v\n", *offsets, err)
+			os.Exit(1)
+		}
 	}
-
-	fmt.Printf("Subscribing with %s\n", u)
-
-	response, err := http.Get(u)
-	if err != nil {
-		fmt.Printf("Subscribe error: %s - exiting.", err.Error())
-		return false
+	processor = client.NewExactlyOnce(store, nil)
+	if *latency {
+		go reportLatency()
 	}
 
-	if response.StatusCode != 200 {
-		fmt.Printf("Storenfor replied with invalid status code: %d - exiting.", response.StatusCode)
-		return false
+	c := client.NewConsumer(BROKER)
+	if *id != "" {
+		c.Id = *id
 	}
-
-	fmt.Println("Subscribed okay")
-	response.Body.Close()
-	return true
-}
-
-func createURL() (string, error) {
-
-	replyTo := "http://localhost:" + strconv.Itoa(port) + PATTERN + "?topic=" + TOPIC
-
-	sendTo, err := url.Parse("http://localhost:" + strconv.Itoa(PORT) + "/subscribe")
-	if err != nil {
-		fmt.Printf("Error parsing sendTo: %+v", err)
-		return "", err
+	c.Listen = *listen
+	c.Host = *host
+	c.Batch = BATCH
+	c.Linger = LINGER * time.Millisecond
+	c.Accept = *accept
+	c.Encoding = *encoding
+	c.From = processor.From // Only what we haven't handled yet
+	c.Epoch = processor.Epoch
+	c.Workers = *workers // Each topic's messages are still handled in order, which ExactlyOnce needs
+
+	var tracer *trace.Tracer
+	if *tracing {
+		tracer = trace.NewTracer("simple-subscriber", trace.NewStdoutExporter(os.Stdout))
+		replier.Tracer = tracer // So that a reply is part of the request's trace
+	}
+	c.Use(client.Recover, client.Tracing(tracer), metrics.Middleware, processor.Middleware)
+	for _, topic := range strings.Split(*topics, ",") {
+		c.HandleFunc(topic, handleMessage)
 	}
 
-	parameters := url.Values{}
-	id := randomSeq.Intn(100)
-	parameters.Add("id", strconv.Itoa(id))
-	parameters.Add("topic", TOPIC)
-	parameters.Add("replyto", replyTo)
-	sendTo.RawQuery = parameters.Encode()
-
-	fmt.Printf("Encoded URL is %q\n", sendTo.String())
-
-	return sendTo.String(), nil
+	fmt.Printf("Subscribing to %v as %s\n", c.Topics(), c.Id)
+	if err := c.Start(context.Background()); err != nil {
+		fmt.Printf("Subscribe error: %s - exiting.\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Subscribed okay, listening on %s\n", c.Addr())
+
+	// Run until we're told to stop, then let the storenforward know we're going before we do
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN)
+	defer cancel()
+	if err := c.Stop(ctx); err != nil {
+		fmt.Printf("Cannot unsubscribe: %+v\n", err)
+	}
+	fmt.Print(metrics)
 }
 
-// Once subscribed, then the storenforward will send messages here
-func processMessage(w http.ResponseWriter, r *http.Request) {
+// Do whatever a message is for, which here is to print it, count it, and reply to it if it's a request. A message
+// that can't be read is counted as handled, otherwise we'd never get past it.
+func handleMessage(ctx context.Context, env *types.Envelope) error {
 
-	if r.Method != "POST" {
-		fmt.Println("recieved a non-POST request")
-		err := errors.New("Unsupported request method")
-		http.Error(w, err.Error(), 404)
-		return
+	var msg types.Message
+	if err := client.Decode(env, &msg); err != nil {
+		fmt.Printf("Cannot read message %d: %+v\n", env.Sequence, err)
+		return nil
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		fmt.Printf("Error reading body: %+v\n", err)
+	handled := atomic.AddUint64(&state.Handled, 1)
+	if *latency {
+		recordLatency(msg)
+	} else {
+		fmt.Printf("Message %d on %s from %s is: %+v, %d handled so far\n", env.Sequence, env.Topic, env.ProducerId, msg, handled)
 	}
 
-	var msg types.Message
-	err = json.Unmarshal(body, &msg)
-	if err != nil {
-		fmt.Printf("Error unmarshalling body: %+v\n", err)
+	// If it's a request, then say we've got it
+	if env.ReplyTo != "" {
+		ack, _ := json.Marshal(types.Message{Topic: env.ReplyTo, Id: msg.Id, Content: "Got it", Time: time.Now()})
+		err := replier.Reply(ctx, env, &types.Envelope{ContentType: codec.JSON, Body: ack})
+		if err != nil {
+			fmt.Printf("Cannot reply to message %d: %+v\n", env.Sequence, err)
+		}
 	}
-
-	fmt.Printf("Message is: %+v\n", msg)
-
-	io.WriteString(w, "OK")
+	return nil
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"gsamples/types"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Messages are handled by several workers at once, as they are with -workers, and every one is counted.
+func TestHandleMessageWorkers(t *testing.T) {
+
+	const WORKERS, EACH = 4, 50
+	before := atomic.LoadUint64(&state.Handled)
+	var wg sync.WaitGroup
+	for w := 0; w < WORKERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 1; i <= EACH; i++ {
+				body, _ := json.Marshal(types.Message{Id: i})
+				env := &types.Envelope{Topic: "Bernie", Sequence: uint64(i), ContentType: types.DEFAULT_TYPE, Body: body}
+				handleMessage(context.Background(), env)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if handled := atomic.LoadUint64(&state.Handled) - before; handled != WORKERS*EACH {
+		t.Errorf("Handled %d, not %d", handled, WORKERS*EACH)
+	}
+}
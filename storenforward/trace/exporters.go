@@ -0,0 +1,93 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Writes each span as a line of JSON, e.g. to os.Stdout, for whatever's collecting the logs to pick up.
+type StdoutExporter struct {
+	mut *sync.Mutex
+	enc *json.Encoder
+}
+
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{mut: &sync.Mutex{}, enc: json.NewEncoder(w)}
+}
+
+// A span as it's written out, with the ids in hex as they are in a traceparent.
+type spanLine struct {
+	Trace      string
+	Span       string
+	Parent     string `json:",omitempty"`
+	Name       string
+	Service    string `json:",omitempty"`
+	Start      time.Time
+	Duration   string
+	Attributes map[string]string `json:",omitempty"`
+	Error      string            `json:",omitempty"`
+}
+
+func (e *StdoutExporter) Export(span *Span) {
+
+	line := spanLine{
+		Trace:      span.Context.TraceID.String(),
+		Span:       span.Context.SpanID.String(),
+		Name:       span.Name,
+		Service:    span.Service,
+		Start:      span.Start,
+		Duration:   span.Duration().String(),
+		Attributes: span.Attributes,
+		Error:      span.Error,
+	}
+	if span.Parent != (SpanID{}) {
+		line.Parent = span.Parent.String()
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.enc.Encode(line)
+}
+
+// Keeps the spans it's given, for tests.
+type MemoryExporter struct {
+	mut   *sync.Mutex
+	spans []*Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{mut: &sync.Mutex{}}
+}
+
+func (e *MemoryExporter) Export(span *Span) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// The spans exported so far, in the order they were finished.
+func (e *MemoryExporter) Spans() []*Span {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// The spans with the given name in a trace.
+func (e *MemoryExporter) Find(trace TraceID, name string) []*Span {
+	var found []*Span
+	for _, span := range e.Spans() {
+		if span.Context.TraceID == trace && span.Name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+// Forget the spans exported so far.
+func (e *MemoryExporter) Reset() {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.spans = nil
+}
@@ -0,0 +1,220 @@
+/*
+Package trace follows a message through the system, from the publisher, through the storenforward, to the subscriber's
+handler, so that you can see where it went and where the time went.
+
+The trace context goes from one process to the next in a W3C traceparent (https://www.w3.org/TR/trace-context/),
+which is what OpenTelemetry and most other tracing systems use, so the traces can be joined up with theirs:
+
+	traceparent: 00-<32 hex digit trace id>-<16 hex digit parent span id>-<2 hex digit flags>
+
+Each step a message goes through is a Span, which is started by a Tracer and handed to its Exporter when it's
+finished. What an Exporter does with the spans is up to it: StdoutExporter writes them out as JSON lines, and
+MemoryExporter keeps them for tests. Anything else, e.g. sending them on to an OpenTelemetry collector, is an Exporter
+of your own.
+
+A nil *Tracer is a tracer that's switched off. It starts nil Spans, which do nothing, so code that's traced needn't
+check whether tracing's on.
+*/
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	VERSION = "00"         // The only version of traceparent there is so far
+	SAMPLED = byte(1 << 0) // The flag saying the trace is being recorded
+)
+
+var ErrInvalid = errors.New("invalid traceparent")
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// Which trace a span is in, and which span it is. This is what's passed on from one process to the next.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// Whether there's a trace context at all. The zero SpanContext isn't one; all zero ids aren't allowed.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&SAMPLED != 0
+}
+
+// The traceparent for the span context, or "" if it isn't valid.
+func (sc SpanContext) String() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%s-%02x", VERSION, sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// Read a traceparent. Later versions are read as far as this one goes, as the spec says.
+func Parse(traceparent string) (SpanContext, error) {
+
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == VERSION && len(parts) != 4) {
+		return sc, ErrInvalid
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, ErrInvalid
+	}
+
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, ErrInvalid
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, ErrInvalid
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalid
+	}
+	return sc, nil
+}
+
+// Decode exactly len(into) bytes of lower case hex.
+func decodeHex(into []byte, s string) bool {
+	if len(s) != 2*len(into) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(into, []byte(s))
+	return err == nil
+}
+
+// What a span's exported as.
+type Span struct {
+	Name       string
+	Service    string // The Tracer's
+	Context    SpanContext
+	Parent     SpanID // Zero for the first span in a trace
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string // Why it failed, if it did
+
+	tracer *Tracer
+}
+
+// The span's trace context, to pass on. It's the zero SpanContext for a nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// The span's traceparent, or "" for a nil span.
+func (s *Span) TraceParent() string {
+	return s.SpanContext().String()
+}
+
+func (s *Span) SetAttribute(name, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[name] = value
+}
+
+// Record that whatever the span's for failed. A nil error does nothing.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// End the span and export it, if it's sampled. A span must only be finished once, and not changed after.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if s.Context.Sampled() && s.tracer.Exporter != nil {
+		s.tracer.Exporter.Export(s)
+	}
+}
+
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// An Exporter is given every sampled span when it's finished. It's called from whichever goroutine finished the span,
+// so it must be safe to use from several at once, and it shouldn't keep them waiting.
+type Exporter interface {
+	Export(span *Span)
+}
+
+// A Tracer starts spans for one service, e.g. the storenforward or a subscriber.
+type Tracer struct {
+	Service  string
+	Exporter Exporter
+}
+
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{Service: service, Exporter: exporter}
+}
+
+// Start a span as a child of the given one. If the parent isn't valid, then the span starts a new trace, which is
+// sampled. Children keep their parent's sampled flag.
+func (t *Tracer) Start(name string, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{Name: name, Service: t.Service, Start: time.Now(), tracer: t}
+	if parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Flags = parent.Flags
+		s.Parent = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Flags = SAMPLED
+	}
+	rand.Read(s.Context.SpanID[:])
+	return s
+}
+
+// Start a span as a child of the one in a traceparent, or of nothing if it's empty or can't be read.
+func (t *Tracer) StartFrom(name string, traceparent string) *Span {
+	parent, _ := Parse(traceparent)
+	return t.Start(name, parent)
+}
+
+type spanKey struct{}
+
+// A context that carries the span, so that what's done with the context is part of it.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// The span a context carries, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
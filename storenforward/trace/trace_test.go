@@ -0,0 +1,102 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := Parse(tp)
+	if err != nil || !sc.IsValid() || !sc.Sampled() || sc.String() != tp {
+		t.Fatalf("Parse got %+v, %v", sc, err)
+	}
+	if sc, err := Parse("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-whatever"); err != nil || sc.Sampled() {
+		t.Errorf("A later version got %+v, %v", sc, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01",
+	} {
+		if _, err := Parse(bad); err != ErrInvalid {
+			t.Errorf("Parsed %q", bad)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+
+	exp := NewMemoryExporter()
+	tracer := NewTracer("test", exp)
+
+	root := tracer.Start("publish", SpanContext{})
+	ctx := ContextWithSpan(context.Background(), root)
+	child := tracer.StartFrom("store", FromContext(ctx).TraceParent())
+	child.SetAttribute("topic", "Orders")
+	child.SetError(errors.New("no room"))
+	child.Finish()
+	root.Finish()
+
+	spans := exp.Spans()
+	if len(spans) != 2 || spans[0] != child || spans[1] != root {
+		t.Fatalf("Exported %v", spans)
+	}
+	if child.Context.TraceID != root.Context.TraceID || child.Parent != root.Context.SpanID || root.Parent != (SpanID{}) {
+		t.Errorf("The child %+v isn't the root's %+v", child.Context, root.Context)
+	}
+	if child.Attributes["topic"] != "Orders" || child.Error != "no room" || child.End.Before(child.Start) {
+		t.Errorf("The child is %+v", child)
+	}
+	if len(exp.Find(root.Context.TraceID, "store")) != 1 {
+		t.Errorf("Cannot find the child")
+	}
+
+	// What isn't sampled isn't exported, but is still passed on
+	exp.Reset()
+	unsampled := tracer.Start("deliver", SpanContext{TraceID: root.Context.TraceID, SpanID: root.Context.SpanID})
+	unsampled.Finish()
+	if len(exp.Spans()) != 0 || unsampled.Context.TraceID != root.Context.TraceID {
+		t.Errorf("Unsampled span %+v was exported", unsampled)
+	}
+
+	// Switched off, nothing happens
+	var off *Tracer
+	span := off.StartFrom("handle", root.TraceParent())
+	span.SetAttribute("topic", "Orders")
+	span.Finish()
+	if span != nil || span.TraceParent() != "" || FromContext(ContextWithSpan(context.Background(), span)) != nil {
+		t.Errorf("A nil tracer started %+v", span)
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+
+	var out bytes.Buffer
+	tracer := NewTracer("storenforward", NewStdoutExporter(&out))
+	span := tracer.Start("store", SpanContext{})
+	span.SetAttribute("seq", "1")
+	span.Finish()
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("Cannot read %s: %v", out.String(), err)
+	}
+	if line["Trace"] != span.Context.TraceID.String() || line["Name"] != "store" || line["Service"] != "storenforward" {
+		t.Errorf("Wrote %s", out.String())
+	}
+	if _, ok := line["Parent"]; ok {
+		t.Errorf("A root span has a parent: %s", out.String())
+	}
+}
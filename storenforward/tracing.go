@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"gsamples/storenforward/trace"
+	"gsamples/types"
+	"os"
+	"strconv"
+)
+
+/*
+Tracing. A message can be followed from the publisher, through the storenforward, to the subscriber's handler. Its
+trace context comes in as a W3C traceparent header, is kept in the envelope's TraceParent while it's stored, and goes
+out to the subscriber in the traceparent header, or in each envelope of a batch. See the trace package.
+
+With -trace the storenforward adds its own spans to the trace:
+
+	store   - from the message being accepted to it being stored, scheduled or added to a transaction
+	enqueue - putting it on a subscriber's queue, one for each subscriber
+	deliver - sending it to the subscriber, until the subscriber answers
+
+Each one is the parent of the next, so the publisher's span is the parent of store, and deliver is the parent of
+whatever the subscriber does with it. Without -trace the traceparent is passed on as it came, so the publisher's span
+is the subscriber's parent.
+*/
+
+const (
+	TRACE_STDOUT = "stdout" // Write the spans to stdout as JSON lines
+)
+
+// Make the tracer for the -trace flag. An empty exporter is none, which switches tracing off.
+func newTracer(exporter string) (*trace.Tracer, error) {
+	switch exporter {
+	case "":
+		return nil, nil
+	case TRACE_STDOUT:
+		return trace.NewTracer("storenforward", trace.NewStdoutExporter(os.Stdout)), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q; it's %s", exporter, TRACE_STDOUT)
+}
+
+// Start the span for storing a message, as a child of the publisher's, and make it the message's parent from here on.
+func (b *broker) startStore(env *types.Envelope) *trace.Span {
+	span := b.tracer.StartFrom("store", env.TraceParent)
+	if span != nil {
+		span.SetAttribute("topic", env.Topic)
+		env.TraceParent = span.TraceParent()
+	}
+	return span
+}
+
+// Record what happened to a message that was stored, or wasn't.
+func finishStore(span *trace.Span, seq uint64, dup bool, err error) {
+	if span == nil {
+		return
+	}
+	if err == nil {
+		span.SetAttribute("seq", strconv.FormatUint(seq, 10))
+	}
+	if dup {
+		span.SetAttribute("duplicate", "true")
+	}
+	span.SetError(err)
+	span.Finish()
+}
+
+// Start the span for putting a message on a subscriber's queue. What's queued is a copy of the envelope with the span
+// as its parent, as the stored envelope mustn't change.
+func (s *subscriber) startEnqueue(env *types.Envelope) (*trace.Span, *types.Envelope) {
+	span := s.tracer.StartFrom("enqueue", env.TraceParent)
+	if span == nil {
+		return nil, env
+	}
+	span.SetAttribute("topic", s.topic)
+	span.SetAttribute("subscriber", s.id)
+	span.SetAttribute("seq", strconv.FormatUint(env.Sequence, 10))
+
+	queued := *env
+	queued.TraceParent = span.TraceParent()
+	return span, &queued
+}
+
+// Start a span for delivering each message in a batch, and make each one the parent of what's sent.
+func (s *subscriber) startDeliver(batch []*types.Envelope) []*trace.Span {
+	if s.tracer == nil {
+		return nil
+	}
+	spans := make([]*trace.Span, len(batch))
+	for i, env := range batch {
+		span := s.tracer.StartFrom("deliver", env.TraceParent)
+		span.SetAttribute("topic", s.topic)
+		span.SetAttribute("subscriber", s.id)
+		span.SetAttribute("seq", strconv.FormatUint(env.Sequence, 10))
+		span.SetAttribute("batch", strconv.Itoa(len(batch)))
+		delivered := *env
+		delivered.TraceParent = span.TraceParent()
+		batch[i] = &delivered
+		spans[i] = span
+	}
+	return spans
+}
+
+// Finish the delivery spans with what the subscriber said.
+func finishDeliver(spans []*trace.Span, err error) {
+	for _, span := range spans {
+		span.SetError(err)
+		span.Finish()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"gsamples/storenforward/client"
+	"gsamples/storenforward/trace"
+	"gsamples/types"
+	"testing"
+)
+
+// Follow a span's parents back to the start of its trace, giving their names, e.g. handle, deliver, ..., publish.
+func ancestry(spans []*trace.Span, span *trace.Span) []string {
+	byId := make(map[trace.SpanID]*trace.Span)
+	for _, s := range spans {
+		byId[s.Context.SpanID] = s
+	}
+	var names []string
+	id := span.Context.TraceID
+	for ; span != nil; span = byId[span.Parent] {
+		if span.Context.TraceID != id {
+			return append(names, "another trace")
+		}
+		names = append(names, span.Name)
+	}
+	return names
+}
+
+// A message can be followed from the publisher, through the store, to each subscriber's handler, whether it's sent
+// to the subscriber on its own or in a batch.
+func TestTracing(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	spans := trace.NewMemoryExporter()
+	tracer := trace.NewTracer("test", spans)
+	n.b.tracer = tracer
+
+	single := newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) { c.Use(client.Tracing(tracer)) })
+	batched := newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) {
+		c.Batch = 5
+		c.Use(client.Tracing(tracer))
+	})
+
+	p := newHarnessPublisher(n.url, "tracer")
+	p.Tracer = tracer
+	root := tracer.Start("order", trace.SpanContext{})
+	if _, err := p.Publish(trace.ContextWithSpan(context.Background(), root), "Orders", &types.Message{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	root.Finish()
+	single.wait(1)
+	batched.wait(1)
+
+	id := root.Context.TraceID
+	eventually(t, "both handlers' spans", func() bool { return len(spans.Find(id, "handle")) == 2 })
+	all := spans.Spans()
+	for _, handle := range spans.Find(id, "handle") {
+		if got := ancestry(all, handle); len(got) != 6 || got[1] != "deliver" || got[2] != "enqueue" || got[3] != "store" || got[4] != "publish" || got[5] != "order" {
+			t.Errorf("Handled in %v", got)
+		}
+		if handle.Attributes["seq"] != "1" || handle.Error != "" {
+			t.Errorf("Handle span is %+v", handle)
+		}
+	}
+	if deliver := spans.Find(id, "deliver"); len(deliver) != 2 || deliver[0].Attributes["subscriber"] == deliver[1].Attributes["subscriber"] {
+		t.Errorf("Delivered in %+v", deliver)
+	}
+
+	// The stored message keeps the store span as its parent, e.g. for replaying it to a new subscriber
+	rb := n.b.getRingBuf("Orders")
+	rb.mut.Lock()
+	env := rb.entry(1)
+	rb.mut.Unlock()
+	if store := spans.Find(id, "store"); len(store) != 1 || env.TraceParent != store[0].TraceParent() || store[0].Attributes["seq"] != "1" {
+		t.Errorf("Stored with %q, store spans %+v", env.TraceParent, store)
+	}
+}
+
+// A storenforward that isn't tracing passes the trace on as it came.
+func TestTracingPassedOn(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	spans := trace.NewMemoryExporter()
+	tracer := trace.NewTracer("test", spans)
+
+	sub := newHarnessSub(t, n.url, "Orders", func(c *client.Consumer) { c.Use(client.Tracing(tracer)) })
+	p := newHarnessPublisher(n.url, "tracer")
+	p.Tracer = tracer
+	if _, err := p.Publish(context.Background(), "Orders", &types.Message{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	sub.wait(1)
+
+	eventually(t, "the handler's span", func() bool { return len(spans.Spans()) == 2 })
+	handle := spans.Find(spans.Spans()[0].Context.TraceID, "handle")
+	if len(handle) != 1 {
+		t.Fatalf("Exported %+v", spans.Spans())
+	}
+	if got := ancestry(spans.Spans(), handle[0]); len(got) != 2 || got[0] != "handle" || got[1] != "publish" {
+		t.Errorf("Handled in %v", got)
+	}
+}
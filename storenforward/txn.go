@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsamples/types"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Transactions. A publisher can publish to several topics and have the messages stored all together or not at all:
+
+	POST TXN_PATTERN                - opens a transaction; its id comes back in TXN_HEADER and the body
+	POST IN_PATTERN?topic=..&txn=id - adds a message to it (the id can go in TXN_HEADER instead of the parameter)
+	POST COMMIT_PATTERN?txn=id      - stores and forwards the lot
+	POST ABORT_PATTERN?txn=id       - throws them away
+
+A message added to a transaction is checked as if it were being published on its own, so a bad one is turned down
+straight away, but it isn't stored until the commit. The commit locks every topic in the transaction - in topic
+order, so that two commits can't wait for each other - then stores the messages and queues them up for the
+subscribers in the order they were added, before letting go. So a subscriber never sees part of a transaction, and
+subscribers to the same topics all see transactions in the same order. The reply to the commit has one result per
+message, like the reply to a batch.
+
+Duplicates are dropped as usual, so a transaction can be committed again with the same keys if the publisher isn't
+sure the first commit went through. A transaction that isn't committed within TXN_TIMEOUT is aborted. Messages
+can't be scheduled for later in a transaction, and replies are passed on straight away, transaction or not.
+
+In a cluster a transaction is held by the node it was opened on, whichever node that is, and its messages are added
+there rather than being passed on to their topics' leaders. At the commit it's passed on to the leader of its
+topics, which stores it as above then waits for most of the nodes to have every topic's share. The topics must all
+have the same leader, as only then is there one node to store the lot; if they don't the commit is turned down with
+CONFLICT, and the transaction is gone. And a leader that fails during the commit might leave some of the topics with
+their share and some without, which the publisher sees as an error: as with any error, it can commit the same
+messages again, with the same keys, and what did get stored is dropped as duplicates.
+*/
+
+const (
+	TXN_PATTERN    = "/txn"
+	COMMIT_PATTERN = "/txn/commit"
+	ABORT_PATTERN  = "/txn/abort"
+	TXN_HEADER     = "X-Transaction"
+	TXN_TIMEOUT    = time.Minute // How long a transaction can stay open
+	MAX_TXN        = MAX_BATCH   // The most messages in one transaction
+	NOT_FOUND      = 404
+	CONFLICT       = 409
+	NOT_SUPPORTED  = 501
+)
+
+var errTxnLeaders = errors.New("the transaction's topics have different leaders, so it can't be stored as one")
+
+// An open transaction.
+type transaction struct {
+	envs   []*types.Envelope // In the order they were added
+	opened time.Time
+}
+
+// The open transactions, by id.
+type transactions struct {
+	mut  *sync.Mutex
+	open map[string]*transaction
+}
+
+func newTransactions() *transactions {
+	return &transactions{mut: &sync.Mutex{}, open: make(map[string]*transaction)}
+}
+
+// Abort the transactions that have been open too long, returning how many there were.
+func (ts *transactions) expire(now time.Time) int {
+
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+
+	count := 0
+	for id, txn := range ts.open {
+		if now.Sub(txn.opened) > TXN_TIMEOUT {
+			delete(ts.open, id)
+			count++
+		}
+	}
+	return count
+}
+
+// The transaction id a request is for, if it's for one.
+func txnId(r *http.Request) string {
+	if id := r.URL.Query().Get("txn"); id != "" {
+		return id
+	}
+	return r.Header.Get(TXN_HEADER)
+}
+
+// Open a transaction.
+func (b *broker) openTxn(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		fmt.Println("recieved a non-POST request")
+		err := errors.New("Unsupported request method")
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	id := fmt.Sprintf("%x", raw)
+
+	b.txns.mut.Lock()
+	b.txns.open[id] = &transaction{opened: time.Now()}
+	b.txns.mut.Unlock()
+
+	w.Header().Set(TXN_HEADER, id)
+	io.WriteString(w, id)
+}
+
+// Add a message, which has been checked over, to an open transaction.
+func (b *broker) addToTxn(w http.ResponseWriter, id string, env *types.Envelope) {
+
+	b.txns.mut.Lock()
+	txn, ok := b.txns.open[id]
+	full := ok && len(txn.envs) >= MAX_TXN
+	if ok && !full {
+		txn.envs = append(txn.envs, env)
+	}
+	b.txns.mut.Unlock()
+
+	switch {
+	case !ok:
+		http.Error(w, "No such transaction; it may have timed out", NOT_FOUND)
+	case full:
+		http.Error(w, fmt.Sprintf("A transaction can't have more than %d messages", MAX_TXN), BAD_REQUEST)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "Added to transaction")
+	}
+}
+
+// Commit or abort a transaction.
+func (b *broker) endTxn(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		fmt.Println("recieved a non-POST request")
+		err := errors.New("Unsupported request method")
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	id := txnId(r)
+	b.txns.mut.Lock()
+	txn, ok := b.txns.open[id]
+	delete(b.txns.open, id)
+	b.txns.mut.Unlock()
+	if !ok {
+		http.Error(w, "No such transaction; it may have timed out", NOT_FOUND)
+		return
+	}
+
+	if r.URL.Path == ABORT_PATTERN {
+		fmt.Printf("Aborted transaction %s with %d messages\n", id, len(txn.envs))
+		io.WriteString(w, "Aborted")
+		return
+	}
+
+	seqs, dups, err := b.commitTxn(txn.envs)
+	if err != nil {
+		fmt.Printf("Cannot commit transaction %s: %+v\n", id, err)
+		status := UNAVAILABLE
+		if err == errTxnLeaders {
+			status = CONFLICT
+		}
+		http.Error(w, "Cannot commit transaction - "+err.Error(), status)
+		return
+	}
+	fmt.Printf("Committed transaction %s with %d messages\n", id, len(txn.envs))
+
+	results := make([]batchResult, len(txn.envs))
+	for i, env := range txn.envs {
+		results[i] = batchResult{Index: i, Topic: env.Topic, Status: http.StatusOK, Seq: seqs[i], Dup: dups[i]}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// Store messages for several topics as one, and pass them on to the subscribers. This is addAllToStore for more than
+// one topic: every topic's ring is locked until they've all been stored and queued up to be forwarded, so a subscriber
+// sees either all of a transaction's messages for its topic or none of them. Each topic's are forwarded in turn with
+// whatever else is published to it, and publishers wait for them as they do for addAllToStore. The sequence numbers,
+// and whether each was a duplicate, come back in the same order as the envelopes.
+func (b *broker) commitTxn(envs []*types.Envelope) ([]uint64, []bool, error) {
+
+	if b.cluster != nil {
+		return b.cluster.commitTxn(envs)
+	}
+
+	topics, byTopic := txnTopics(envs)
+	rbs := b.lockTopics(topics)
+	seqs, dups := appendTxn(envs, topics, byTopic, rbs)
+
+	var forwarded []<-chan struct{}
+	for _, topic := range topics {
+		rb := rbs[topic]
+		forwarded = append(forwarded, b.commitTo(rb, rb.seq))
+		rb.mut.Unlock()
+	}
+	for _, f := range forwarded {
+		waitForwarded(f)
+	}
+	return seqs, dups, nil
+}
+
+// The topics in a transaction, in order, and the index of each topic's messages.
+func txnTopics(envs []*types.Envelope) ([]string, map[string][]int) {
+
+	byTopic := make(map[string][]int)
+	var topics []string
+	for i, env := range envs {
+		if _, ok := byTopic[env.Topic]; !ok {
+			topics = append(topics, env.Topic)
+		}
+		byTopic[env.Topic] = append(byTopic[env.Topic], i)
+	}
+	sort.Strings(topics)
+	return topics, byTopic
+}
+
+// Lock the topics' rings, in order, so that two commits can't wait for each other.
+func (b *broker) lockTopics(topics []string) map[string]*ringBuf {
+
+	rbs := make(map[string]*ringBuf, len(topics))
+	for _, topic := range topics {
+		rb := b.getRingBuf(topic)
+		rb.mut.Lock()
+		rbs[topic] = rb
+	}
+	return rbs
+}
+
+// Store a transaction's messages in the locked rings, returning the sequence numbers, and whether each was a
+// duplicate, in the same order as the envelopes.
+func appendTxn(envs []*types.Envelope, topics []string, byTopic map[string][]int, rbs map[string]*ringBuf) ([]uint64, []bool) {
+
+	seqs := make([]uint64, len(envs))
+	dups := make([]bool, len(envs))
+	for _, topic := range topics {
+		idx := byTopic[topic]
+		topicEnvs := make([]*types.Envelope, len(idx))
+		for j, i := range idx {
+			topicEnvs[j] = envs[i]
+		}
+		topicSeqs, topicDups := rbs[topic].appendAll(topicEnvs, topic)
+		for j, i := range idx {
+			seqs[i], dups[i] = topicSeqs[j], topicDups[j]
+		}
+	}
+	return seqs, dups
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// POST to a broker, returning the status and body of the reply. It's safe to call from any goroutine.
+func post(t *testing.T, url, body string) (int, string) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Errorf("POST %s failed: %v", url, err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(reply)
+}
+
+func TestTxnCommitAndAbort(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+
+	_, id := post(t, n.url+TXN_PATTERN, "")
+	for _, topic := range []string{"Orders", "Inventory", "Orders"} {
+		if status, body := post(t, n.url+IN_PATTERN+"?topic="+topic+"&txn="+id, `{"Id":1}`); status != http.StatusAccepted {
+			t.Fatalf("Adding to transaction got %d %s", status, body)
+		}
+	}
+	if len(stored(n, "Orders")) != 0 {
+		t.Fatalf("Messages stored before the commit")
+	}
+
+	status, body := post(t, n.url+COMMIT_PATTERN+"?txn="+id, "")
+	var results []batchResult
+	if err := json.Unmarshal([]byte(body), &results); status != http.StatusOK || err != nil {
+		t.Fatalf("Commit got %d %s", status, body)
+	}
+	if len(results) != 3 || results[0].Seq != 1 || results[1].Seq != 1 || results[2].Seq != 2 {
+		t.Errorf("Commit results %+v", results)
+	}
+	if len(stored(n, "Orders")) != 2 || len(stored(n, "Inventory")) != 1 {
+		t.Errorf("Stored %q and %q", stored(n, "Orders"), stored(n, "Inventory"))
+	}
+
+	// An aborted transaction stores nothing, and is gone
+	_, id = post(t, n.url+TXN_PATTERN, "")
+	post(t, n.url+IN_PATTERN+"?topic=Orders&txn="+id, `{"Id":2}`)
+	if status, _ := post(t, n.url+ABORT_PATTERN+"?txn="+id, ""); status != http.StatusOK {
+		t.Errorf("Abort got %d", status)
+	}
+	if status, _ := post(t, n.url+COMMIT_PATTERN+"?txn="+id, ""); status != NOT_FOUND {
+		t.Errorf("Commit after abort got %d", status)
+	}
+	if len(stored(n, "Orders")) != 2 {
+		t.Errorf("Aborted message was stored")
+	}
+}
+
+// Transactions committed at the same time come out in the same order on every topic.
+func TestTxnOrder(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, id := post(t, n.url+TXN_PATTERN, "")
+			for _, topic := range []string{"Orders", "Inventory"} {
+				post(t, n.url+IN_PATTERN+"?topic="+topic+"&txn="+id, fmt.Sprintf(`{"Id":%d}`, i))
+			}
+			post(t, n.url+COMMIT_PATTERN+"?txn="+id, "")
+		}(i)
+	}
+	wg.Wait()
+
+	orders, inventory := strings.Join(stored(n, "Orders"), ","), strings.Join(stored(n, "Inventory"), ",")
+	if orders != inventory || len(stored(n, "Orders")) != 15 {
+		t.Errorf("Orders has %s, Inventory has %s", orders, inventory)
+	}
+}
+
+// A transaction with more messages for a topic than the ring holds gets every one of them to the subscribers.
+func TestTxnLarge(t *testing.T) {
+
+	ln, _ := listen(t)
+	n := startBroker(t, ln, "")
+	rec := newTestReceiver(t)
+	subscribeReceiver(t, n, rec, "Orders", url.Values{"batch": {"100"}})
+
+	const COUNT = BUFF_SIZE*2 + 20
+	_, id := post(t, n.url+TXN_PATTERN, "")
+	for i := 1; i <= COUNT; i++ {
+		post(t, n.url+IN_PATTERN+"?topic=Orders&txn="+id, fmt.Sprintf(`{"Id":%d}`, i))
+	}
+	post(t, n.url+IN_PATTERN+"?topic=Inventory&txn="+id, `{"Id":0}`)
+	if status, body := post(t, n.url+COMMIT_PATTERN+"?txn="+id, ""); status != http.StatusOK {
+		t.Fatalf("Commit got %d %s", status, body)
+	}
+
+	eventually(t, "every message", func() bool { return len(rec.seqs()) >= COUNT })
+	for i, seq := range rec.seqs() {
+		if seq != uint64(i+1) || len(rec.seqs()) != COUNT {
+			t.Fatalf("Subscriber got %v", rec.seqs())
+		}
+	}
+}
+
+// In a cluster a transaction can be opened on any node, and is stored by the leader of its topics, unless they have
+// different leaders.
+func TestTxnCluster(t *testing.T) {
+
+	nodes := startCluster(t, 3)
+
+	// Find two topics with the same leader, and one with another. The leaders are spread by a hash of the topic, which
+	// the start of the name does more for than the end.
+	byLeader := make(map[string][]string)
+	var leader string
+	for i := 0; leader == "" || len(byLeader) < 2; i++ {
+		if i == 20 {
+			t.Fatalf("The topics' leaders are %v", byLeader)
+		}
+		topic := fmt.Sprint(i, "-Orders")
+		publish(t, nodes[0], topic, `{"Id":0}`)
+		l := leaderOf(nodes[0], topic)
+		byLeader[l] = append(byLeader[l], topic)
+		if len(byLeader[l]) == 2 && leader == "" {
+			leader = l
+		}
+	}
+	shared := byLeader[leader]
+	var elsewhere string
+	for l, topics := range byLeader {
+		if l != leader {
+			elsewhere = topics[0]
+		}
+	}
+	var follower *testNode
+	for _, n := range nodes {
+		if n.url != leader {
+			follower = n
+		}
+	}
+
+	// Opened, added to and committed through a node that doesn't lead its topics
+	_, id := post(t, follower.url+TXN_PATTERN, "")
+	for _, topic := range []string{shared[0], shared[1], shared[0]} {
+		if status, body := post(t, follower.url+IN_PATTERN+"?topic="+topic+"&txn="+id, `{"Id":1}`); status != http.StatusAccepted {
+			t.Fatalf("Adding to transaction got %d %s", status, body)
+		}
+	}
+	status, body := post(t, follower.url+COMMIT_PATTERN+"?txn="+id, "")
+	var results []batchResult
+	if err := json.Unmarshal([]byte(body), &results); status != http.StatusOK || err != nil {
+		t.Fatalf("Commit got %d %s", status, body)
+	}
+	if len(results) != 3 || results[0].Seq != 2 || results[1].Seq != 2 || results[2].Seq != 3 {
+		t.Errorf("Commit results %+v", results)
+	}
+	for _, n := range nodes {
+		n := n
+		eventually(t, "every node to have the transaction", func() bool {
+			return len(stored(n, shared[0])) == 3 && len(stored(n, shared[1])) == 2
+		})
+	}
+
+	// Topics with different leaders can't be stored as one
+	_, id = post(t, follower.url+TXN_PATTERN, "")
+	post(t, follower.url+IN_PATTERN+"?topic="+shared[0]+"&txn="+id, `{"Id":2}`)
+	post(t, follower.url+IN_PATTERN+"?topic="+elsewhere+"&txn="+id, `{"Id":2}`)
+	if status, body := post(t, follower.url+COMMIT_PATTERN+"?txn="+id, ""); status != CONFLICT {
+		t.Errorf("Commit across leaders got %d %s", status, body)
+	}
+	if len(stored(nodes[0], shared[0])) != 3 {
+		t.Errorf("Part of a transaction across leaders was stored")
+	}
+}
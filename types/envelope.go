@@ -0,0 +1,127 @@
+package types
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The HTTP headers that carry an Envelope's metadata, both when it's published to the storenforward and when it's
+// forwarded on to a subscriber.
+const (
+	TOPIC_HEADER       = "X-Topic"
+	SEQUENCE_HEADER    = "X-Sequence"
+	EPOCH_HEADER       = "X-Epoch"
+	RECEIVED_HEADER    = "X-Received"
+	EXPIRES_HEADER     = "X-Expires"
+	CORRELATION_HEADER = "X-Correlation-Id"
+	REPLY_TO_HEADER    = "X-Reply-To"
+	PRODUCER_HEADER    = "X-Producer-Id"
+	KEY_HEADER         = "Idempotency-Key"
+	TRACEPARENT_HEADER = "Traceparent" // The W3C trace context, see gsamples/storenforward/trace
+	HEADER_PREFIX      = "X-Header-"   // Each of an Envelope's Headers is sent as X-Header-<name>
+	DEFAULT_TYPE       = "application/json"
+)
+
+// An Envelope is a message as the storenforward sees it: the body the publisher sent, as opaque bytes, together with
+// the metadata that goes with it from the publisher, through the store, to the subscriber.
+type Envelope struct {
+	Topic         string            // The topic the message was published to
+	Sequence      uint64            // Given by the storenforward, one more than the last message stored on the topic
+	Epoch         string            // The topic's store the Sequence is from. A store that starts again from 1 has a new one.
+	Received      time.Time         // When the storenforward received the message
+	Expires       time.Time         // When the message expires. The zero time means never.
+	ContentType   string            // What the body is
+	Encoding      string            // How the body is compressed, as a Content-Encoding. Empty means it isn't.
+	CorrelationId string            // Ties related messages together, e.g. a reply to its request
+	ReplyTo       string            // The topic to send a reply to, for a request
+	ProducerId    string            // Who published the message
+	Key           string            // The publisher's idempotency key
+	TraceParent   string            // Where the message is in a trace, as a W3C traceparent. Empty if it isn't traced.
+	Headers       map[string]string // Anything else the publisher wants to send, names in canonical header form
+	Body          []byte            // The message itself
+}
+
+// Build an envelope from a message body and the HTTP headers it was sent with.
+func ReadEnvelope(h http.Header, body []byte) *Envelope {
+
+	env := &Envelope{
+		Topic:         h.Get(TOPIC_HEADER),
+		ContentType:   h.Get("Content-Type"),
+		Encoding:      h.Get("Content-Encoding"),
+		CorrelationId: h.Get(CORRELATION_HEADER),
+		ReplyTo:       h.Get(REPLY_TO_HEADER),
+		ProducerId:    h.Get(PRODUCER_HEADER),
+		Key:           h.Get(KEY_HEADER),
+		Epoch:         h.Get(EPOCH_HEADER),
+		TraceParent:   h.Get(TRACEPARENT_HEADER),
+		Body:          body,
+	}
+	if env.ContentType == "" {
+		env.ContentType = DEFAULT_TYPE
+	}
+
+	if seq, err := strconv.ParseUint(h.Get(SEQUENCE_HEADER), 10, 64); err == nil {
+		env.Sequence = seq
+	}
+	if t, err := time.Parse(time.RFC3339Nano, h.Get(RECEIVED_HEADER)); err == nil {
+		env.Received = t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, h.Get(EXPIRES_HEADER)); err == nil {
+		env.Expires = t
+	}
+
+	for name, vals := range h {
+		if strings.HasPrefix(name, HEADER_PREFIX) && len(name) > len(HEADER_PREFIX) && len(vals) > 0 {
+			if env.Headers == nil {
+				env.Headers = make(map[string]string)
+			}
+			env.Headers[name[len(HEADER_PREFIX):]] = vals[0]
+		}
+	}
+	return env
+}
+
+// Set the HTTP headers for sending the envelope's body. Only the metadata that's been filled in is sent.
+func (env *Envelope) WriteHeaders(h http.Header) {
+
+	setIf := func(name, val string) {
+		if val != "" {
+			h.Set(name, val)
+		}
+	}
+
+	contentType := env.ContentType
+	if contentType == "" {
+		contentType = DEFAULT_TYPE
+	}
+	h.Set("Content-Type", contentType)
+	setIf("Content-Encoding", env.Encoding)
+
+	setIf(TOPIC_HEADER, env.Topic)
+	if env.Sequence != 0 {
+		h.Set(SEQUENCE_HEADER, strconv.FormatUint(env.Sequence, 10))
+	}
+	setIf(EPOCH_HEADER, env.Epoch)
+	if !env.Received.IsZero() {
+		h.Set(RECEIVED_HEADER, env.Received.Format(time.RFC3339Nano))
+	}
+	if !env.Expires.IsZero() {
+		h.Set(EXPIRES_HEADER, env.Expires.Format(time.RFC3339Nano))
+	}
+	setIf(CORRELATION_HEADER, env.CorrelationId)
+	setIf(REPLY_TO_HEADER, env.ReplyTo)
+	setIf(PRODUCER_HEADER, env.ProducerId)
+	setIf(KEY_HEADER, env.Key)
+	setIf(TRACEPARENT_HEADER, env.TraceParent)
+
+	for name, val := range env.Headers {
+		h.Set(HEADER_PREFIX+name, val)
+	}
+}
+
+// Whether the message has expired.
+func (env *Envelope) Expired(now time.Time) bool {
+	return !env.Expires.IsZero() && !now.Before(env.Expires)
+}
@@ -0,0 +1,57 @@
+package types
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// An envelope comes back as it was sent through its headers.
+func TestEnvelopeHeaders(t *testing.T) {
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	env := &Envelope{
+		Topic:         "Orders",
+		Sequence:      42,
+		Epoch:         "e1",
+		Received:      now,
+		Expires:       now.Add(time.Minute),
+		ContentType:   "text/plain",
+		Encoding:      "gzip",
+		CorrelationId: "c1",
+		ReplyTo:       "Replies",
+		ProducerId:    "p1",
+		Key:           "k1",
+		TraceParent:   "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		Headers:       map[string]string{"Region": "eu"},
+		Body:          []byte("hello"),
+	}
+
+	h := http.Header{}
+	env.WriteHeaders(h)
+	if h.Get(KEY_HEADER) != "k1" || h.Get(HEADER_PREFIX+"Region") != "eu" {
+		t.Errorf("Headers are %v", h)
+	}
+	if got := ReadEnvelope(h, env.Body); !reflect.DeepEqual(got, env) {
+		t.Errorf("Got back %+v", got)
+	}
+}
+
+// Only what's filled in is sent, and an envelope without a content type is JSON.
+func TestEnvelopeEmpty(t *testing.T) {
+
+	h := http.Header{}
+	(&Envelope{}).WriteHeaders(h)
+	if len(h) != 1 || h.Get("Content-Type") != DEFAULT_TYPE {
+		t.Errorf("Headers are %v", h)
+	}
+
+	env := ReadEnvelope(http.Header{}, nil)
+	if env.ContentType != DEFAULT_TYPE || env.Sequence != 0 || !env.Received.IsZero() || env.Headers != nil {
+		t.Errorf("Got %+v", env)
+	}
+	if env.Expired(time.Now()) {
+		t.Errorf("An envelope without an expiry has expired")
+	}
+}